@@ -4,7 +4,10 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"log/slog"
+	"os"
 
 	"github.com/aalpar/wile"
 	"github.com/aalpar/wile-extension-example/internal/display"
@@ -14,14 +17,19 @@ import (
 func main() {
 	ctx := context.Background()
 
-	// Create an engine with the kvstore extension loaded.
-	store := kvstore.New()
+	// Create an engine with the kvstore extension loaded, keeping the last
+	// few versions of each key for kv-history and logging its events to
+	// stderr.
+	store := kvstore.New(
+		kvstore.WithHistory(8, 1024),
+		kvstore.WithLogger(slog.New(slog.NewTextHandler(os.Stderr, nil))),
+	)
 	engine, err := wile.NewEngine(ctx, wile.WithExtension(store))
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer func() {
-		// Close calls kvstore's Close(), which prints a summary.
+		// Close calls kvstore's Close(), which logs a summary.
 		closeErr := engine.Close()
 		if closeErr != nil {
 			log.Fatal(closeErr)
@@ -39,23 +47,144 @@ func main() {
 
 	display.Section("kv-get without default (error)")
 	display.RunExpectError(engine, `(kv-get "missing")`, `(kv-get "missing")`)
+	display.RunMultiple(engine, "branch on the error kind", `
+		(guard (e ((kv-key-not-found-error? e) (list 'missing (kv-error-key e))))
+		  (kv-get "missing"))
+	`)
+
+	display.Section("Storing datums")
+	display.Run(engine, `(kv-set! "limits" '(10 20 #(a b)))`, `(kv-set! "limits" '(10 20 #(a b)))`)
+	display.Run(engine, `(kv-get "limits")`, `(kv-get "limits")`)
+	display.RunExpectError(engine, `(kv-set! "f" car)`, `(kv-set! "f" car)`)
+
+	display.Section("kv-set! with TTL")
+	display.Run(engine, `(kv-set! "session" "abc" 60000)`, `(kv-set! "session" "abc" 60000)`)
+	display.Run(engine, `(kv-ttl "session")`, `(kv-ttl "session")`)
+	display.Run(engine, `(kv-ttl "host")`, `(kv-ttl "host")`)
 
 	display.Section("kv-count and kv-keys")
 	display.Run(engine, "(kv-count)", "(kv-count)")
 	display.Run(engine, "(kv-keys)", "(kv-keys)")
 
+	display.Section("Ordered scans")
+	display.Run(engine, `(kv-keys-with-prefix "p")`, `(kv-keys-with-prefix "p")`)
+	display.Run(engine, `(kv-range "a" "z")`, `(kv-range "a" "z")`)
+	display.Run(engine, `(kv-range-reverse "" "" 1)`, `(kv-range-reverse "" "" 1)`)
+
 	display.Section("kv-delete!")
 	display.Run(engine, `(kv-delete! "port")`, `(kv-delete! "port")`)
 	display.Run(engine, "(kv-count)", "(kv-count)")
 	display.Run(engine, "(kv-keys)", "(kv-keys)")
 
+	display.Section("Compare-and-swap and read-modify-write")
+	display.Run(engine, `(kv-cas! "host" "localhost" "db")`, `(kv-cas! "host" "localhost" "db")`)
+	display.Run(engine, `(kv-cas! "host" "localhost" "x")`, `(kv-cas! "host" "localhost" "x")`)
+	display.Run(engine, `(kv-set-if-absent! "host" "y")`, `(kv-set-if-absent! "host" "y")`)
+	display.Run(engine, `(kv-update! "hits" ... "0")`,
+		`(kv-update! "hits" (lambda (v) (number->string (+ 1 (string->number v)))) "0")`)
+
+	display.Section("Batches")
+	display.Run(engine, `(kv-set-many! '(("a" . "1") ("b" . "2")))`, `(kv-set-many! '(("a" . "1") ("b" . "2")))`)
+	display.Run(engine, `(kv-get-many '("a" "b" "z") "-")`,
+		`(let ((h (kv-get-many '("a" "b" "z") "-"))) (map (lambda (k) (hashtable-ref h k #f)) '("a" "b" "z")))`)
+	display.Run(engine, `(kv-delete-many! '("a" "b" "z"))`, `(kv-delete-many! '("a" "b" "z"))`)
+
+	display.Section("Counters")
+	display.Run(engine, `(kv-incr! "requests")`, `(kv-incr! "requests")`)
+	display.Run(engine, `(kv-add! "requests" 41)`, `(kv-add! "requests" 41)`)
+	display.Run(engine, `(kv-decr! "hits")`, `(kv-decr! "hits")`)
+	display.RunExpectError(engine, `(kv-incr! "host")`, `(kv-incr! "host")`)
+
+	display.Section("History")
+	display.Run(engine, `(kv-history "host")`, `(kv-history "host")`)
+	display.RunMultiple(engine, "revert to the first version", `
+		(kv-revert! "host" (car (car (kv-history "host"))))
+		(kv-get "host")
+	`)
+
 	display.Section("kv-clear!")
 	display.Run(engine, "(kv-clear!)", "(kv-clear!)")
 	display.Run(engine, "(kv-count)", "(kv-count)")
 
+	display.Section("kv-transaction")
+	display.RunMultiple(engine, "commit", `
+		(kv-transaction (lambda ()
+		  (kv-set! "from" "90")
+		  (kv-set! "to" "10")))
+		(kv-keys)
+	`)
+	display.RunMultiple(engine, "rollback on error", `
+		(guard (e (#t (kv-get "rolled-back" "discarded")))
+		  (kv-transaction (lambda ()
+		    (kv-set! "rolled-back" "kept")
+		    (error "abort"))))
+	`)
+
+	display.Section("kv-watch")
+	display.RunMultiple(engine, "react to changes under a prefix", `
+		(define changes '())
+		(define token
+		  (kv-watch "user/" (lambda (event key old new)
+		                      (set! changes (cons (list event key old new) changes)))))
+		(kv-set! "user/alice" "admin")
+		(kv-delete! "user/alice")
+		(kv-set! "other" "ignored")
+		(kv-unwatch token)
+		(reverse changes)
+	`)
+
+	display.Section("kv-stats")
+	display.Run(engine, "(kv-stats)", "(kv-stats)")
+
+	display.Section("Snapshots")
+	display.RunMultiple(engine, "reads ignore later writes", `
+		(kv-set! "version" "1")
+		(define snap (kv-snapshot))
+		(kv-set! "version" "2")
+		(list (kv-snapshot-get snap "version") (kv-get "version"))
+	`)
+
+	display.Section("Change feed")
+	display.RunMultiple(engine, "last two changes", `
+		(kv-changes-since (- (kv-revision) 2))
+	`)
+
+	display.Section("Named stores")
+	display.RunMultiple(engine, "isolated keyspaces", `
+		(define sessions (kv-open "sessions"))
+		(kv-store-set! sessions "alice" "token-1")
+		(list sessions (kv-store-keys sessions) (kv-count))
+	`)
+
+	display.Section("Permissions")
+	tenant, err := wile.NewEngine(ctx, wile.WithExtension(store.Restrict(kvstore.Policy{
+		ReadPrefixes:  []string{"tenant/"},
+		WritePrefixes: []string{"tenant/"},
+	})))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tenant.Close()
+	display.Run(tenant, `(kv-set! "tenant/theme" "dark")`, `(kv-set! "tenant/theme" "dark")`)
+	display.Run(tenant, "(kv-keys)", "(kv-keys)")
+	display.RunExpectError(tenant, `(kv-get "host")`, `(kv-get "host")`)
+	display.Run(tenant, `(kv-clear!) caught`,
+		`(guard (e ((kv-permission-denied-error? e) 'denied)) (kv-clear!))`)
+
 	display.Section("Use from Scheme")
 	display.RunMultiple(engine, "store and retrieve", `
 		(kv-set! "greeting" "hello")
 		(string-append (kv-get "greeting") ", world!")
 	`)
+
+	display.Section("Sharing the store with Go")
+	if err := store.Set("region", "eu-west-1"); err != nil {
+		log.Fatal(err)
+	}
+	display.Run(engine, `(kv-get "region")`, `(kv-get "region")`)
+	greeting, _, err := store.Get("greeting")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("  %-30s => %q\n", `store.Get("greeting")`, greeting)
 }
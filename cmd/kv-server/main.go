@@ -0,0 +1,119 @@
+// Command kv-server serves a kvstore over the Redis RESP2 protocol, so that
+// redis-cli and other Redis tooling can inspect a live store:
+//
+//	go run ./cmd/kv-server -addr 127.0.0.1:6380
+//	redis-cli -p 6380 set greeting hello
+//	redis-cli -p 6380 keys '*'
+//
+// With -data the store is durable, backed by a write-ahead log at that path.
+// With -http the same store is also served as a JSON REST API:
+//
+//	curl localhost:8080/keys/greeting
+//
+// With -replicate it streams its changes to followers, and with -follow it
+// is a read-only replica of another kv-server's store:
+//
+//	go run ./cmd/kv-server -replicate 127.0.0.1:7380
+//	go run ./cmd/kv-server -addr 127.0.0.1:6381 -follow 127.0.0.1:7380
+//
+// Unlike the other examples it runs until interrupted.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/aalpar/wile-extension-example/kvstore"
+	"github.com/aalpar/wile-extension-example/kvstore/kvhttp"
+	"github.com/aalpar/wile-extension-example/kvstore/resp"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:6380", "TCP address to listen on")
+	data := flag.String("data", "", "write-ahead log path (default: in memory)")
+	httpAddr := flag.String("http", "", "TCP address for the REST API (default: none)")
+	replAddr := flag.String("replicate", "", "TCP address to serve followers on (default: none)")
+	leaderAddr := flag.String("follow", "", "replication address of a leader to follow (default: none)")
+	flag.Parse()
+
+	store, err := openStore(*data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := resp.NewServer(store)
+
+	if *leaderAddr != "" {
+		f, err := kvstore.Follow(store, *leaderAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		log.Printf("following %s", *leaderAddr)
+	}
+	var leader *kvstore.Leader
+	if *replAddr != "" {
+		leader = kvstore.NewLeader(store)
+		go func() {
+			log.Printf("serving followers on %s", *replAddr)
+			if err := leader.ListenAndServe(*replAddr); !errors.Is(err, kvstore.ErrLeaderClosed) {
+				log.Print(err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var web *http.Server
+	if *httpAddr != "" {
+		web = &http.Server{Addr: *httpAddr, Handler: kvhttp.NewHandler(store)}
+		go func() {
+			log.Printf("REST API listening on %s", *httpAddr)
+			if err := web.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Print(err)
+			}
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		if web != nil {
+			web.Close()
+		}
+		if leader != nil {
+			leader.Close()
+		}
+		srv.Close()
+	}()
+
+	log.Printf("kv-server listening on %s", l.Addr())
+	if err := srv.Serve(l); !errors.Is(err, resp.ErrServerClosed) {
+		log.Print(err)
+	}
+}
+
+// openStore opens the durable store at path, or an in-memory store if path
+// is empty.
+func openStore(path string) (*kvstore.KVStore, error) {
+	logger := kvstore.WithLogger(slog.Default())
+	if path == "" {
+		return kvstore.New(logger), nil
+	}
+	return kvstore.Open(path, logger)
+}
@@ -0,0 +1,260 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"time"
+
+	"github.com/aalpar/wile/values"
+)
+
+// The methods in this file let Go code share a store with the scripts that
+// use it. They are safe for concurrent use and go through the same paths as
+// the primitives, so host writes are seen by readers, transactions and
+// watchers exactly as Scheme writes are.
+//
+// Values cross the boundary as strings. A value stored from Scheme that is
+// not a string is returned in its written Scheme form, such as "(1 2 3)".
+
+// Get returns the value stored under key and whether it was present.
+func (kv *KVStore) Get(key string) (string, bool, error) {
+	var val string
+	var found bool
+	err := kv.readKey(context.Background(), key, func(v view) error {
+		var err error
+		val, found, err = v.get(key)
+		return err
+	})
+	if err != nil || !found {
+		return "", false, err
+	}
+	s, err := displayValue(val)
+	if err != nil {
+		return "", false, err
+	}
+	return s, true, nil
+}
+
+// Set stores value under key, clearing any TTL the key had.
+func (kv *KVStore) Set(key, value string) error {
+	return kv.writeKey(context.Background(), key, func(v view) error {
+		return v.set(key, encodeString(value), 0)
+	})
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (kv *KVStore) Delete(key string) error {
+	return kv.writeKey(context.Background(), key, func(v view) error {
+		return v.delete(key)
+	})
+}
+
+// SetWithTTL stores value under key, expiring it after ttl. A ttl of zero
+// or less fails with ErrInvalidTTL.
+func (kv *KVStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidTTL, ttl)
+	}
+	return kv.writeKey(context.Background(), key, func(v view) error {
+		return v.set(key, encodeString(value), ttl)
+	})
+}
+
+// Expire makes key expire after ttl, keeping its value, and reports whether
+// the key was present. A ttl of zero or less fails with ErrInvalidTTL.
+func (kv *KVStore) Expire(key string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, fmt.Errorf("%w: %v", ErrInvalidTTL, ttl)
+	}
+	var found bool
+	err := kv.writeKey(context.Background(), key, func(v view) error {
+		var val string
+		var err error
+		if val, found, err = v.get(key); err != nil || !found {
+			return err
+		}
+		return v.set(key, val, ttl)
+	})
+	return found, err
+}
+
+// TTL returns how long key has left before it expires, or -1 if it has no
+// TTL, like kv-ttl. It reports false if key is not present.
+func (kv *KVStore) TTL(key string) (time.Duration, bool, error) {
+	var found, hasTTL bool
+	var deadline time.Time
+	err := kv.readKey(context.Background(), key, func(v view) error {
+		var err error
+		_, found, err = v.get(key)
+		deadline, hasTTL = v.expiry(key)
+		return err
+	})
+	if err != nil || !found {
+		return 0, false, err
+	}
+	if !hasTTL {
+		return -1, true, nil
+	}
+	return deadline.Sub(kv.now()), true, nil
+}
+
+// DeleteMany removes keys in one atomic step, like kv-delete-many!, and
+// returns how many were present.
+func (kv *KVStore) DeleteMany(keys ...string) (int, error) {
+	var deleted int
+	err := kv.atomically(context.Background(), func(_ context.Context, v view) error {
+		var err error
+		deleted, err = deleteKeys(v, keys)
+		return err
+	})
+	return deleted, err
+}
+
+// Clear removes every key in one atomic step, like kv-clear!.
+func (kv *KVStore) Clear() error {
+	return kv.write(context.Background(), func(v view) error {
+		return v.clear()
+	})
+}
+
+// Keys returns every key in sorted order. If the keys cannot be read, for
+// instance because the store is closed, Keys logs the error and returns nil.
+func (kv *KVStore) Keys() []string {
+	var keys []string
+	err := kv.read(context.Background(), func(v view) error {
+		var err error
+		keys, err = v.keys()
+		return err
+	})
+	if err != nil {
+		kv.listFailed("keys", err)
+		return nil
+	}
+	return keys
+}
+
+// KeysWithPrefix returns the keys that start with prefix in sorted order. It
+// reports errors as Keys does.
+func (kv *KVStore) KeysWithPrefix(prefix string) []string {
+	var keys []string
+	err := kv.read(context.Background(), func(v view) error {
+		var err error
+		keys, err = v.scan(prefix, prefixEnd(prefix), false, 0)
+		return err
+	})
+	if err != nil {
+		kv.listFailed("keys-with-prefix", err)
+		return nil
+	}
+	return keys
+}
+
+// Len returns the number of entries. If they cannot be counted, Len logs the
+// error and returns 0.
+func (kv *KVStore) Len() int {
+	var n int
+	err := kv.read(context.Background(), func(v view) error {
+		var err error
+		n, err = v.count()
+		return err
+	})
+	if err != nil {
+		kv.listFailed("len", err)
+		return 0
+	}
+	return n
+}
+
+// Range calls fn for each entry in key order until fn returns false. It does
+// not hold the store's lock while fn runs, so fn may use the store; entries
+// changed during the walk may or may not be seen. An error listing the keys
+// or reading a value is logged and ends the walk.
+func (kv *KVStore) Range(fn func(key, value string) bool) {
+	for _, key := range kv.Keys() {
+		val, found, err := kv.Get(key)
+		if err != nil {
+			kv.listFailed("range", err)
+			return
+		}
+		if found && !fn(key, val) {
+			return
+		}
+	}
+}
+
+// All returns an iterator over the store's entries in key order, with the
+// same semantics as Range.
+func (kv *KVStore) All() iter.Seq2[string, string] {
+	return kv.Range
+}
+
+// listFailed logs the error that cut short a listing method, which has no
+// error result to return it in.
+func (kv *KVStore) listFailed(op string, err error) {
+	kv.logger.Warn("listing failed", "op", op, "err", err)
+}
+
+// Event describes a change to a key, as reported to Watch callbacks and by
+// Changes. Old and New hold the values before and after, as returned by Get;
+// HadOld and HasNew report whether they were present. Rev is the revision
+// the change was assigned. In the Changes feed a clear is a single event with
+// an empty Key.
+type Event struct {
+	Op     string // "set", "delete", "expire", "evict" or "clear"
+	Key    string
+	Old    string
+	New    string
+	HadOld bool
+	HasNew bool
+	Rev    int64
+}
+
+// eventFrom converts a recorded change to an Event.
+func eventFrom(ch change) (Event, error) {
+	ev := Event{Op: ch.op, Key: ch.key, HadOld: ch.hadOld, HasNew: ch.hasNew, Rev: ch.rev}
+	var err error
+	if ch.hadOld {
+		if ev.Old, err = displayValue(ch.old); err != nil {
+			return Event{}, err
+		}
+	}
+	if ch.hasNew {
+		if ev.New, err = displayValue(ch.new); err != nil {
+			return Event{}, err
+		}
+	}
+	return ev, nil
+}
+
+// Watch calls fn after each change to a key that starts with prefix, whether
+// it was made from Scheme or from Go. fn runs on the goroutine that made the
+// change, after the store's lock is released. The returned function removes
+// the watch.
+//
+// Changes made from Go are also queued for the procedures registered with
+// kv-watch, which their engines call on their own machines.
+func (kv *KVStore) Watch(prefix string, fn func(Event)) (unwatch func()) {
+	token := kv.watch(watcher{prefix: prefix, fn: func(ch change) error {
+		ev, err := eventFrom(ch)
+		if err != nil {
+			return err
+		}
+		fn(ev)
+		return nil
+	}})
+	return func() { kv.unwatch(token) }
+}
+
+// displayValue returns the Go form of a stored value: strings as-is, other
+// datums in their written Scheme form.
+func displayValue(enc string) (string, error) {
+	v, err := decodeValue(enc)
+	if err != nil {
+		return "", err
+	}
+	if s, ok := v.(*values.String); ok {
+		return s.Value, nil
+	}
+	return v.SchemeString(), nil
+}
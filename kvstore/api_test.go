@@ -0,0 +1,112 @@
+package kvstore
+
+import (
+	"bytes"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGoAPIListing(t *testing.T) {
+	store := New()
+	t.Cleanup(func() { store.close() })
+	for _, k := range []string{"b", "a/2", "a/1", "c"} {
+		if err := store.Set(k, "v"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if keys := store.Keys(); !slices.Equal(keys, []string{"a/1", "a/2", "b", "c"}) {
+		t.Errorf("Keys() = %v", keys)
+	}
+	if keys := store.KeysWithPrefix("a/"); !slices.Equal(keys, []string{"a/1", "a/2"}) {
+		t.Errorf("KeysWithPrefix(a/) = %v", keys)
+	}
+	if n := store.Len(); n != 4 {
+		t.Errorf("Len() = %d", n)
+	}
+
+	var seen []string
+	store.Range(func(k, v string) bool {
+		seen = append(seen, k+"="+v)
+		return k != "b"
+	})
+	if want := []string{"a/1=va/1", "a/2=va/2", "b=vb"}; !slices.Equal(seen, want) {
+		t.Errorf("Range saw %v, want %v", seen, want)
+	}
+
+	got := maps.Collect(store.All())
+	if want := map[string]string{"a/1": "va/1", "a/2": "va/2", "b": "vb", "c": "vc"}; !maps.Equal(got, want) {
+		t.Errorf("All() = %v, want %v", got, want)
+	}
+	seen = nil
+	for k := range store.All() {
+		seen = append(seen, k)
+		if k == "a/2" {
+			break
+		}
+	}
+	if want := []string{"a/1", "a/2"}; !slices.Equal(seen, want) {
+		t.Errorf("All() up to a break saw %v, want %v", seen, want)
+	}
+}
+
+func TestGoAPIListingErrors(t *testing.T) {
+	// A value that cannot be decoded ends Range and All after the entries
+	// before it, and the error is logged.
+	backend := NewMemoryBackend()
+	for k, v := range map[string]string{"a": "1", "bad": "\x00?", "c": "3"} {
+		if err := backend.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var log bytes.Buffer
+	store := New(WithBackend(backend), WithLogger(slog.New(slog.NewTextHandler(&log, nil))))
+	t.Cleanup(func() { store.close() })
+
+	var seen []string
+	store.Range(func(k, _ string) bool {
+		seen = append(seen, k)
+		return true
+	})
+	if !slices.Equal(seen, []string{"a"}) {
+		t.Errorf("Range saw %v, want a", seen)
+	}
+	seen = nil
+	for k := range store.All() {
+		seen = append(seen, k)
+	}
+	if !slices.Equal(seen, []string{"a"}) {
+		t.Errorf("All saw %v, want a", seen)
+	}
+	if got := strings.Count(log.String(), `msg="listing failed" extension=kvstore op=range`); got != 2 {
+		t.Errorf("logged %q, want two failed ranges", log.String())
+	}
+
+	// Listing a closed store finds nothing and logs why.
+	store.close()
+	log.Reset()
+	if keys := store.Keys(); keys != nil {
+		t.Errorf("Keys() on a closed store = %v", keys)
+	}
+	if keys := store.KeysWithPrefix("a"); keys != nil {
+		t.Errorf("KeysWithPrefix() on a closed store = %v", keys)
+	}
+	if n := store.Len(); n != 0 {
+		t.Errorf("Len() on a closed store = %d", n)
+	}
+	store.Range(func(string, string) bool {
+		t.Error("Range on a closed store called fn")
+		return true
+	})
+	for _, op := range []string{"keys", "keys-with-prefix", "len", "keys"} {
+		line, rest, _ := strings.Cut(log.String(), "\n")
+		if !strings.Contains(line, "op="+op) || !strings.Contains(line, `err="store closed"`) {
+			t.Errorf("logged %q, want %s failing with store closed", line, op)
+		}
+		log.Reset()
+		log.WriteString(rest)
+	}
+}
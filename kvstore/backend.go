@@ -0,0 +1,283 @@
+package kvstore
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend is the storage engine behind a KVStore. Every primitive reaches
+// the data through this interface, so a deployment can swap storage without
+// touching the primitive layer.
+//
+// KVStore never calls a backend concurrently for the same key, and never
+// runs Keys, Len or Clear concurrently with a mutation. Operations on
+// different keys may run in parallel if the backend implements
+// ConcurrentBackend; otherwise KVStore serializes every call.
+type Backend interface {
+	// Get returns the value stored under key and whether it was present.
+	Get(key string) (string, bool, error)
+	// Set stores value under key, replacing any previous value.
+	Set(key, value string) error
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+	// Clear removes every entry.
+	Clear() error
+	// Keys returns every key, in no particular order.
+	Keys() ([]string, error)
+	// Len returns the number of entries.
+	Len() int
+	// Close releases the backend's resources.
+	Close() error
+}
+
+// ConcurrentBackend is implemented by backends that are safe for concurrent
+// use, letting operations on different keys reach them in parallel.
+type ConcurrentBackend interface {
+	Backend
+	// Concurrent reports whether the backend is safe for concurrent use.
+	Concurrent() bool
+}
+
+// ExpiringBackend is implemented by backends that store the expiry deadline
+// of a key set with a TTL alongside its value, so that a durable store keeps
+// its TTLs across a restart. For other backends the store holds deadlines in
+// memory only.
+type ExpiringBackend interface {
+	Backend
+	// SetExpiring is Set for a key that expires at the given time, or
+	// never if it is zero.
+	SetExpiring(key, value string, expires time.Time) error
+	// Expiries returns the deadline of every key that has one.
+	Expiries() (map[string]time.Time, error)
+}
+
+// BatchBackend is implemented by backends that can apply several mutations
+// as one atomic step, so that a committed transaction reaches storage whole
+// or not at all, even across a crash. For other backends the store applies
+// the mutations one at a time and undoes those already applied if one fails.
+type BatchBackend interface {
+	Backend
+	// Apply applies ops in order. If it fails, none of them has been
+	// applied.
+	Apply(ops []BatchOp) error
+}
+
+// BatchOp is one mutation in a batch given to BatchBackend.Apply.
+type BatchOp struct {
+	Key     string
+	Value   string
+	Expires time.Time // zero if the key has no TTL
+	Delete  bool      // remove Key instead of setting it
+	Clear   bool      // remove every entry; the other fields are unused
+}
+
+// batchBackend returns b as a BatchBackend, if it or the backend it
+// serializes is one.
+func batchBackend(b Backend) (BatchBackend, bool) {
+	if s, ok := b.(*serialBackend); ok {
+		if _, ok := s.b.(BatchBackend); !ok {
+			return nil, false
+		}
+	}
+	bb, ok := b.(BatchBackend)
+	return bb, ok
+}
+
+// concurrentBackend returns b if it is safe for concurrent use, or b
+// wrapped so that its calls are serialized.
+func concurrentBackend(b Backend) Backend {
+	if c, ok := b.(ConcurrentBackend); ok && c.Concurrent() {
+		return b
+	}
+	return &serialBackend{b: b}
+}
+
+// serialBackend serializes the calls to a backend that is not safe for
+// concurrent use.
+type serialBackend struct {
+	mu sync.Mutex
+	b  Backend
+}
+
+func (s *serialBackend) Get(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Get(key)
+}
+
+func (s *serialBackend) Set(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Set(key, value)
+}
+
+func (s *serialBackend) SetExpiring(key, value string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if eb, ok := s.b.(ExpiringBackend); ok {
+		return eb.SetExpiring(key, value, expires)
+	}
+	return s.b.Set(key, value)
+}
+
+func (s *serialBackend) Expiries() (map[string]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if eb, ok := s.b.(ExpiringBackend); ok {
+		return eb.Expiries()
+	}
+	return nil, nil
+}
+
+// Apply is only called through batchBackend, which checks that the
+// backend it serializes is a BatchBackend.
+func (s *serialBackend) Apply(ops []BatchOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.(BatchBackend).Apply(ops)
+}
+
+func (s *serialBackend) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Delete(key)
+}
+
+func (s *serialBackend) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Clear()
+}
+
+func (s *serialBackend) Keys() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Keys()
+}
+
+func (s *serialBackend) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Len()
+}
+
+func (s *serialBackend) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Close()
+}
+
+// memoryShards is the number of maps a MemoryBackend spreads its entries
+// across.
+const memoryShards = 64
+
+// MemoryBackend keeps entries in Go maps. It is the default backend and
+// loses everything on Close. It is safe for concurrent use; entries are
+// spread across several maps so that writers to different keys rarely
+// contend.
+type MemoryBackend struct {
+	seed   maphash.Seed
+	shards [memoryShards]memoryShard
+	len    atomic.Int64
+}
+
+type memoryShard struct {
+	mu   sync.RWMutex
+	data map[string]string
+}
+
+// NewMemoryBackend creates an empty in-memory backend.
+func NewMemoryBackend() *MemoryBackend {
+	m := &MemoryBackend{seed: maphash.MakeSeed()}
+	for i := range m.shards {
+		m.shards[i].data = make(map[string]string)
+	}
+	return m
+}
+
+func (m *MemoryBackend) shard(key string) *memoryShard {
+	return &m.shards[maphash.String(m.seed, key)%memoryShards]
+}
+
+// Get implements Backend.
+func (m *MemoryBackend) Get(key string) (string, bool, error) {
+	sh := m.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	val, found := sh.data[key]
+	return val, found, nil
+}
+
+// Set implements Backend.
+func (m *MemoryBackend) Set(key, value string) error {
+	sh := m.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, found := sh.data[key]; !found {
+		m.len.Add(1)
+	}
+	sh.data[key] = value
+	return nil
+}
+
+// Delete implements Backend.
+func (m *MemoryBackend) Delete(key string) error {
+	sh := m.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, found := sh.data[key]; found {
+		delete(sh.data, key)
+		m.len.Add(-1)
+	}
+	return nil
+}
+
+// Clear implements Backend.
+func (m *MemoryBackend) Clear() error {
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.Lock()
+		m.len.Add(-int64(len(sh.data)))
+		clear(sh.data)
+		sh.mu.Unlock()
+	}
+	return nil
+}
+
+// Keys implements Backend.
+func (m *MemoryBackend) Keys() ([]string, error) {
+	keys := make([]string, 0, m.Len())
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		for k := range sh.data {
+			keys = append(keys, k)
+		}
+		sh.mu.RUnlock()
+	}
+	return keys, nil
+}
+
+// Len implements Backend.
+func (m *MemoryBackend) Len() int {
+	return int(m.len.Load())
+}
+
+// Concurrent implements ConcurrentBackend.
+func (m *MemoryBackend) Concurrent() bool {
+	return true
+}
+
+// Close implements Backend.
+func (m *MemoryBackend) Close() error {
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.Lock()
+		sh.data = nil
+		sh.mu.Unlock()
+	}
+	m.len.Store(0)
+	return nil
+}
@@ -0,0 +1,156 @@
+package kvstore
+
+import (
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// The parallel benchmarks run each workload against three stores: one with a
+// single segment over a plain map, whose calls the store serializes behind
+// one mutex as it did before sharding; one with a single segment over the
+// sharded MemoryBackend; and one with the default number of segments.
+// Compare them with
+//
+//	make bench
+//
+// or go test -bench=Parallel -cpu=1,4,16 ./kvstore/ to vary the load.
+
+const benchKeys = 4096
+
+var benchKeyNames = func() []string {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%05d", i)
+	}
+	return keys
+}()
+
+// mapBackend is a Backend over a plain map that is not safe for concurrent
+// use, so the store wraps it in a serialBackend.
+type mapBackend map[string]string
+
+func (m mapBackend) Get(key string) (string, bool, error) {
+	v, ok := m[key]
+	return v, ok, nil
+}
+
+func (m mapBackend) Set(key, value string) error {
+	m[key] = value
+	return nil
+}
+
+func (m mapBackend) Delete(key string) error {
+	delete(m, key)
+	return nil
+}
+
+func (m mapBackend) Clear() error {
+	clear(m)
+	return nil
+}
+
+func (m mapBackend) Keys() ([]string, error) {
+	return slices.Collect(maps.Keys(m)), nil
+}
+
+func (m mapBackend) Len() int     { return len(m) }
+func (m mapBackend) Close() error { return nil }
+
+func benchStores(b *testing.B, run func(b *testing.B, kv *KVStore)) {
+	stores := []struct {
+		name string
+		opts []Option
+	}{
+		{"single-lock", []Option{WithShards(1), WithBackend(mapBackend{})}},
+		{"shards=1", []Option{WithShards(1)}},
+		{fmt.Sprintf("shards=%d", defaultShards), nil},
+	}
+	for _, s := range stores {
+		b.Run(s.name, func(b *testing.B) {
+			kv := New(s.opts...)
+			b.Cleanup(func() { _ = kv.close() })
+			for _, k := range benchKeyNames {
+				if err := kv.Set(k, "value"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			run(b, kv)
+		})
+	}
+}
+
+func BenchmarkParallelGet(b *testing.B) {
+	benchStores(b, func(b *testing.B, kv *KVStore) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.IntN(benchKeys)
+			for pb.Next() {
+				if _, _, err := kv.Get(benchKeyNames[i%benchKeys]); err != nil {
+					b.Error(err)
+					return
+				}
+				i++
+			}
+		})
+	})
+}
+
+func BenchmarkParallelSet(b *testing.B) {
+	benchStores(b, func(b *testing.B, kv *KVStore) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.IntN(benchKeys)
+			for pb.Next() {
+				if err := kv.Set(benchKeyNames[i%benchKeys], "value"); err != nil {
+					b.Error(err)
+					return
+				}
+				i++
+			}
+		})
+	})
+}
+
+// BenchmarkParallelMixed does one write for every nine reads.
+func BenchmarkParallelMixed(b *testing.B) {
+	benchStores(b, func(b *testing.B, kv *KVStore) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.IntN(benchKeys)
+			for pb.Next() {
+				key := benchKeyNames[i%benchKeys]
+				var err error
+				if i%10 == 0 {
+					err = kv.Set(key, "value")
+				} else {
+					_, _, err = kv.Get(key)
+				}
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				i++
+			}
+		})
+	})
+}
+
+// BenchmarkParallelKeysUnderWrites lists the keys while other goroutines
+// write, measuring how long the sorted listing waits for the writers.
+func BenchmarkParallelKeysUnderWrites(b *testing.B) {
+	benchStores(b, func(b *testing.B, kv *KVStore) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.IntN(benchKeys)
+			for pb.Next() {
+				if i%64 == 0 {
+					_ = kv.Keys()
+				} else if err := kv.Set(benchKeyNames[i%benchKeys], "value"); err != nil {
+					b.Error(err)
+					return
+				}
+				i++
+			}
+		})
+	})
+}
@@ -0,0 +1,668 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// The B-tree file is an array of fixed-size pages. Page 0 is the header:
+//
+//	magic "WKVBTRE\x01" | root uint32 | pages uint32 | free uint32 | count uint64
+//
+// Every other page is a node, an overflow page or a free page:
+//
+//	leaf:     kind byte | n uint16 | n × (uvarint klen | key | value)
+//	internal: kind byte | n uint16 | child uint32 | n × (uvarint klen | key | child uint32)
+//	value:    0 | uvarint vlen | bytes          (inline)
+//	          1 | first uint32 | length uint32  (overflow chain)
+//	overflow: next uint32 | n uint16 | bytes
+//	free:     next uint32
+//
+// Integers are little-endian. In an internal node, child i holds keys below
+// key i and child i+1 holds keys at or above it. Values larger than
+// btMaxInline live in a chain of overflow pages so that a node always holds
+// at least four entries, which keeps a size-balanced split within one page.
+
+const (
+	btPageSize   = 8192
+	btMaxKeySize = 1024
+	btMaxInline  = 1024
+	btMagic      = "WKVBTRE\x01"
+	btHeaderSize = len(btMagic) + 4 + 4 + 4 + 8
+	btNodeHeader = 3
+	btChunkSize  = btPageSize - 6
+)
+
+const (
+	btLeaf     byte = 1
+	btInternal byte = 2
+)
+
+var errCorruptPage = errors.New("kvstore: corrupt B-tree page")
+
+// BTreeBackend stores entries in a single-file B+tree. Nodes are rewritten in
+// place and the file is only fsynced on Close, so a crash in the middle of a
+// mutation can leave the tree inconsistent; use a LogBackend where crash
+// safety matters. Deletes remove empty nodes but do not rebalance.
+type BTreeBackend struct {
+	f     pageFile
+	root  uint32
+	pages uint32
+	free  uint32
+	count uint64
+}
+
+// pageFile is the file behind a BTreeBackend. It is an *os.File except in
+// tests, which substitute one that fails.
+type pageFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Truncate(size int64) error
+	Sync() error
+}
+
+// btNode is a decoded leaf or internal page.
+type btNode struct {
+	id       uint32
+	leaf     bool
+	keys     []string
+	vals     []btValue // leaf only
+	children []uint32  // internal only, len(keys)+1
+}
+
+// btValue is a leaf value, either inline or in an overflow chain.
+type btValue struct {
+	inline   string
+	overflow uint32
+	length   uint32
+}
+
+// OpenBTreeBackend opens or creates the B-tree file at path.
+func OpenBTreeBackend(path string) (*BTreeBackend, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	b := &BTreeBackend{f: f}
+	info, err := f.Stat()
+	if err == nil {
+		if info.Size() == 0 {
+			err = b.init()
+			if err == nil {
+				err = syncDir(path)
+			}
+		} else {
+			err = b.readHeader()
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("kvstore: open %s: %w", path, err)
+	}
+	return b, nil
+}
+
+// init writes an empty tree: the header and a single empty leaf as root.
+func (b *BTreeBackend) init() error {
+	if err := b.f.Truncate(0); err != nil {
+		return err
+	}
+	b.root, b.pages, b.free, b.count = 1, 2, 0, 0
+	if err := b.writeNode(&btNode{id: b.root, leaf: true}); err != nil {
+		return err
+	}
+	return b.writeHeader()
+}
+
+func (b *BTreeBackend) readHeader() error {
+	buf, err := b.readPage(0)
+	if err != nil {
+		return err
+	}
+	if string(buf[:len(btMagic)]) != btMagic {
+		return errors.New("not a kvstore B-tree file")
+	}
+	p := buf[len(btMagic):]
+	b.root = binary.LittleEndian.Uint32(p)
+	b.pages = binary.LittleEndian.Uint32(p[4:])
+	b.free = binary.LittleEndian.Uint32(p[8:])
+	b.count = binary.LittleEndian.Uint64(p[12:])
+	if b.root == 0 || b.root >= b.pages {
+		return errCorruptPage
+	}
+	return nil
+}
+
+func (b *BTreeBackend) writeHeader() error {
+	buf := make([]byte, btPageSize)
+	copy(buf, btMagic)
+	p := buf[len(btMagic):]
+	binary.LittleEndian.PutUint32(p, b.root)
+	binary.LittleEndian.PutUint32(p[4:], b.pages)
+	binary.LittleEndian.PutUint32(p[8:], b.free)
+	binary.LittleEndian.PutUint64(p[12:], b.count)
+	return b.writePage(0, buf)
+}
+
+// Get implements Backend.
+func (b *BTreeBackend) Get(key string) (string, bool, error) {
+	id := b.root
+	for {
+		n, err := b.readNode(id)
+		if err != nil {
+			return "", false, err
+		}
+		if !n.leaf {
+			id = n.children[childIndex(n.keys, key)]
+			continue
+		}
+		i := sort.SearchStrings(n.keys, key)
+		if i == len(n.keys) || n.keys[i] != key {
+			return "", false, nil
+		}
+		val, err := b.loadValue(n.vals[i])
+		return val, err == nil, err
+	}
+}
+
+// Set implements Backend. Keys longer than btMaxKeySize are rejected.
+func (b *BTreeBackend) Set(key, value string) error {
+	if len(key) > btMaxKeySize {
+		return fmt.Errorf("kvstore: key of %d bytes exceeds the B-tree limit of %d", len(key), btMaxKeySize)
+	}
+	v, err := b.storeValue(value)
+	if err != nil {
+		return err
+	}
+	split, err := b.insert(b.root, key, v)
+	if err != nil {
+		return err
+	}
+	if split.right != 0 {
+		id, err := b.alloc()
+		if err != nil {
+			return err
+		}
+		root := &btNode{id: id, keys: []string{split.sep}, children: []uint32{b.root, split.right}}
+		if err := b.writeNode(root); err != nil {
+			return err
+		}
+		b.root = id
+	}
+	if !split.replaced {
+		b.count++
+	}
+	return b.writeHeader()
+}
+
+// btSplit reports the outcome of an insert into a subtree.
+type btSplit struct {
+	sep      string // first key of the new right sibling
+	right    uint32 // new right sibling, 0 if the node did not split
+	replaced bool   // key already existed
+}
+
+func (b *BTreeBackend) insert(id uint32, key string, v btValue) (btSplit, error) {
+	n, err := b.readNode(id)
+	if err != nil {
+		return btSplit{}, err
+	}
+	var out btSplit
+	if n.leaf {
+		i := sort.SearchStrings(n.keys, key)
+		if i < len(n.keys) && n.keys[i] == key {
+			if err := b.freeValue(n.vals[i]); err != nil {
+				return btSplit{}, err
+			}
+			n.vals[i] = v
+			out.replaced = true
+		} else {
+			n.keys = insertAt(n.keys, i, key)
+			n.vals = insertAt(n.vals, i, v)
+		}
+	} else {
+		ci := childIndex(n.keys, key)
+		child, err := b.insert(n.children[ci], key, v)
+		if err != nil {
+			return btSplit{}, err
+		}
+		out.replaced = child.replaced
+		if child.right == 0 {
+			return out, nil
+		}
+		n.keys = insertAt(n.keys, ci, child.sep)
+		n.children = insertAt(n.children, ci+1, child.right)
+	}
+
+	if nodeSize(n) > btPageSize {
+		right, sep, err := b.split(n)
+		if err != nil {
+			return btSplit{}, err
+		}
+		out.sep, out.right = sep, right.id
+		if err := b.writeNode(right); err != nil {
+			return btSplit{}, err
+		}
+	}
+	return out, b.writeNode(n)
+}
+
+// split moves the upper half of n, by encoded size, into a new page and
+// returns the new node and the separator key for the parent.
+func (b *BTreeBackend) split(n *btNode) (*btNode, string, error) {
+	id, err := b.alloc()
+	if err != nil {
+		return nil, "", err
+	}
+	half := nodeSize(n) / 2
+	size := btNodeHeader
+	m := 0
+	for m < len(n.keys) && size < half {
+		size += entrySize(n, m)
+		m++
+	}
+
+	right := &btNode{id: id, leaf: n.leaf}
+	if n.leaf {
+		m = max(1, min(m, len(n.keys)-1))
+		right.keys = append([]string(nil), n.keys[m:]...)
+		right.vals = append([]btValue(nil), n.vals[m:]...)
+		n.keys, n.vals = n.keys[:m], n.vals[:m]
+		return right, right.keys[0], nil
+	}
+	m = min(m, len(n.keys)-1)
+	sep := n.keys[m]
+	right.keys = append([]string(nil), n.keys[m+1:]...)
+	right.children = append([]uint32(nil), n.children[m+1:]...)
+	n.keys, n.children = n.keys[:m], n.children[:m+1]
+	return right, sep, nil
+}
+
+// Delete implements Backend.
+func (b *BTreeBackend) Delete(key string) error {
+	found, _, err := b.remove(b.root, key, true)
+	if err != nil || !found {
+		return err
+	}
+	b.count--
+	if err := b.collapseRoot(); err != nil {
+		return err
+	}
+	return b.writeHeader()
+}
+
+// remove deletes key from the subtree at id. It reports whether the key was
+// found and whether the node is now empty. Empty children are freed and
+// unlinked by their parent; the root is never freed here.
+func (b *BTreeBackend) remove(id uint32, key string, isRoot bool) (found, empty bool, err error) {
+	n, err := b.readNode(id)
+	if err != nil {
+		return false, false, err
+	}
+	if n.leaf {
+		i := sort.SearchStrings(n.keys, key)
+		if i == len(n.keys) || n.keys[i] != key {
+			return false, false, nil
+		}
+		if err := b.freeValue(n.vals[i]); err != nil {
+			return false, false, err
+		}
+		n.keys = removeAt(n.keys, i)
+		n.vals = removeAt(n.vals, i)
+	} else {
+		ci := childIndex(n.keys, key)
+		found, childEmpty, err := b.remove(n.children[ci], key, false)
+		if err != nil || !found {
+			return found, false, err
+		}
+		if !childEmpty {
+			return true, false, nil
+		}
+		if err := b.freePage(n.children[ci]); err != nil {
+			return false, false, err
+		}
+		n.children = removeAt(n.children, ci)
+		if len(n.keys) > 0 {
+			n.keys = removeAt(n.keys, max(ci-1, 0))
+		}
+	}
+	empty = len(n.keys) == 0 && (n.leaf || len(n.children) == 0)
+	if empty && !isRoot {
+		return true, true, nil
+	}
+	return true, empty, b.writeNode(n)
+}
+
+// collapseRoot shortens the tree while the root is an internal node with a
+// single child, and turns a childless root back into an empty leaf.
+func (b *BTreeBackend) collapseRoot() error {
+	for {
+		n, err := b.readNode(b.root)
+		if err != nil {
+			return err
+		}
+		if n.leaf || len(n.children) > 1 {
+			return nil
+		}
+		if len(n.children) == 0 {
+			return b.writeNode(&btNode{id: n.id, leaf: true})
+		}
+		if err := b.freePage(n.id); err != nil {
+			return err
+		}
+		b.root = n.children[0]
+	}
+}
+
+// Clear implements Backend by truncating the file to an empty tree.
+func (b *BTreeBackend) Clear() error {
+	return b.init()
+}
+
+// Keys implements Backend. Keys are returned in sorted order.
+func (b *BTreeBackend) Keys() ([]string, error) {
+	keys := make([]string, 0, b.count)
+	return keys, b.walk(b.root, func(n *btNode) { keys = append(keys, n.keys...) })
+}
+
+// walk calls fn for every leaf under id, in key order.
+func (b *BTreeBackend) walk(id uint32, fn func(*btNode)) error {
+	n, err := b.readNode(id)
+	if err != nil {
+		return err
+	}
+	if n.leaf {
+		fn(n)
+		return nil
+	}
+	for _, c := range n.children {
+		if err := b.walk(c, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len implements Backend.
+func (b *BTreeBackend) Len() int {
+	return int(b.count)
+}
+
+// Close writes the header, syncs and closes the file.
+func (b *BTreeBackend) Close() error {
+	err := b.writeHeader()
+	if err == nil {
+		err = b.f.Sync()
+	}
+	if cerr := b.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// --- pages ---
+
+func (b *BTreeBackend) readPage(id uint32) ([]byte, error) {
+	buf := make([]byte, btPageSize)
+	if _, err := b.f.ReadAt(buf, int64(id)*btPageSize); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (b *BTreeBackend) writePage(id uint32, buf []byte) error {
+	_, err := b.f.WriteAt(buf, int64(id)*btPageSize)
+	return err
+}
+
+// alloc returns a page from the free list, or extends the file.
+func (b *BTreeBackend) alloc() (uint32, error) {
+	if b.free == 0 {
+		id := b.pages
+		b.pages++
+		return id, nil
+	}
+	id := b.free
+	buf, err := b.readPage(id)
+	if err != nil {
+		return 0, err
+	}
+	b.free = binary.LittleEndian.Uint32(buf)
+	return id, nil
+}
+
+// freePage pushes id onto the free list.
+func (b *BTreeBackend) freePage(id uint32) error {
+	buf := make([]byte, btPageSize)
+	binary.LittleEndian.PutUint32(buf, b.free)
+	b.free = id
+	return b.writePage(id, buf)
+}
+
+// --- values ---
+
+// storeValue returns an inline value, or writes s to a new overflow chain.
+func (b *BTreeBackend) storeValue(s string) (btValue, error) {
+	if len(s) <= btMaxInline {
+		return btValue{inline: s}, nil
+	}
+	// Write chunks back to front so each page can point at its successor.
+	var next uint32
+	for end := len(s); end > 0; {
+		start := (end - 1) / btChunkSize * btChunkSize
+		id, err := b.alloc()
+		if err != nil {
+			return btValue{}, errors.Join(err, b.freeValue(btValue{overflow: next}))
+		}
+		buf := make([]byte, btPageSize)
+		binary.LittleEndian.PutUint32(buf, next)
+		binary.LittleEndian.PutUint16(buf[4:], uint16(end-start))
+		copy(buf[6:], s[start:end])
+		if err := b.writePage(id, buf); err != nil {
+			// Return the pages written so far, and this one, to the
+			// free list.
+			return btValue{}, errors.Join(err, b.freeValue(btValue{overflow: next}), b.freePage(id))
+		}
+		next, end = id, start
+	}
+	return btValue{overflow: next, length: uint32(len(s))}, nil
+}
+
+func (b *BTreeBackend) loadValue(v btValue) (string, error) {
+	if v.overflow == 0 {
+		return v.inline, nil
+	}
+	out := make([]byte, 0, v.length)
+	for id := v.overflow; id != 0; {
+		buf, err := b.readPage(id)
+		if err != nil {
+			return "", err
+		}
+		n := int(binary.LittleEndian.Uint16(buf[4:]))
+		if n > btChunkSize {
+			return "", errCorruptPage
+		}
+		out = append(out, buf[6:6+n]...)
+		id = binary.LittleEndian.Uint32(buf)
+	}
+	if len(out) != int(v.length) {
+		return "", errCorruptPage
+	}
+	return string(out), nil
+}
+
+func (b *BTreeBackend) freeValue(v btValue) error {
+	for id := v.overflow; id != 0; {
+		buf, err := b.readPage(id)
+		if err != nil {
+			return err
+		}
+		next := binary.LittleEndian.Uint32(buf)
+		if err := b.freePage(id); err != nil {
+			return err
+		}
+		id = next
+	}
+	return nil
+}
+
+// --- nodes ---
+
+func (b *BTreeBackend) readNode(id uint32) (*btNode, error) {
+	buf, err := b.readPage(id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := decodeNode(buf)
+	if err != nil {
+		return nil, fmt.Errorf("page %d: %w", id, err)
+	}
+	n.id = id
+	return n, nil
+}
+
+func (b *BTreeBackend) writeNode(n *btNode) error {
+	return b.writePage(n.id, encodeNode(n))
+}
+
+func decodeNode(buf []byte) (*btNode, error) {
+	n := &btNode{leaf: buf[0] == btLeaf}
+	if buf[0] != btLeaf && buf[0] != btInternal {
+		return nil, errCorruptPage
+	}
+	count := int(binary.LittleEndian.Uint16(buf[1:]))
+	p := buf[btNodeHeader:]
+	n.keys = make([]string, 0, count)
+	if !n.leaf {
+		if len(p) < 4 {
+			return nil, errCorruptPage
+		}
+		n.children = append(make([]uint32, 0, count+1), binary.LittleEndian.Uint32(p))
+		p = p[4:]
+	} else {
+		n.vals = make([]btValue, 0, count)
+	}
+	for range count {
+		key, rest, ok := readField(p)
+		if !ok {
+			return nil, errCorruptPage
+		}
+		n.keys = append(n.keys, key)
+		p = rest
+		if !n.leaf {
+			if len(p) < 4 {
+				return nil, errCorruptPage
+			}
+			n.children = append(n.children, binary.LittleEndian.Uint32(p))
+			p = p[4:]
+			continue
+		}
+		if len(p) < 1 {
+			return nil, errCorruptPage
+		}
+		var v btValue
+		if p[0] == 0 {
+			v.inline, p, ok = readField(p[1:])
+			if !ok {
+				return nil, errCorruptPage
+			}
+		} else {
+			if len(p) < 9 {
+				return nil, errCorruptPage
+			}
+			v.overflow = binary.LittleEndian.Uint32(p[1:])
+			v.length = binary.LittleEndian.Uint32(p[5:])
+			p = p[9:]
+		}
+		n.vals = append(n.vals, v)
+	}
+	return n, nil
+}
+
+func encodeNode(n *btNode) []byte {
+	buf := make([]byte, btNodeHeader, btPageSize)
+	buf[0] = btInternal
+	if n.leaf {
+		buf[0] = btLeaf
+	}
+	binary.LittleEndian.PutUint16(buf[1:], uint16(len(n.keys)))
+	if !n.leaf {
+		buf = binary.LittleEndian.AppendUint32(buf, n.children[0])
+	}
+	for i, k := range n.keys {
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		if !n.leaf {
+			buf = binary.LittleEndian.AppendUint32(buf, n.children[i+1])
+			continue
+		}
+		v := n.vals[i]
+		if v.overflow == 0 {
+			buf = append(buf, 0)
+			buf = binary.AppendUvarint(buf, uint64(len(v.inline)))
+			buf = append(buf, v.inline...)
+		} else {
+			buf = append(buf, 1)
+			buf = binary.LittleEndian.AppendUint32(buf, v.overflow)
+			buf = binary.LittleEndian.AppendUint32(buf, v.length)
+		}
+	}
+	return buf[:btPageSize]
+}
+
+// nodeSize returns the encoded size of n in bytes.
+func nodeSize(n *btNode) int {
+	size := btNodeHeader
+	if !n.leaf {
+		size += 4
+	}
+	for i := range n.keys {
+		size += entrySize(n, i)
+	}
+	return size
+}
+
+// entrySize returns the encoded size of entry i of n.
+func entrySize(n *btNode, i int) int {
+	size := uvarintLen(len(n.keys[i])) + len(n.keys[i])
+	if !n.leaf {
+		return size + 4
+	}
+	v := n.vals[i]
+	if v.overflow != 0 {
+		return size + 9
+	}
+	return size + 1 + uvarintLen(len(v.inline)) + len(v.inline)
+}
+
+func uvarintLen(n int) int {
+	size := 1
+	for n >= 0x80 {
+		n >>= 7
+		size++
+	}
+	return size
+}
+
+// childIndex returns the index of the child of an internal node whose
+// subtree covers key.
+func childIndex(keys []string, key string) int {
+	return sort.Search(len(keys), func(i int) bool { return keys[i] > key })
+}
+
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func removeAt[T any](s []T, i int) []T {
+	return append(s[:i], s[i+1:]...)
+}
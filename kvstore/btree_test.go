@@ -0,0 +1,243 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func openBTree(t *testing.T, path string) *BTreeBackend {
+	t.Helper()
+	b, err := OpenBTreeBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// depth returns the number of levels in the tree.
+func (b *BTreeBackend) depth() (int, error) {
+	d := 1
+	for id := b.root; ; d++ {
+		n, err := b.readNode(id)
+		if err != nil || n.leaf {
+			return d, err
+		}
+		id = n.children[0]
+	}
+}
+
+// checkTree fails the test unless b holds exactly want, in sorted order.
+func checkTree(t *testing.T, b *BTreeBackend, want map[string]string) {
+	t.Helper()
+	keys, err := b.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.IsSorted(keys) {
+		t.Error("Keys are not sorted")
+	}
+	if wantKeys := slices.Sorted(maps.Keys(want)); !slices.Equal(keys, wantKeys) {
+		t.Fatalf("tree has %d keys, want %d", len(keys), len(wantKeys))
+	}
+	if n := b.Len(); n != len(want) {
+		t.Errorf("Len = %d, want %d", n, len(want))
+	}
+	for k, v := range want {
+		got, found, err := b.Get(k)
+		if err != nil || !found || got != v {
+			t.Fatalf("Get(%.20q) = %.20q, %v, %v; want %.20q", k, got, found, err, v)
+		}
+	}
+	if _, found, err := b.Get("missing"); found || err != nil {
+		t.Errorf("Get(missing) = %v, %v", found, err)
+	}
+}
+
+func TestBTree(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     int
+		keyPad   int // bytes added to each key
+		valueLen func(i int) int
+		depth    int // minimum depth reached
+	}{
+		{"leaf splits", 3000, 0, func(int) int { return 8 }, 2},
+		{"internal splits", 3000, 600, func(int) int { return 8 }, 3},
+		{"overflow chains", 1000, 0, func(i int) int { return btMaxInline + 1 + i%3*btChunkSize }, 2},
+		{"mixed", 2000, 100, func(i int) int { return []int{0, 100, btMaxInline, 3 * btChunkSize}[i%4] }, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "kv.db")
+			b := openBTree(t, path)
+			rng := rand.New(rand.NewPCG(1, 2))
+			pad := strings.Repeat("k", tt.keyPad)
+			want := make(map[string]string)
+			for _, i := range rng.Perm(tt.keys) {
+				k := fmt.Sprintf("%s%06d", pad, i)
+				want[k] = strings.Repeat(string(rune('a'+i%26)), tt.valueLen(i))
+				if err := b.Set(k, want[k]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkTree(t, b, want)
+			if d, err := b.depth(); err != nil || d < tt.depth {
+				t.Errorf("depth = %d, %v; want at least %d", d, err, tt.depth)
+			}
+
+			// Replace every third value and delete every other key.
+			for i := range tt.keys {
+				k := fmt.Sprintf("%s%06d", pad, i)
+				switch {
+				case i%2 == 0:
+					if err := b.Delete(k); err != nil {
+						t.Fatal(err)
+					}
+					delete(want, k)
+				case i%3 == 0:
+					want[k] = strings.Repeat("r", tt.valueLen(i+1))
+					if err := b.Set(k, want[k]); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			checkTree(t, b, want)
+
+			// The header carries the tree across a reopen.
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+			b = openBTree(t, path)
+			checkTree(t, b, want)
+
+			// Deleting everything collapses the tree to an empty leaf,
+			// and the pages freed are reused by the next inserts.
+			for k := range want {
+				if err := b.Delete(k); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkTree(t, b, nil)
+			if d, err := b.depth(); err != nil || d != 1 {
+				t.Errorf("depth after deleting everything = %d, %v", d, err)
+			}
+			if b.free == 0 {
+				t.Error("free list is empty after deleting everything")
+			}
+			pages := b.pages
+			for k, v := range want {
+				if err := b.Set(k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkTree(t, b, want)
+			if b.pages > pages {
+				t.Errorf("file grew from %d to %d pages refilling freed space", pages, b.pages)
+			}
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBTreeClear(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.db")
+	b := openBTree(t, path)
+	defer b.Close()
+	for i := range 500 {
+		if err := b.Set(fmt.Sprint(i), strings.Repeat("v", 2*btMaxInline)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, b, nil)
+	if b.pages != 2 || b.free != 0 {
+		t.Errorf("cleared tree has %d pages and free list %d", b.pages, b.free)
+	}
+}
+
+func TestBTreeOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"foreign file", []byte(strings.Repeat("x", btPageSize))},
+		{"short header", []byte(btMagic)},
+		{"bad root", append([]byte(btMagic), make([]byte, btPageSize-len(btMagic))...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if b, err := OpenBTreeBackend(path); err == nil {
+				b.Close()
+				t.Error("opened an invalid file")
+			}
+		})
+	}
+
+	b := openBTree(t, filepath.Join(dir, "ok"))
+	defer b.Close()
+	if err := b.Set(strings.Repeat("k", btMaxKeySize+1), "v"); err == nil {
+		t.Error("Set accepted a key over the size limit")
+	}
+}
+
+// faultyPages is a B-tree file whose writes fail once failAt more have
+// succeeded, if failAt is positive.
+type faultyPages struct {
+	*os.File
+	failAt int
+}
+
+func (f *faultyPages) WriteAt(p []byte, off int64) (int, error) {
+	if f.failAt > 0 {
+		f.failAt--
+		if f.failAt == 0 {
+			return 0, errInjected
+		}
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func TestBTreeFailedOverflow(t *testing.T) {
+	b := openBTree(t, filepath.Join(t.TempDir(), "kv.db"))
+	f := &faultyPages{File: b.f.(*os.File)}
+	b.f = f
+	defer b.Close()
+	if err := b.Set("a", "small"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The third page of a four-page chain fails to write; the two written
+	// before it and the one that failed go to the free list.
+	value := strings.Repeat("v", 3*btChunkSize+1)
+	pages := b.pages
+	f.failAt = 3
+	if err := b.Set("big", value); !errors.Is(err, errInjected) {
+		t.Fatalf("Set with failing write = %v", err)
+	}
+	if b.pages != pages+3 {
+		t.Fatalf("failed Set allocated %d pages, want 3", b.pages-pages)
+	}
+	if err := b.Set("big", value); err != nil {
+		t.Fatal(err)
+	}
+	if b.pages != pages+4 {
+		t.Errorf("retry grew the file by %d pages, want 1", b.pages-pages-3)
+	}
+	checkTree(t, b, map[string]string{"a": "small", "big": value})
+}
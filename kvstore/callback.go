@@ -0,0 +1,32 @@
+package kvstore
+
+import (
+	"context"
+
+	"github.com/aalpar/wile/machine"
+	"github.com/aalpar/wile/values"
+)
+
+// callProcedure applies the Scheme procedure proc to args on the machine
+// running the current primitive. Primitives invoked by proc receive ctx, which
+// is how a transaction reaches the kvstore calls made inside its thunk.
+func callProcedure(ctx context.Context, mc *machine.MachineContext, proc values.Value, args ...values.Value) (values.Value, error) {
+	return mc.Apply(ctx, proc, args...)
+}
+
+// callerKey is the context key under which a primitive's MachineContext is
+// stored, so watchers can call back into Scheme after the store's lock has
+// been released.
+type callerKey struct{}
+
+// withCaller returns ctx carrying mc.
+func withCaller(ctx context.Context, mc *machine.MachineContext) context.Context {
+	return context.WithValue(ctx, callerKey{}, mc)
+}
+
+// callerFrom returns the MachineContext carried by ctx, or nil if the change
+// did not come from a primitive.
+func callerFrom(ctx context.Context) *machine.MachineContext {
+	mc, _ := ctx.Value(callerKey{}).(*machine.MachineContext)
+	return mc
+}
@@ -0,0 +1,253 @@
+package kvstore
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+
+	"github.com/aalpar/wile/values"
+)
+
+// ErrQuotaExceeded is returned when a write would take the store past its
+// configured capacity and the eviction policy cannot make room.
+var ErrQuotaExceeded = values.NewStaticError("quota exceeded")
+
+// EvictionPolicy decides what happens when a write would exceed the store's
+// capacity.
+type EvictionPolicy int
+
+const (
+	// EvictReject fails the write with ErrQuotaExceeded.
+	EvictReject EvictionPolicy = iota
+	// EvictLRU removes the least recently used keys to make room.
+	EvictLRU
+	// EvictLFU removes the least frequently used keys to make room.
+	EvictLFU
+)
+
+// evictionSample is how many keys are compared to choose each victim.
+// Sampling keeps eviction cheap in large stores; a store with fewer keys
+// than this is searched exactly.
+const evictionSample = 16
+
+// limits is a store's capacity. A zero maximum means no limit.
+type limits struct {
+	maxEntries int
+	maxBytes   int64
+	policy     EvictionPolicy
+}
+
+func (l limits) enabled() bool {
+	return l.maxEntries > 0 || l.maxBytes > 0
+}
+
+// tracksUsage reports whether the policy needs key access statistics.
+func (l limits) tracksUsage() bool {
+	return l.enabled() && l.policy != EvictReject
+}
+
+// usage records how recently and how often a key was used. A segment's usage
+// map is changed only by writers, but the fields are updated by readers
+// holding the segment for reading, so they are atomic.
+type usage struct {
+	last atomic.Int64 // value of kv.tick at the last use
+	uses atomic.Int64
+}
+
+// touch records a use of key. Callers hold key's segment.
+func (kv *KVStore) touch(key string) {
+	if u, ok := kv.segment(key).usage[key]; ok {
+		u.last.Store(kv.tick.Add(1))
+		u.uses.Add(1)
+	}
+}
+
+// track starts recording usage for key, counting the write as a use.
+// Callers hold key's segment for writing.
+func (kv *KVStore) track(key string) {
+	if !kv.limits.tracksUsage() {
+		return
+	}
+	seg := kv.segment(key)
+	if seg.usage == nil {
+		seg.usage = make(map[string]*usage)
+	}
+	u, ok := seg.usage[key]
+	if !ok {
+		u = &usage{}
+		seg.usage[key] = u
+	}
+	u.last.Store(kv.tick.Add(1))
+	u.uses.Add(1)
+}
+
+// makeRoom ensures that storing value under key, replacing prev, keeps the
+// store within its limits, evicting other keys if the policy allows.
+// Callers hold kv.mu for writing, as writeKey ensures for a store with
+// limits.
+func (sv *storeView) makeRoom(key, value string, prev version) error {
+	if !sv.limits.enabled() {
+		return nil
+	}
+	grow := 0
+	if !prev.present {
+		grow = 1
+	}
+	size := storedSize(key, value)
+	return sv.makeRoomFor(key, grow, size-prev.size(key), 1, size, func(k string) bool { return k == key })
+}
+
+// makeRoomForBatch is makeRoom for applyBatch: it ensures that the store
+// stays within its limits once all of ops are applied, evicting only keys
+// the batch does not write.
+func (sv *storeView) makeRoomForBatch(ops []BatchOp) error {
+	if !sv.limits.enabled() || len(ops) == 0 {
+		return nil
+	}
+	grow, delta := 0, int64(0)
+	cleared := ops[0].Clear
+	if cleared {
+		grow, delta = -sv.backend.Len(), -sv.stats.bytes.Load()
+	}
+	var key string
+	largest := int64(-1)
+	kept, keptSize := 0, int64(0) // what the batch leaves in the store
+	pending := make(map[string]version)
+	for _, op := range ops {
+		if op.Clear {
+			continue
+		}
+		prev, ok := pending[op.Key]
+		if !ok && !cleared {
+			var err error
+			if prev, err = sv.current(op.Key); err != nil {
+				return err
+			}
+		}
+		next := version{}
+		if !op.Delete {
+			next = version{value: op.Value, present: true}
+			if size := next.size(op.Key); size >= largest {
+				key, largest = op.Key, size
+			}
+		}
+		switch {
+		case next.present && !prev.present:
+			grow++
+		case !next.present && prev.present:
+			grow--
+		}
+		delta += next.size(op.Key) - prev.size(op.Key)
+		pending[op.Key] = next
+	}
+	if largest < 0 {
+		return nil // the batch only removes keys
+	}
+	for k, v := range pending {
+		if v.present {
+			kept++
+			keptSize += v.size(k)
+		}
+	}
+	return sv.makeRoomFor(key, grow, delta, kept, keptSize, func(k string) bool {
+		_, ok := pending[k]
+		return ok
+	})
+}
+
+// makeRoomFor evicts keys until the store has room to grow by grow entries
+// and delta bytes, for a write which stores key and leaves at least entries
+// keys of size bytes in the store. It never evicts a protected key.
+func (sv *storeView) makeRoomFor(key string, grow int, delta int64, entries int, size int64, protected func(string) bool) error {
+	kv := sv.KVStore
+	fits := func() bool {
+		return (kv.limits.maxEntries <= 0 || kv.backend.Len()+grow <= kv.limits.maxEntries) &&
+			(kv.limits.maxBytes <= 0 || kv.stats.bytes.Load()+delta <= kv.limits.maxBytes)
+	}
+	if fits() {
+		return nil
+	}
+	// A write too big for an otherwise empty store is rejected before
+	// anything is given up for it.
+	if (kv.limits.maxEntries > 0 && entries > kv.limits.maxEntries) ||
+		(kv.limits.maxBytes > 0 && size > kv.limits.maxBytes) {
+		return kv.quotaError(key)
+	}
+	// Keys whose TTL has run out are the cheapest to give up.
+	now := kv.now()
+	for i := range kv.segments {
+		for k, deadline := range kv.segments[i].expires {
+			if !protected(k) && !now.Before(deadline) {
+				if err := sv.remove(k, opExpire); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if fits() {
+		return nil
+	}
+	if kv.limits.policy == EvictReject {
+		return kv.quotaError(key)
+	}
+	for !fits() {
+		victim, ok := kv.victim(protected)
+		if !ok {
+			return kv.quotaError(key)
+		}
+		if err := sv.remove(victim, opEvict); err != nil {
+			return err
+		}
+		kv.stats.evictions.Add(1)
+		kv.logger.Debug("key evicted", "key", victim, "for", key)
+	}
+	return nil
+}
+
+// victim picks the key to evict next, never a protected one. The sample
+// starts at a random segment so that every segment gives up keys.
+func (kv *KVStore) victim(protected func(string) bool) (string, bool) {
+	var best string
+	var bestUsage *usage
+	n := 0
+	first := rand.IntN(len(kv.segments))
+	for i := range kv.segments {
+		seg := &kv.segments[(first+i)%len(kv.segments)]
+		for k, u := range seg.usage {
+			if protected(k) {
+				continue
+			}
+			if bestUsage == nil || kv.colder(u, bestUsage) {
+				best, bestUsage = k, u
+			}
+			if n++; n == evictionSample {
+				return best, true
+			}
+		}
+	}
+	return best, bestUsage != nil
+}
+
+// colder reports whether a should be evicted before b under the policy.
+func (kv *KVStore) colder(a, b *usage) bool {
+	if kv.limits.policy == EvictLFU {
+		if au, bu := a.uses.Load(), b.uses.Load(); au != bu {
+			return au < bu
+		}
+	}
+	return a.last.Load() < b.last.Load()
+}
+
+func (kv *KVStore) quotaError(key string) error {
+	return keyError(key, fmt.Errorf("%w: storing %q would exceed %v", ErrQuotaExceeded, key, kv.limits))
+}
+
+func (l limits) String() string {
+	switch {
+	case l.maxEntries > 0 && l.maxBytes > 0:
+		return fmt.Sprintf("the limit of %d entries or %d bytes", l.maxEntries, l.maxBytes)
+	case l.maxEntries > 0:
+		return fmt.Sprintf("the limit of %d entries", l.maxEntries)
+	}
+	return fmt.Sprintf("the limit of %d bytes", l.maxBytes)
+}
@@ -0,0 +1,90 @@
+package kvstore
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCapacityReject(t *testing.T) {
+	engine := newEngine(t, New(WithMaxEntries(2)))
+	eval(t, engine, `(kv-set! "a" 1) (kv-set! "b" 2)`)
+	checkRaises(t, engine, `(kv-set! "c" 3)`, "quota-exceeded")
+	checkRaises(t, engine, `(kv-set-many! '(("c" . 3) ("d" . 4)))`, "quota-exceeded")
+
+	// Replacing or removing keys needs no room.
+	eval(t, engine, `(kv-set! "a" 10) (kv-delete! "b") (kv-set! "c" 3)`)
+	check(t, engine,
+		`(equal? (kv-keys) '("a" "c"))`,
+		`(= (cdr (assq 'evictions (kv-stats))) 0)`)
+}
+
+func TestCapacityExpiredFirst(t *testing.T) {
+	clock := newFakeClock()
+	engine := newEngine(t, New(WithMaxEntries(2), WithClock(clock.now), WithJanitorInterval(time.Hour)))
+	eval(t, engine, `(kv-set! "short" 1 10) (kv-set! "b" 2)`)
+	clock.advance(10 * time.Millisecond)
+
+	// An expired key makes room even under EvictReject, and is reported
+	// as expired rather than evicted.
+	eval(t, engine, `(kv-set! "c" 3)`)
+	check(t, engine,
+		`(equal? (kv-keys) '("b" "c"))`,
+		`(= (cdr (assq 'evictions (kv-stats))) 0)`,
+		`(equal? (car (list-ref (kv-changes-since 0) 2)) 'expire)`)
+}
+
+func TestCapacityLRU(t *testing.T) {
+	store := New(WithMaxEntries(3), WithEvictionPolicy(EvictLRU))
+	engine := newEngine(t, store)
+	eval(t, engine, recordEvents(""))
+	eval(t, engine, `(kv-set! "a" 1) (kv-set! "b" 2) (kv-set! "c" 3) (kv-get "a")`)
+
+	eval(t, engine, `(kv-set! "d" 4)`)
+	check(t, engine,
+		`(equal? (kv-keys) '("a" "c" "d"))`,
+		`(equal? (list-ref (events-seen) 3) '(evict "b" 2 #f))`,
+		`(equal? (car (list-ref (kv-changes-since 0) 3)) 'evict)`)
+	if st := store.Stats(); st.Evictions != 1 {
+		t.Errorf("Stats().Evictions = %d, want 1", st.Evictions)
+	}
+}
+
+func TestCapacityLFU(t *testing.T) {
+	engine := newEngine(t, New(WithMaxEntries(3), WithEvictionPolicy(EvictLFU)))
+	eval(t, engine, `
+		(kv-set! "a" 1) (kv-set! "b" 2) (kv-set! "c" 3)
+		(kv-get "a") (kv-get "a") (kv-get "c") (kv-get "b") (kv-get "c")`)
+	eval(t, engine, `(kv-set! "d" 4)`)
+	check(t, engine, `(equal? (kv-keys) '("a" "c" "d"))`)
+}
+
+func TestCapacityBytes(t *testing.T) {
+	store := New(WithMaxBytes(20), WithEvictionPolicy(EvictLRU))
+	t.Cleanup(func() { store.close() })
+	for _, k := range []string{"k1", "k2"} {
+		if err := store.Set(k, "12345678"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A value larger than the limit is rejected without evicting anything.
+	if err := store.Set("big", strings.Repeat("x", 20)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Set of an oversized value = %v, want ErrQuotaExceeded", err)
+	}
+	if keys := store.Keys(); !slices.Equal(keys, []string{"k1", "k2"}) {
+		t.Errorf("keys after oversized write = %v", keys)
+	}
+
+	if err := store.Set("k3", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := store.Keys(); !slices.Equal(keys, []string{"k2", "k3"}) {
+		t.Errorf("keys = %v, want k1 evicted", keys)
+	}
+	if st := store.Stats(); st.Bytes != 20 || st.Evictions != 1 {
+		t.Errorf("Stats() = %+v, want 20 bytes and one eviction", st)
+	}
+}
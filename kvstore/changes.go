@@ -0,0 +1,195 @@
+package kvstore
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aalpar/wile/values"
+)
+
+// ErrChangesTruncated is returned when changes are requested from a revision
+// older than the change feed still holds.
+var ErrChangesTruncated = values.NewStaticError("change feed truncated")
+
+// changeLog is the store's change feed: every mutation is given the next
+// revision and kept in a ring holding the most recent entries. Revisions are
+// consecutive, so the entry for revision r lives at index (r-1) % len(ring).
+//
+// Revisions restart with each store, and when it is reopened, so the log
+// also has a random epoch that tells a follower whether the revisions it has
+// applied came from it.
+type changeLog struct {
+	epoch  atomic.Uint64
+	mu     sync.Mutex
+	rev    int64
+	ring   []change
+	wake   chan struct{}
+	closed bool
+}
+
+func newChangeLog(size int) *changeLog {
+	l := &changeLog{ring: make([]change, max(size, 0))}
+	l.epoch.Store(rand.Uint64())
+	return l
+}
+
+// append assigns ch the next revision, stores it and wakes any waiting
+// readers. It returns the revision.
+func (l *changeLog) append(ch change) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rev++
+	ch.rev = l.rev
+	if len(l.ring) > 0 {
+		l.ring[(ch.rev-1)%int64(len(l.ring))] = ch
+	}
+	if l.wake != nil {
+		close(l.wake)
+		l.wake = nil
+	}
+	return l.rev
+}
+
+// revision returns the most recently assigned revision.
+func (l *changeLog) revision() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rev
+}
+
+// since returns up to limit changes after rev, all of them if limit is zero
+// or less. It reports false if changes after rev have already been dropped
+// from the ring. When there are no newer changes it also returns a channel
+// that is closed when one arrives, or nil if the log has been closed.
+func (l *changeLog) since(rev int64, limit int) ([]change, <-chan struct{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	oldest := max(l.rev-int64(len(l.ring)), 0)
+	if rev < oldest {
+		return nil, nil, false
+	}
+	n := l.rev - rev
+	if limit > 0 && n > int64(limit) {
+		n = int64(limit)
+	}
+	if n <= 0 {
+		if l.closed {
+			return nil, nil, true
+		}
+		if l.wake == nil {
+			l.wake = make(chan struct{})
+		}
+		return nil, l.wake, true
+	}
+	out := make([]change, n)
+	for i := range out {
+		out[i] = l.ring[(rev+int64(i))%int64(len(l.ring))]
+	}
+	return out, nil, true
+}
+
+// close wakes every reader waiting for changes so they can finish.
+func (l *changeLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.wake != nil {
+		close(l.wake)
+		l.wake = nil
+	}
+}
+
+// reset empties the log of a reopened store and starts a new epoch.
+func (l *changeLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.epoch.Store(rand.Uint64())
+	l.rev = 0
+	clear(l.ring)
+	l.closed = false
+}
+
+// Revision returns the revision of the most recent change to the store, or
+// zero if it has never been changed.
+func (kv *KVStore) Revision() int64 {
+	return kv.changes.revision()
+}
+
+// Epoch returns the random number identifying the store's current run of
+// revisions. Revisions restart when the store is reopened or reset, and the
+// epoch changes with them, so an epoch and a revision together name one
+// change.
+func (kv *KVStore) Epoch() uint64 {
+	return kv.changes.epoch.Load()
+}
+
+// Changes streams the changes made after fromRev, in revision order, starting
+// with those still held by the change feed and then following new ones as
+// they are made. The channel is closed when ctx is done, when the store is
+// closed, or if the reader falls so far behind that changes it has not
+// received are dropped from the feed; compare the last Rev received with
+// Revision to tell these apart.
+//
+// Changes returns ErrChangesTruncated if the feed no longer holds the
+// changes after fromRev, and ErrStoreClosed if the store is closed.
+func (kv *KVStore) Changes(ctx context.Context, fromRev int64) (<-chan Event, error) {
+	if err := kv.opened(); err != nil {
+		return nil, err
+	}
+	if _, _, ok := kv.changes.since(fromRev, 1); !ok {
+		return nil, ErrChangesTruncated
+	}
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		rev := fromRev
+		for {
+			batch, wake, ok := kv.changes.since(rev, 0)
+			if !ok {
+				return
+			}
+			if len(batch) == 0 {
+				if wake == nil {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-wake:
+				}
+				continue
+			}
+			for _, ch := range batch {
+				ev, err := eventFrom(ch)
+				if err != nil {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case out <- ev:
+				}
+				rev = ch.rev
+			}
+		}
+	}()
+	return out, nil
+}
+
+// changeRecord returns the Scheme form of a change, (op key old new rev).
+// Missing keys and values are #f.
+func changeRecord(ch change) values.Value {
+	var key values.Value = values.FalseValue
+	if ch.op != opClear || ch.key != "" {
+		key = values.NewString(ch.key)
+	}
+	return values.List(
+		values.NewSymbol(ch.op),
+		key,
+		eventValue(ch.old, ch.hadOld),
+		eventValue(ch.new, ch.hasNew),
+		values.NewInteger(ch.rev),
+	)
+}
@@ -0,0 +1,77 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestChangeFeed(t *testing.T) {
+	engine := newEngine(t, New(WithChangeLogSize(4)))
+	check(t, engine, `(= (kv-revision) 0)`, `(null? (kv-changes-since 0))`)
+
+	eval(t, engine, `(kv-set! "a" "1") (kv-set! "a" "2") (kv-delete! "a") (kv-clear!)`)
+	check(t, engine,
+		`(= (kv-revision) 4)`,
+		`(equal? (kv-changes-since 0)
+		         '((set "a" #f "1" 1) (set "a" "1" "2" 2) (delete "a" "2" #f 3) (clear #f #f #f 4)))`,
+		`(equal? (map (lambda (r) (list-ref r 4)) (kv-changes-since 1 2)) '(2 3))`,
+		`(null? (kv-changes-since 4))`)
+
+	// Reads, and writes that change nothing, are not changes.
+	eval(t, engine, `(kv-get "a" #f) (kv-delete! "a") (kv-cas! "a" 1 2)`)
+	check(t, engine, `(= (kv-revision) 4)`)
+
+	// The ring holds the last four changes.
+	eval(t, engine, `(kv-set! "b" 1)`)
+	check(t, engine, `(equal? (map (lambda (r) (list-ref r 4)) (kv-changes-since 1)) '(2 3 4 5))`)
+	checkRaises(t, engine, `(kv-changes-since 0)`, "changes-truncated")
+}
+
+func TestChanges(t *testing.T) {
+	store := New(WithChangeLogSize(3))
+	t.Cleanup(func() { store.close() })
+	for _, k := range []string{"x", "a", "b", "c"} {
+		if err := store.Set(k, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Changes(context.Background(), 0); !errors.Is(err, ErrChangesTruncated) {
+		t.Errorf("Changes(0) = %v, want ErrChangesTruncated", err)
+	}
+
+	// The feed replays what it holds, then follows new changes.
+	ctx, cancel := context.WithCancel(context.Background())
+	feed, err := store.Changes(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		{Op: opSet, Key: "b", New: "v", HasNew: true, Rev: 3},
+		{Op: opSet, Key: "c", New: "v", HasNew: true, Rev: 4},
+		{Op: opDelete, Key: "a", Old: "v", HadOld: true, Rev: 5},
+	}
+	for _, w := range want {
+		if ev := <-feed; ev != w {
+			t.Errorf("received %+v, want %+v", ev, w)
+		}
+	}
+	cancel()
+	for range feed {
+	}
+
+	// Closing the store ends the feed.
+	feed, err = store.Changes(context.Background(), store.Revision())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+	for range feed {
+	}
+	if _, err := store.Changes(context.Background(), 0); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("Changes on a closed store = %v, want ErrStoreClosed", err)
+	}
+}
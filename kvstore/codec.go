@@ -0,0 +1,354 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"unicode"
+
+	"github.com/aalpar/wile/values"
+)
+
+// Values are stored in the backend as encoded strings. A string value is
+// stored as-is unless it is empty or begins with a NUL byte, so data written
+// before datums were supported still reads back as strings and backends stay
+// easy to inspect. Every other value is a NUL byte followed by a tagged
+// encoding:
+//
+//	string     's' uvarint len | bytes
+//	symbol     'y' uvarint len | bytes
+//	integer    'i' zigzag varint
+//	real       'r' float64 bits, little-endian
+//	boolean    't' | 'f'
+//	character  'c' uvarint code point
+//	list       'l' uvarint n | n × value | tail value  (tail is '(' for proper lists)
+//	empty list '('
+//	vector     'v' uvarint n | n × value
+//	bytevector 'b' uvarint len | bytes
+//	hashtable  'h' uvarint n | n × (key value), sorted by encoded key
+//
+// The encoding of a value is canonical, so two values are equal datums
+// exactly when their encodings are equal.
+
+const codecMarker = '\x00'
+
+const (
+	tagString    = 's'
+	tagSymbol    = 'y'
+	tagInteger   = 'i'
+	tagReal      = 'r'
+	tagTrue      = 't'
+	tagFalse     = 'f'
+	tagCharacter = 'c'
+	tagList      = 'l'
+	tagEmptyList = '('
+	tagVector    = 'v'
+	tagBytevec   = 'b'
+	tagHashtable = 'h'
+)
+
+// encodeString returns the stored form of a string value.
+func encodeString(s string) string {
+	if s != "" && s[0] != codecMarker {
+		return s
+	}
+	buf := []byte{codecMarker, tagString}
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return string(append(buf, s...))
+}
+
+// encodeValue returns the stored form of v. Values that have no stable
+// external representation, such as procedures, and values that contain
+// themselves fail with an *unserializableError.
+func encodeValue(v values.Value) (string, error) {
+	if s, ok := v.(*values.String); ok {
+		return encodeString(s.Value), nil
+	}
+	var e encoder
+	buf, err := e.appendValue([]byte{codecMarker}, v)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// decodeValue reverses encodeValue.
+func decodeValue(s string) (values.Value, error) {
+	if s != "" && s[0] != codecMarker {
+		return values.NewString(s), nil
+	}
+	if s == "" {
+		// Only data written by a backend directly can be empty.
+		return values.NewString(""), nil
+	}
+	v, rest, err := readValue([]byte(s[1:]))
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errCorruptValue
+	}
+	return v, nil
+}
+
+var errCorruptValue = errors.New("kvstore: corrupt encoded value")
+
+// unserializableError reports a value, possibly nested inside the one being
+// stored, that the codec cannot encode, or a pair, vector or hashtable that
+// contains itself.
+type unserializableError struct {
+	value  values.Value
+	cyclic bool
+}
+
+func (e *unserializableError) Error() string {
+	if e.cyclic {
+		return fmt.Sprintf("cannot store a cyclic value: a %T contains itself", e.value)
+	}
+	return fmt.Sprintf("cannot store a value of type %T", e.value)
+}
+
+// encoder holds the state of one encodeValue call. open holds the pairs,
+// vectors and hashtables being encoded, which are all pointers; meeting one
+// again inside itself means the value is cyclic. A value shared without a
+// cycle is encoded each time it appears.
+type encoder struct {
+	open map[values.Value]bool
+}
+
+// enter marks v as being encoded, failing if it already is.
+func (e *encoder) enter(v values.Value) error {
+	if e.open[v] {
+		return &unserializableError{value: v, cyclic: true}
+	}
+	if e.open == nil {
+		e.open = make(map[values.Value]bool)
+	}
+	e.open[v] = true
+	return nil
+}
+
+func (e *encoder) leave(v values.Value) {
+	delete(e.open, v)
+}
+
+func (e *encoder) appendValue(buf []byte, v values.Value) ([]byte, error) {
+	if values.IsEmptyList(v) {
+		return append(buf, tagEmptyList), nil
+	}
+	switch v := v.(type) {
+	case *values.String:
+		return appendBytes(append(buf, tagString), v.Value), nil
+	case *values.Symbol:
+		return appendBytes(append(buf, tagSymbol), v.Key), nil
+	case *values.Integer:
+		return binary.AppendVarint(append(buf, tagInteger), v.Value), nil
+	case *values.Float:
+		return binary.LittleEndian.AppendUint64(append(buf, tagReal), math.Float64bits(v.Value)), nil
+	case *values.Boolean:
+		if v.Value {
+			return append(buf, tagTrue), nil
+		}
+		return append(buf, tagFalse), nil
+	case *values.Character:
+		return binary.AppendUvarint(append(buf, tagCharacter), uint64(v.Value)), nil
+	case *values.Bytevector:
+		return appendBytes(append(buf, tagBytevec), string(*v)), nil
+	case *values.Vector:
+		if err := e.enter(v); err != nil {
+			return nil, err
+		}
+		defer e.leave(v)
+		buf = binary.AppendUvarint(append(buf, tagVector), uint64(len(*v)))
+		return e.appendValues(buf, *v)
+	case *values.Hashtable:
+		if err := e.enter(v); err != nil {
+			return nil, err
+		}
+		defer e.leave(v)
+		return e.appendHashtable(buf, v)
+	case values.Tuple:
+		return e.appendList(buf, v)
+	}
+	return nil, &unserializableError{value: v}
+}
+
+func appendBytes(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func (e *encoder) appendValues(buf []byte, vs []values.Value) ([]byte, error) {
+	var err error
+	for _, v := range vs {
+		if buf, err = e.appendValue(buf, v); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// appendList encodes a chain of pairs iteratively, so long lists do not
+// recurse once per element. Every pair in the chain stays open until the
+// list is encoded, which catches both a cdr that leads back into the chain
+// and an element that contains the list.
+func (e *encoder) appendList(buf []byte, t values.Tuple) ([]byte, error) {
+	var elems, pairs []values.Value
+	defer func() {
+		for _, p := range pairs {
+			e.leave(p)
+		}
+	}()
+	var tail values.Value = t
+	for {
+		pair, ok := tail.(values.Tuple)
+		if !ok || values.IsEmptyList(tail) {
+			break
+		}
+		if err := e.enter(pair); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+		elems = append(elems, pair.Car())
+		tail = pair.Cdr()
+	}
+	buf = binary.AppendUvarint(append(buf, tagList), uint64(len(elems)))
+	buf, err := e.appendValues(buf, elems)
+	if err != nil {
+		return nil, err
+	}
+	return e.appendValue(buf, tail)
+}
+
+// appendHashtable encodes entries sorted by encoded key so that equal tables
+// have equal encodings.
+func (e *encoder) appendHashtable(buf []byte, h *values.Hashtable) ([]byte, error) {
+	type entry struct{ key, value []byte }
+	keys := h.Keys()
+	entries := make([]entry, 0, len(keys))
+	for _, k := range keys {
+		kb, err := e.appendValue(nil, k)
+		if err != nil {
+			return nil, err
+		}
+		v, _ := h.Get(k)
+		vb, err := e.appendValue(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{kb, vb})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return string(entries[i].key) < string(entries[j].key)
+	})
+	buf = binary.AppendUvarint(append(buf, tagHashtable), uint64(len(entries)))
+	for _, en := range entries {
+		buf = append(append(buf, en.key...), en.value...)
+	}
+	return buf, nil
+}
+
+func readValue(p []byte) (values.Value, []byte, error) {
+	if len(p) == 0 {
+		return nil, nil, errCorruptValue
+	}
+	tag, p := p[0], p[1:]
+	switch tag {
+	case tagString, tagSymbol, tagBytevec:
+		s, rest, ok := readField(p)
+		if !ok {
+			return nil, nil, errCorruptValue
+		}
+		switch tag {
+		case tagString:
+			return values.NewString(s), rest, nil
+		case tagSymbol:
+			return values.NewSymbol(s), rest, nil
+		}
+		return values.NewBytevector([]byte(s)), rest, nil
+	case tagInteger:
+		n, w := binary.Varint(p)
+		if w <= 0 {
+			return nil, nil, errCorruptValue
+		}
+		return values.NewInteger(n), p[w:], nil
+	case tagReal:
+		if len(p) < 8 {
+			return nil, nil, errCorruptValue
+		}
+		return values.NewFloat(math.Float64frombits(binary.LittleEndian.Uint64(p))), p[8:], nil
+	case tagTrue:
+		return values.TrueValue, p, nil
+	case tagFalse:
+		return values.FalseValue, p, nil
+	case tagCharacter:
+		r, w := binary.Uvarint(p)
+		if w <= 0 || r > unicode.MaxRune {
+			return nil, nil, errCorruptValue
+		}
+		return values.NewCharacter(rune(r)), p[w:], nil
+	case tagEmptyList:
+		return values.EmptyList, p, nil
+	case tagList:
+		elems, p, err := readValues(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		tail, p, err := readValue(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := len(elems) - 1; i >= 0; i-- {
+			tail = values.NewCons(elems[i], tail)
+		}
+		return tail, p, nil
+	case tagVector:
+		elems, p, err := readValues(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		return values.NewVector(elems...), p, nil
+	case tagHashtable:
+		n, w := binary.Uvarint(p)
+		if w <= 0 || n > uint64(len(p)) {
+			return nil, nil, errCorruptValue
+		}
+		p = p[w:]
+		h := values.NewHashtable()
+		for range n {
+			var k, v values.Value
+			var err error
+			if k, p, err = readValue(p); err != nil {
+				return nil, nil, err
+			}
+			if v, p, err = readValue(p); err != nil {
+				return nil, nil, err
+			}
+			h.Set(k, v)
+		}
+		return h, p, nil
+	}
+	return nil, nil, errCorruptValue
+}
+
+// readValues reads a uvarint count followed by that many values.
+func readValues(p []byte) ([]values.Value, []byte, error) {
+	n, w := binary.Uvarint(p)
+	// Every value takes at least one byte, which bounds a corrupt count.
+	if w <= 0 || n > uint64(len(p)) {
+		return nil, nil, errCorruptValue
+	}
+	p = p[w:]
+	elems := make([]values.Value, 0, n)
+	for range n {
+		v, rest, err := readValue(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		elems = append(elems, v)
+		p = rest
+	}
+	return elems, p, nil
+}
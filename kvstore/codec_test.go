@@ -0,0 +1,139 @@
+package kvstore
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/aalpar/wile/values"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	table := values.NewHashtable()
+	table.Set(values.NewString("k"), values.NewInteger(1))
+	table.Set(values.NewSymbol("s"), values.List(values.TrueValue))
+	table.Set(values.NewInteger(7), values.NewVector())
+	shared := values.NewVector(values.NewInteger(1))
+
+	tests := []struct {
+		name  string
+		value values.Value
+		tag   byte // 0 for a string stored as-is
+	}{
+		{"plain string", values.NewString("hello"), 0},
+		{"empty string", values.NewString(""), tagString},
+		{"string starting with NUL", values.NewString("\x00x"), tagString},
+		{"symbol", values.NewSymbol("sym"), tagSymbol},
+		{"zero", values.NewInteger(0), tagInteger},
+		{"negative", values.NewInteger(-42), tagInteger},
+		{"max int", values.NewInteger(math.MaxInt64), tagInteger},
+		{"min int", values.NewInteger(math.MinInt64), tagInteger},
+		{"real", values.NewFloat(-1.5), tagReal},
+		{"true", values.TrueValue, tagTrue},
+		{"false", values.FalseValue, tagFalse},
+		{"character", values.NewCharacter('λ'), tagCharacter},
+		{"empty list", values.EmptyList, tagEmptyList},
+		{"proper list", values.List(values.NewInteger(1), values.NewString("two"), values.EmptyList), tagList},
+		{"improper list", values.NewCons(values.NewInteger(1), values.NewInteger(2)), tagList},
+		{"vector", values.NewVector(values.NewSymbol("a"), values.NewVector(values.FalseValue)), tagVector},
+		{"shared element", values.List(shared, shared), tagList},
+		{"bytevector", values.NewBytevector([]byte{0, 1, 255}), tagBytevec},
+		{"hashtable", table, tagHashtable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := encodeValue(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.tag == 0 {
+				if s := tt.value.(*values.String).Value; enc != s {
+					t.Errorf("stored %q, want it as-is", enc)
+				}
+			} else if len(enc) < 2 || enc[0] != codecMarker || enc[1] != tt.tag {
+				t.Errorf("encoding %q does not start with tag %q", enc, tt.tag)
+			}
+			got, err := decodeValue(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Encodings are canonical, so equal datums encode equally.
+			if again, err := encodeValue(got); err != nil || again != enc {
+				t.Errorf("decoded %s, which encodes as %q, %v; want %q", got.SchemeString(), again, err, enc)
+			}
+			if got.SchemeString() != tt.value.SchemeString() {
+				t.Errorf("decoded %s, want %s", got.SchemeString(), tt.value.SchemeString())
+			}
+		})
+	}
+}
+
+func TestCodecHashtableOrder(t *testing.T) {
+	a, b := values.NewHashtable(), values.NewHashtable()
+	for i := range 10 {
+		a.Set(values.NewInteger(int64(i)), values.NewInteger(int64(i)))
+		b.Set(values.NewInteger(int64(9-i)), values.NewInteger(int64(9-i)))
+	}
+	ea, err := encodeValue(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eb, err := encodeValue(b); err != nil || eb != ea {
+		t.Errorf("equal tables encode as %q and %q, %v", ea, eb, err)
+	}
+}
+
+func TestCodecCorrupt(t *testing.T) {
+	for _, enc := range []string{
+		"\x00",                  // no tag
+		"\x00?",                 // unknown tag
+		"\x00s\x05ab",           // string shorter than its length
+		"\x00i",                 // integer without a varint
+		"\x00r\x01\x02",         // short real
+		"\x00c\xff\xff\xff\x0f", // code point out of range
+		"\x00l\xff\x01",         // list count larger than the input
+		"\x00l\x01i\x02",        // list without its tail
+		"\x00v\x02t",            // vector missing an element
+		"\x00h\x01s\x01a",       // hashtable key without a value
+		"\x00t!",                // trailing bytes
+	} {
+		if v, err := decodeValue(enc); !errors.Is(err, errCorruptValue) {
+			t.Errorf("decodeValue(%q) = %v, %v; want errCorruptValue", enc, v, err)
+		}
+	}
+}
+
+func TestCodecCycles(t *testing.T) {
+	selfCdr := values.NewCons(values.NewInteger(1), values.EmptyList)
+	selfCdr.SetCdr(selfCdr)
+	longCycle := values.NewCons(values.NewInteger(1), values.EmptyList)
+	longCycle.SetCdr(values.NewCons(values.NewInteger(2), longCycle))
+	selfCar := values.NewCons(values.EmptyList, values.EmptyList)
+	selfCar.SetCar(selfCar)
+	vec := values.NewVector(values.FalseValue)
+	(*vec)[0] = vec
+	table := values.NewHashtable()
+	table.Set(values.NewString("self"), table)
+	outer := values.NewVector(values.FalseValue)
+	(*outer)[0] = values.List(values.NewInteger(1), outer)
+
+	for name, v := range map[string]values.Value{
+		"pair whose cdr is itself":                 selfCdr,
+		"list whose tail loops back":               longCycle,
+		"pair whose car is itself":                 selfCar,
+		"vector holding itself":                    vec,
+		"hashtable holding itself":                 table,
+		"vector holding a list holding the vector": outer,
+	} {
+		var ue *unserializableError
+		if _, err := encodeValue(v); !errors.As(err, &ue) || !ue.cyclic {
+			t.Errorf("%s: encodeValue = %v, want a cyclic value error", name, err)
+		}
+	}
+
+	engine := newEngine(t, New())
+	checkRaises(t, engine, `(let ((p (list 1 2))) (set-cdr! (cdr p) p) (kv-set! "k" p))`, "not-serializable")
+	checkRaises(t, engine, `(let ((v (vector 1))) (vector-set! v 0 v) (kv-set! "k" v))`, "not-serializable")
+	checkRaises(t, engine, `(kv-update! "k" (lambda (x) (let ((p (list x))) (set-car! p p) p)) 0)`, "not-serializable")
+	check(t, engine, `(eq? (kv-get "k" 'none) 'none)`)
+}
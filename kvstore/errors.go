@@ -0,0 +1,186 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aalpar/wile/machine"
+	"github.com/aalpar/wile/registry"
+	"github.com/aalpar/wile/values"
+)
+
+// KeyError is an error about one key, such as ErrKeyNotFound for a missing
+// one. It wraps the error describing what went wrong, so errors.Is still
+// matches the sentinel, and carries the key for errors.As and kv-error-key.
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string { return e.Err.Error() }
+
+func (e *KeyError) Unwrap() error { return e.Err }
+
+// keyError returns err as an error about key.
+func keyError(key string, err error) error {
+	return &KeyError{Key: key, Err: err}
+}
+
+// errorKinds gives each error kvstore raises the symbol kv-error-kind
+// returns for it. Every new sentinel belongs here, and in any errorClasses
+// group it fits, so that scripts can tell it apart from other failures.
+var errorKinds = []struct {
+	err  error
+	kind string
+}{
+	{ErrKeyNotFound, "key-not-found"},
+	{ErrVersionNotFound, "version-not-found"},
+	{ErrNotAString, "not-a-string"},
+	{ErrNotSerializable, "not-serializable"},
+	{ErrNotAnInteger, "not-an-integer"},
+	{ErrNotAList, "not-a-list"},
+	{ErrNotASnapshot, "not-a-snapshot"},
+	{ErrNotAStore, "not-a-store"},
+	{ErrInvalidTTL, "invalid-ttl"},
+	{ErrOverflow, "overflow"},
+	{ErrSnapshotReleased, "snapshot-released"},
+	{ErrStoreClosed, "store-closed"},
+	{ErrPermissionDenied, "permission-denied"},
+	{ErrReadOnlyReplica, "read-only-replica"},
+	{ErrAlreadyFollowing, "already-following"},
+	{ErrQuotaExceeded, "quota-exceeded"},
+	{ErrRevisionMismatch, "revision-mismatch"},
+	{ErrNestedTransaction, "nested-transaction"},
+	{ErrTransactionConflict, "transaction-conflict"},
+	{ErrChangesTruncated, "changes-truncated"},
+	{ErrHistoryDisabled, "history-disabled"},
+	{ErrStorage, "storage"},
+}
+
+// errorKind returns the kind of a kvstore error, or "" if err is not one.
+func errorKind(err error) string {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.err) {
+			return k.kind
+		}
+	}
+	return ""
+}
+
+// errorClasses are the kv-*-error? predicates, named without the primitive
+// prefix. Each recognizes the errors of the listed kinds; kv-error?
+// recognizes every kind.
+var errorClasses = []struct {
+	name  string
+	kinds []string
+	doc   string
+}{
+	{
+		name:  "key-not-found-error?",
+		kinds: []string{"key-not-found"},
+		doc:   "Return #t if obj is an error raised because a key is missing.",
+	},
+	{
+		name:  "type-error?",
+		kinds: []string{"not-a-string", "not-serializable", "not-an-integer", "not-a-list", "not-a-snapshot", "not-a-store"},
+		doc:   "Return #t if obj is an error raised because an argument or stored value has the wrong type.",
+	},
+	{
+		name:  "closed-error?",
+		kinds: []string{"snapshot-released", "store-closed"},
+		doc:   "Return #t if obj is an error raised by using a snapshot or store after it was released or closed.",
+	},
+	{
+		name:  "permission-denied-error?",
+		kinds: []string{"permission-denied"},
+		doc:   "Return #t if obj is an error raised because the engine's policy denied an operation.",
+	},
+}
+
+// conditionError returns the error a raised object carries. Errors returned
+// by primitives reach Scheme handlers as objects implementing error.
+func conditionError(v values.Value) (error, bool) {
+	err, ok := v.(error)
+	return err, ok
+}
+
+// errorSpecs returns the PrimitiveSpecs of the error predicates and
+// accessors.
+func (kv *KVStore) errorSpecs() []registry.PrimitiveSpec {
+	specs := []registry.PrimitiveSpec{{
+		Name:       kv.prefix + "error?",
+		ParamCount: 1,
+		Impl:       errorPredicate(nil),
+		Doc:        "Return #t if obj is an error raised by a kvstore primitive.",
+		ParamNames: []string{"obj"},
+		Category:   kv.category,
+	}}
+	for _, cl := range errorClasses {
+		specs = append(specs, registry.PrimitiveSpec{
+			Name:       kv.prefix + cl.name,
+			ParamCount: 1,
+			Impl:       errorPredicate(cl.kinds),
+			Doc:        cl.doc,
+			ParamNames: []string{"obj"},
+			Category:   kv.category,
+		})
+	}
+	return append(specs,
+		registry.PrimitiveSpec{
+			Name:       kv.prefix + "error-kind",
+			ParamCount: 1,
+			Impl:       primErrorKind,
+			Doc:        "Return a symbol naming the kind of a kvstore error, such as key-not-found, or #f for any other object.",
+			ParamNames: []string{"obj"},
+			Category:   kv.category,
+		},
+		registry.PrimitiveSpec{
+			Name:       kv.prefix + "error-key",
+			ParamCount: 1,
+			Impl:       primErrorKey,
+			Doc:        "Return the key a kvstore error is about, or #f if it is not about one key.",
+			ParamNames: []string{"obj"},
+			Category:   kv.category,
+		},
+	)
+}
+
+// errorPredicate returns a primitive reporting whether its argument is a
+// kvstore error of one of kinds, or of any kind if kinds is nil.
+func errorPredicate(kinds []string) machine.ForeignFunction {
+	return func(_ context.Context, mc *machine.MachineContext) error {
+		match := false
+		if err, ok := conditionError(mc.Arg(0)); ok {
+			kind := errorKind(err)
+			match = kind != "" && kinds == nil
+			for _, k := range kinds {
+				match = match || k == kind
+			}
+		}
+		mc.SetValue(boolean(match))
+		return nil
+	}
+}
+
+// primErrorKind implements (kv-error-kind obj) → symbol or #f.
+func primErrorKind(_ context.Context, mc *machine.MachineContext) error {
+	var result values.Value = values.FalseValue
+	if err, ok := conditionError(mc.Arg(0)); ok {
+		if kind := errorKind(err); kind != "" {
+			result = values.NewSymbol(kind)
+		}
+	}
+	mc.SetValue(result)
+	return nil
+}
+
+// primErrorKey implements (kv-error-key obj) → string or #f.
+func primErrorKey(_ context.Context, mc *machine.MachineContext) error {
+	var result values.Value = values.FalseValue
+	var ke *KeyError
+	if err, ok := conditionError(mc.Arg(0)); ok && errors.As(err, &ke) {
+		result = values.NewString(ke.Key)
+	}
+	mc.SetValue(result)
+	return nil
+}
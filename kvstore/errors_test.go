@@ -0,0 +1,102 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aalpar/wile"
+	"github.com/aalpar/wile/values"
+)
+
+func TestErrorPredicates(t *testing.T) {
+	store := New()
+	engine := newEngine(t, store)
+	guest := newEngine(t, store.Restrict(Policy{ReadOnly: true}))
+	closed := New()
+	closedEngine := newEngine(t, closed)
+	eval(t, engine, `(kv-set! "word" "abc")`)
+	closed.Close()
+
+	tests := []struct {
+		code  string
+		kind  string // "" for an error kvstore did not raise
+		key   string // "" if the error is not about a key
+		class string // the predicate other than kv-error? that holds, if any
+	}{
+		{`(kv-get "missing")`, "key-not-found", "missing", "kv-key-not-found-error?"},
+		{`(kv-get 1)`, "not-a-string", "", "kv-type-error?"},
+		{`(kv-get-many '("a" 1))`, "not-a-string", "", "kv-type-error?"},
+		{`(kv-set! "k" (lambda () 1))`, "not-serializable", "", "kv-type-error?"},
+		{`(kv-incr! "word")`, "not-an-integer", "word", "kv-type-error?"},
+		{`(kv-get-many 5)`, "not-a-list", "", "kv-type-error?"},
+		{`(kv-snapshot-get 1 "k")`, "not-a-snapshot", "", "kv-type-error?"},
+		{`(kv-store-get 1 "k")`, "not-a-store", "", "kv-type-error?"},
+		{`(kv-set! "k" 1 0)`, "invalid-ttl", "", ""},
+		{`(kv-history "k")`, "history-disabled", "", ""},
+		{`(kv-transaction (lambda () (kv-transaction (lambda () 1))))`, "nested-transaction", "", ""},
+		{`(error "not ours")`, "", "", ""},
+		{`(string-length 1)`, "", "", ""},
+		{`(raise 'symbol)`, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			eval(t, engine, fmt.Sprintf(`(define e (guard (e (#t e)) %s 'returned))`, tt.code))
+			checkCondition(t, engine, tt.kind, tt.key, tt.class)
+		})
+	}
+
+	eval(t, guest, `(define e (guard (e (#t e)) (kv-set! "k" 1)))`)
+	checkCondition(t, guest, "permission-denied", "", "kv-permission-denied-error?")
+	eval(t, guest, `(define e (guard (e (#t e)) (kv-get "missing")))`)
+	checkCondition(t, guest, "key-not-found", "missing", "kv-key-not-found-error?")
+	eval(t, closedEngine, `(define e (guard (e (#t e)) (kv-get "k")))`)
+	checkCondition(t, closedEngine, "store-closed", "", "kv-closed-error?")
+}
+
+// checkCondition checks what the error predicates and accessors say about
+// the object bound to e on engine: a kvstore error of kind about key, in
+// class, or no kvstore error if kind is "".
+func checkCondition(t *testing.T, engine *wile.Engine, kind, key, class string) {
+	t.Helper()
+	exprs := []string{fmt.Sprintf("(eq? (kv-error? e) %s)", schemeBool(kind != ""))}
+	for _, pred := range []string{"kv-key-not-found-error?", "kv-type-error?", "kv-closed-error?", "kv-permission-denied-error?"} {
+		exprs = append(exprs, fmt.Sprintf("(eq? (%s e) %s)", pred, schemeBool(pred == class)))
+	}
+	if kind == "" {
+		exprs = append(exprs, "(not (kv-error-kind e))")
+	} else {
+		exprs = append(exprs, fmt.Sprintf("(eq? (kv-error-kind e) '%s)", kind))
+	}
+	if key == "" {
+		exprs = append(exprs, "(not (kv-error-key e))")
+	} else {
+		exprs = append(exprs, fmt.Sprintf("(equal? (kv-error-key e) %q)", key))
+	}
+	check(t, engine, exprs...)
+}
+
+func schemeBool(b bool) string {
+	if b {
+		return "#t"
+	}
+	return "#f"
+}
+
+func TestConditionError(t *testing.T) {
+	// Primitives' errors reach handlers as the error they returned, which
+	// the predicates and accessors rely on.
+	engine := newEngine(t, New())
+	v := eval(t, engine, `(guard (e (#t e)) (kv-get "missing"))`)
+	err, ok := conditionError(v)
+	var ke *KeyError
+	if !ok || !errors.Is(err, ErrKeyNotFound) || !errors.As(err, &ke) || ke.Key != "missing" {
+		t.Errorf("handler got %s, want the primitive's key error", v.SchemeString())
+	}
+
+	// A string argument error is kvstore's own, not wile's.
+	err = evalError(t, engine, `(kv-get 1)`)
+	if !errors.Is(err, ErrNotAString) || errors.Is(err, values.ErrNotAString) {
+		t.Errorf("(kv-get 1) raised %v, want ErrNotAString", err)
+	}
+}
@@ -2,14 +2,21 @@
 //
 // It demonstrates the full extension authoring pattern:
 //   - Implementing registry.Extension and registry.Closeable
-//   - Stateful extension (the KVStore holds a map that primitives read/write)
+//   - Stateful extension (the KVStore holds a Backend that primitives read/write)
 //   - Registering ForeignFunction primitives via AddPrimitives
 //   - Proper error handling with sentinel errors and WrapForeignErrorf
+//
+// Storage is pluggable through the Backend interface. The default keeps
+// everything in memory; Open returns a store made durable by a write-ahead
+// log, and OpenBTreeBackend provides a single-file on-disk B-tree.
 package kvstore
 
 import (
-	"fmt"
+	"hash/maphash"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aalpar/wile/registry"
 	"github.com/aalpar/wile/values"
@@ -18,37 +25,182 @@ import (
 // ErrKeyNotFound is returned when a key lookup fails without a default value.
 var ErrKeyNotFound = values.NewStaticError("key not found")
 
-// KVStore is an in-memory key-value store extension.
+// ErrStorage is returned when the backend fails to read or write an entry.
+// A mutation that fails this way leaves the store unchanged.
+var ErrStorage = values.NewStaticError("storage failure")
+
+// ErrNotSerializable is returned when a value cannot be stored because it
+// has no stable encoding, such as a procedure.
+var ErrNotSerializable = values.NewStaticError("value is not serializable")
+
+// ErrNestedTransaction is returned when kv-transaction is called from inside
+// a transaction on the same store.
+var ErrNestedTransaction = values.NewStaticError("nested transaction")
+
+// ErrInvalidTTL is returned when a TTL is zero or negative.
+var ErrInvalidTTL = values.NewStaticError("invalid TTL")
+
+// ErrNotAString is returned when an argument, such as a key, must be a
+// string.
+var ErrNotAString = values.NewStaticError("not a string")
+
+// ErrNotAnInteger is returned when an argument, or a counter's stored value,
+// must be an exact integer.
+var ErrNotAnInteger = values.NewStaticError("not an integer")
+
+// ErrNotAList is returned when an argument must be a proper list, such as the
+// keys of a batch or an alist of entries.
+var ErrNotAList = values.NewStaticError("not a list")
+
+// ErrOverflow is returned when a counter update would overflow a 64-bit
+// integer. The counter is left unchanged.
+var ErrOverflow = values.NewStaticError("integer overflow")
+
+// KVStore is a key-value store extension.
 // It implements both registry.Extension and registry.Closeable.
 type KVStore struct {
-	mu   sync.RWMutex
-	data map[string]string
+	mu      sync.RWMutex
+	backend Backend
+
+	// Names the store registers under, and the logger its events go to.
+	name     string
+	prefix   string
+	category string
+	logger   *slog.Logger
+
+	// Lifecycle; see Close and Reopen. lifeMu orders Close and Reopen,
+	// and openBackend, if set, opens the backend anew for Reopen.
+	lifeMu      sync.Mutex
+	state       atomic.Int32
+	openBackend func() (Backend, error)
+
+	// Segments holding per-key state and locks; see segment.
+	seed     maphash.Seed
+	segments []segment
+
+	// Sorted index of the backend's keys, built on first use. Writers
+	// holding only a segment lock also hold indexMu to change it.
+	index     *keyIndex
+	indexOnce sync.Once
+	indexErr  error
+	indexMu   sync.Mutex
+
+	// Expiry of keys set with a TTL, and the janitor that evicts them.
+	now             func() time.Time
+	janitorInterval time.Duration
+	janitorMu       sync.Mutex
+	janitorStop     chan struct{}
+	wg              sync.WaitGroup
+
+	// Watchers registered with kv-watch, by token, and the same watchers
+	// in token order for the writers that notify them.
+	watchMu   sync.Mutex
+	watchers  map[int64]watcher
+	nextWatch int64
+	watching  atomic.Pointer[[]watcher]
+
+	// Bindings of the engines that loaded the store itself, released by
+	// Close.
+	bindMu   sync.Mutex
+	bindings []*binding
+
+	// Change feed assigning every mutation a revision.
+	changes *changeLog
+
+	// Set while the store follows a leader; see Follow.
+	replica atomic.Bool
+
+	// Open snapshots, and the replaced values kept for them by key in
+	// revision order.
+	snaps    snapshots
+	versMu   sync.Mutex
+	versions map[string][]version
+
+	// Operational statistics, updated atomically.
+	stats counters
+
+	// Recent versions of each key, if enabled with WithHistory.
+	histMu  sync.Mutex
+	history history
+
+	// Capacity limits, and the clock ordering key uses for eviction.
+	limits limits
+	tick   atomic.Int64
+
+	// Named stores opened with kv-open.
+	storesMu sync.Mutex
+	stores   map[string]*KVStore
 }
 
 // New creates a new KVStore extension.
-func New() *KVStore {
+func New(opts ...Option) *KVStore {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var openBackend func() (Backend, error)
+	if o.backend == nil {
+		o.backend = NewMemoryBackend()
+		openBackend = func() (Backend, error) { return NewMemoryBackend(), nil }
+	}
 	return &KVStore{
-		data: make(map[string]string),
+		backend:         concurrentBackend(o.backend),
+		name:            o.name,
+		prefix:          o.prefix,
+		category:        o.category,
+		logger:          o.logger.With("extension", o.name),
+		openBackend:     openBackend,
+		seed:            maphash.MakeSeed(),
+		segments:        newSegments(o.shards),
+		now:             o.clock,
+		janitorInterval: o.janitorInterval,
+		changes:         newChangeLog(o.changeLogSize),
+		limits:          o.limits,
+		history:         history{perKey: o.historyPerKey, total: o.historyTotal},
 	}
 }
 
+// Open creates a KVStore backed by the write-ahead log at path. See
+// OpenLogBackend for recovery behavior.
+func Open(path string, opts ...Option) (*KVStore, error) {
+	b, err := OpenLogBackend(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	kv := New(append(opts, WithBackend(b))...)
+	kv.openBackend = func() (Backend, error) { return OpenLogBackend(path, opts...) }
+	return kv, nil
+}
+
 // Name returns the extension name.
 func (kv *KVStore) Name() string {
-	return "kvstore"
+	return kv.name
 }
 
 // AddToRegistry registers all kvstore primitives.
 func (kv *KVStore) AddToRegistry(r *registry.Registry) error {
-	r.AddPrimitives(kv.primitiveSpecs(), registry.PhaseRuntime)
+	b := newBinding(kv, nil)
+	kv.bindMu.Lock()
+	kv.bindings = append(kv.bindings, b)
+	kv.bindMu.Unlock()
+	r.AddPrimitives(kv.primitiveSpecs(b), registry.PhaseRuntime)
 	return nil
 }
 
-// Close cleans up the store. Implements registry.Closeable.
+// Close stops the janitor and cleans up the store, its backend and any named
+// stores opened with kv-open, once the operations in progress have finished.
+// Operations started afterwards fail with ErrStoreClosed. It also removes the
+// watches registered with kv-watch by the engines that loaded the store
+// itself, which close it when they close. Close is idempotent. Implements
+// registry.Closeable.
 func (kv *KVStore) Close() error {
-	kv.mu.Lock()
-	defer kv.mu.Unlock()
-	count := len(kv.data)
-	kv.data = nil
-	fmt.Printf("[kvstore] closed (had %d entries)\n", count)
-	return nil
+	err := kv.close()
+	kv.bindMu.Lock()
+	bindings := kv.bindings
+	kv.bindings = nil
+	kv.bindMu.Unlock()
+	for _, b := range bindings {
+		b.release()
+	}
+	return err
 }
@@ -0,0 +1,62 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aalpar/wile"
+	"github.com/aalpar/wile/registry"
+)
+
+// newEngine returns an engine with ext loaded. It is closed when the test
+// ends, which closes ext if it is a store.
+func newEngine(t *testing.T, ext registry.Extension) *wile.Engine {
+	t.Helper()
+	engine, err := wile.NewEngine(context.Background(), wile.WithExtension(ext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	return engine
+}
+
+// eval runs code on engine and returns its last value, failing the test if
+// it raises.
+func eval(t *testing.T, engine *wile.Engine, code string) wile.Value {
+	t.Helper()
+	v, err := engine.EvalMultiple(context.Background(), code)
+	if err != nil {
+		t.Fatalf("%s: %v", code, err)
+	}
+	return v
+}
+
+// check fails the test unless each expression evaluates to #t.
+func check(t *testing.T, engine *wile.Engine, exprs ...string) {
+	t.Helper()
+	for _, expr := range exprs {
+		if v := eval(t, engine, expr); v.SchemeString() != "#t" {
+			t.Errorf("%s = %s", expr, v.SchemeString())
+		}
+	}
+}
+
+// evalError runs code on engine and returns the error it raises, failing
+// the test if it returns normally.
+func evalError(t *testing.T, engine *wile.Engine, code string) error {
+	t.Helper()
+	v, err := engine.EvalMultiple(context.Background(), code)
+	if err == nil {
+		t.Fatalf("%s = %s, want an error", code, v.SchemeString())
+	}
+	return err
+}
+
+// checkRaises fails the test unless code raises a kvstore error of kind.
+func checkRaises(t *testing.T, engine *wile.Engine, code, kind string) {
+	t.Helper()
+	v := eval(t, engine, "(guard (e (#t (kv-error-kind e))) "+code+" 'returned)")
+	if got := v.SchemeString(); got != kind {
+		t.Errorf("%s raised %s, want %s", code, got, kind)
+	}
+}
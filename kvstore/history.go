@@ -0,0 +1,159 @@
+package kvstore
+
+import (
+	"time"
+
+	"github.com/aalpar/wile/values"
+)
+
+// ErrHistoryDisabled is returned by the history primitives when the store
+// was created without WithHistory.
+var ErrHistoryDisabled = values.NewStaticError("history disabled")
+
+// ErrVersionNotFound is returned when kv-revert! names a revision that is not
+// in the key's retained history.
+var ErrVersionNotFound = values.NewStaticError("version not found")
+
+// historyEntry is one retained version of a key: the change made at rev and
+// the time it was made. value is the new value after a set.
+type historyEntry struct {
+	rev   int64
+	at    time.Time
+	op    string
+	value string
+}
+
+// present reports whether the key had a value after the change.
+func (e historyEntry) present() bool {
+	return e.op == opSet
+}
+
+// history keeps the most recent versions of each key, at most perKey per key
+// and total overall. Writers holding only a segment lock also hold kv.histMu
+// to change it.
+type history struct {
+	perKey  int
+	total   int
+	entries map[string][]historyEntry
+	size    int
+
+	// order lists (key, rev) in the order versions were added so the
+	// oldest can be dropped when total is reached. References to versions
+	// already dropped by the per-key bound are skipped.
+	order []historyRef
+}
+
+type historyRef struct {
+	key string
+	rev int64
+}
+
+func (h *history) enabled() bool {
+	return h.perKey > 0
+}
+
+// add retains e as the newest version of key.
+func (h *history) add(key string, e historyEntry) {
+	if h.entries == nil {
+		h.entries = make(map[string][]historyEntry)
+	}
+	es := append(h.entries[key], e)
+	if len(es) > h.perKey {
+		es = append(es[:0:0], es[len(es)-h.perKey:]...)
+		h.size--
+	}
+	h.entries[key] = es
+	h.size++
+	h.order = append(h.order, historyRef{key, e.rev})
+
+	for h.total > 0 && h.size > h.total {
+		ref := h.order[0]
+		h.order = h.order[1:]
+		es := h.entries[ref.key]
+		if len(es) == 0 || es[0].rev != ref.rev {
+			continue
+		}
+		if len(es) == 1 {
+			delete(h.entries, ref.key)
+		} else {
+			h.entries[ref.key] = es[1:]
+		}
+		h.size--
+	}
+	// Stale references accumulate as the per-key bound drops versions;
+	// rebuild the order once they outnumber the live ones.
+	if len(h.order) > 2*h.size+64 {
+		live := h.order[:0:0]
+		for _, ref := range h.order {
+			for _, e := range h.entries[ref.key] {
+				if e.rev == ref.rev {
+					live = append(live, ref)
+					break
+				}
+			}
+		}
+		h.order = live
+	}
+}
+
+// at returns the version of key in effect at time t, reporting false if no
+// retained version is that old.
+func (h *history) at(key string, t time.Time) (historyEntry, bool) {
+	es := h.entries[key]
+	for i := len(es) - 1; i >= 0; i-- {
+		if !es[i].at.After(t) {
+			return es[i], true
+		}
+	}
+	return historyEntry{}, false
+}
+
+// find returns the version of key made at rev.
+func (h *history) find(key string, rev int64) (historyEntry, bool) {
+	for _, e := range h.entries[key] {
+		if e.rev == rev {
+			return e, true
+		}
+	}
+	return historyEntry{}, false
+}
+
+// remember adds the change at ch.rev to the history. Callers hold ch.key's
+// segment for writing, or kv.mu.
+func (kv *KVStore) remember(ch change) {
+	if !kv.history.enabled() {
+		return
+	}
+	kv.histMu.Lock()
+	defer kv.histMu.Unlock()
+	kv.history.add(ch.key, historyEntry{rev: ch.rev, at: kv.now(), op: ch.op, value: ch.new})
+}
+
+// rememberClear adds a clear at rev to the history of every key that has
+// one. Callers hold kv.mu for writing.
+func (kv *KVStore) rememberClear(rev int64) {
+	if !kv.history.enabled() {
+		return
+	}
+	now := kv.now()
+	keys := make([]string, 0, len(kv.history.entries))
+	for k, es := range kv.history.entries {
+		if es[len(es)-1].present() {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		kv.history.add(k, historyEntry{rev: rev, at: now, op: opClear})
+	}
+}
+
+// historyRecord returns the Scheme form of a version, (rev time-ms op value),
+// with #f for the value of a version that removed the key.
+func historyRecord(e historyEntry) values.Value {
+	return values.List(
+		values.NewInteger(e.rev),
+		values.NewInteger(e.at.UnixMilli()),
+		values.NewSymbol(e.op),
+		eventValue(e.value, e.present()),
+	)
+}
@@ -0,0 +1,70 @@
+package kvstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	clock := newFakeClock()
+	engine := newEngine(t, New(WithHistory(3, 0), WithClock(clock.now)))
+	t0 := clock.now().UnixMilli()
+
+	eval(t, engine, `(kv-set! "k" "a")`)
+	clock.advance(time.Second)
+	eval(t, engine, `(kv-set! "k" "b")`)
+	clock.advance(time.Second)
+	eval(t, engine, `(kv-delete! "k")`)
+
+	check(t, engine,
+		fmt.Sprintf(`(equal? (kv-history "k") '((1 %d set "a") (2 %d set "b") (3 %d delete #f)))`, t0, t0+1000, t0+2000),
+		`(null? (kv-history "other"))`,
+		fmt.Sprintf(`(equal? (kv-get-at "k" %d) "a")`, t0+500),
+		fmt.Sprintf(`(equal? (kv-get-at "k" %d) "b")`, t0+1999),
+		fmt.Sprintf(`(eq? (kv-get-at "k" %d 'none) 'none)`, t0+2000),
+		fmt.Sprintf(`(eq? (kv-get-at "k" %d 'none) 'none)`, t0-1))
+	checkRaises(t, engine, fmt.Sprintf(`(kv-get-at "k" %d)`, t0-1), "key-not-found")
+
+	// Reverting makes a new version, and the oldest falls out of the
+	// per-key bound.
+	eval(t, engine, `(kv-revert! "k" 1)`)
+	check(t, engine,
+		`(equal? (kv-get "k") "a")`,
+		`(equal? (map car (kv-history "k")) '(2 3 4))`)
+	checkRaises(t, engine, `(kv-revert! "k" 1)`, "version-not-found")
+
+	// Reverting to a version that removed the key deletes it.
+	eval(t, engine, `(kv-revert! "k" 3)`)
+	check(t, engine, `(not (kv-get "k" #f))`)
+}
+
+func TestHistoryTotal(t *testing.T) {
+	engine := newEngine(t, New(WithHistory(2, 3)))
+	revs := func(key string) string {
+		return fmt.Sprintf(`(map car (kv-history %q))`, key)
+	}
+
+	// The total bound drops the oldest version first, whichever key it
+	// belongs to.
+	eval(t, engine, `(kv-set! "a" 1) (kv-set! "b" 2) (kv-set! "c" 3) (kv-set! "a" 4)`)
+	check(t, engine,
+		`(equal? `+revs("a")+` '(4))`,
+		`(equal? `+revs("b")+` '(2))`,
+		`(equal? `+revs("c")+` '(3))`)
+
+	// A clear adds a version to every key it removed.
+	eval(t, engine, `(kv-clear!)`)
+	check(t, engine,
+		`(equal? (map caddr (kv-history "a")) '(clear))`,
+		`(equal? `+revs("b")+` '(5))`,
+		`(equal? `+revs("c")+` '(5))`)
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	engine := newEngine(t, New())
+	eval(t, engine, `(kv-set! "k" "a")`)
+	checkRaises(t, engine, `(kv-history "k")`, "history-disabled")
+	checkRaises(t, engine, `(kv-get-at "k" 0 #f)`, "history-disabled")
+	checkRaises(t, engine, `(kv-revert! "k" 1)`, "history-disabled")
+}
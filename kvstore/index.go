@@ -0,0 +1,161 @@
+package kvstore
+
+import "math/rand/v2"
+
+const (
+	indexMaxLevel = 32
+	indexBranch   = 4 // each level holds about 1/indexBranch of the one below
+)
+
+// keyIndex is a skip list of keys kept in sorted order, so that kv-keys and
+// range scans never sort. Readers hold every segment or kv.mu; writers
+// holding only a segment lock also hold kv.indexMu.
+type keyIndex struct {
+	head  indexNode
+	tail  *indexNode
+	level int
+	len   int
+}
+
+type indexNode struct {
+	key  string
+	prev *indexNode // level 0 only, for reverse iteration; nil at the front
+	next []*indexNode
+}
+
+func newKeyIndex(keys []string) *keyIndex {
+	idx := &keyIndex{}
+	idx.clear()
+	for _, k := range keys {
+		idx.insert(k)
+	}
+	return idx
+}
+
+// clear removes every key.
+func (idx *keyIndex) clear() {
+	idx.head.next = make([]*indexNode, indexMaxLevel)
+	idx.tail = nil
+	idx.level = 1
+	idx.len = 0
+}
+
+// path fills update with the rightmost node at each level whose key is
+// below key, and returns the node after it at level 0.
+func (idx *keyIndex) path(key string, update *[indexMaxLevel]*indexNode) *indexNode {
+	x := &idx.head
+	for i := idx.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	return x.next[0]
+}
+
+// insert adds key if it is not already present.
+func (idx *keyIndex) insert(key string) {
+	var update [indexMaxLevel]*indexNode
+	if n := idx.path(key, &update); n != nil && n.key == key {
+		return
+	}
+	level := randomLevel()
+	for i := idx.level; i < level; i++ {
+		update[i] = &idx.head
+	}
+	idx.level = max(idx.level, level)
+
+	n := &indexNode{key: key, next: make([]*indexNode, level)}
+	for i := range level {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	if update[0] != &idx.head {
+		n.prev = update[0]
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = n
+	} else {
+		idx.tail = n
+	}
+	idx.len++
+}
+
+// remove deletes key if it is present.
+func (idx *keyIndex) remove(key string) {
+	var update [indexMaxLevel]*indexNode
+	n := idx.path(key, &update)
+	if n == nil || n.key != key {
+		return
+	}
+	for i := range n.next {
+		update[i].next[i] = n.next[i]
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = n.prev
+	} else {
+		idx.tail = n.prev
+	}
+	for idx.level > 1 && idx.head.next[idx.level-1] == nil {
+		idx.level--
+	}
+	idx.len--
+}
+
+// seek returns the first node whose key is at or above key.
+func (idx *keyIndex) seek(key string) *indexNode {
+	var update [indexMaxLevel]*indexNode
+	return idx.path(key, &update)
+}
+
+// ascend calls fn for each key in [start, end) in ascending order until fn
+// returns false. An empty end means no upper bound.
+func (idx *keyIndex) ascend(start, end string, fn func(string) bool) {
+	for n := idx.seek(start); n != nil; n = n.next[0] {
+		if end != "" && n.key >= end {
+			return
+		}
+		if !fn(n.key) {
+			return
+		}
+	}
+}
+
+// descend calls fn for each key in [start, end) in descending order until fn
+// returns false. An empty end means no upper bound.
+func (idx *keyIndex) descend(start, end string, fn func(string) bool) {
+	n := idx.tail
+	if end != "" {
+		if n = idx.seek(end); n != nil {
+			n = n.prev
+		} else {
+			n = idx.tail
+		}
+	}
+	for ; n != nil && n.key >= start; n = n.prev {
+		if !fn(n.key) {
+			return
+		}
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < indexMaxLevel && rand.IntN(indexBranch) == 0 {
+		level++
+	}
+	return level
+}
+
+// prefixEnd returns the smallest key greater than every key with the given
+// prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
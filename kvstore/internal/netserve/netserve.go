@@ -0,0 +1,124 @@
+// Package netserve keeps track of a TCP server's listeners and connections,
+// so that closing the server stops accepting, disconnects every client and
+// waits for their handlers to return.
+package netserve
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// Group is the listeners and connections of one server.
+type Group struct {
+	errClosed error
+
+	mu        sync.Mutex
+	closed    bool
+	done      chan struct{}
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// New returns a group whose Serve returns errClosed once it is closed.
+func New(errClosed error) *Group {
+	return &Group{
+		errClosed: errClosed,
+		done:      make(chan struct{}),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on ln until Close, which also closes ln, and
+// runs handle on each in its own goroutine. The connection is closed when
+// handle returns. Serve always returns a non-nil error, the group's closed
+// error after Close.
+func (g *Group) Serve(ln net.Listener, handle func(net.Conn)) error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		ln.Close()
+		return g.errClosed
+	}
+	g.listeners[ln] = struct{}{}
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.listeners, ln)
+		g.mu.Unlock()
+	}()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if g.isClosed() {
+				return g.errClosed
+			}
+			return err
+		}
+		if !g.addConn(c) {
+			c.Close()
+			return g.errClosed
+		}
+		go func() {
+			defer g.removeConn(c)
+			defer c.Close()
+			handle(c)
+		}()
+	}
+}
+
+// Done returns a channel that is closed by Close.
+func (g *Group) Done() <-chan struct{} {
+	return g.done
+}
+
+// Close stops every listener, disconnects every connection and waits for
+// their handlers to return. Closing a closed group does nothing.
+func (g *Group) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	close(g.done)
+	var errs []error
+	for ln := range g.listeners {
+		errs = append(errs, ln.Close())
+	}
+	for c := range g.conns {
+		c.Close()
+	}
+	g.mu.Unlock()
+	g.wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (g *Group) isClosed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closed
+}
+
+// addConn registers c for Close to disconnect, unless the group is already
+// closed.
+func (g *Group) addConn(c net.Conn) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.conns[c] = struct{}{}
+	g.wg.Add(1)
+	return true
+}
+
+func (g *Group) removeConn(c net.Conn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.conns, c)
+	g.wg.Done()
+}
@@ -0,0 +1,66 @@
+package netserve
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+var errClosed = errors.New("closed")
+
+func TestGroup(t *testing.T) {
+	g := New(errClosed)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	started, handled := make(chan struct{}), make(chan struct{})
+	go func() {
+		served <- g.Serve(ln, func(c net.Conn) {
+			defer close(handled)
+			close(started)
+			_, _ = io.Copy(io.Discard, c)
+		})
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-started
+
+	// Close disconnects the client, waits for its handler and stops Serve.
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handled:
+	default:
+		t.Error("Close returned before the handler")
+	}
+	if err := <-served; !errors.Is(err, errClosed) {
+		t.Errorf("Serve returned %v, want errClosed", err)
+	}
+	select {
+	case <-g.Done():
+	default:
+		t.Error("Done not closed after Close")
+	}
+
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Serve(ln, func(net.Conn) {}); !errors.Is(err, errClosed) {
+		t.Errorf("Serve after Close returned %v, want errClosed", err)
+	}
+	if _, err := ln.Accept(); err == nil {
+		t.Error("Serve after Close left the listener open")
+	}
+	if err := g.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+// Package kvhttp serves a kvstore.KVStore as a JSON REST API for dashboards
+// and other HTTP clients:
+//
+//	GET    /keys/{key}     the entry, with its ETag
+//	PUT    /keys/{key}     store {"value": "...", "ttl_ms": 1000}
+//	DELETE /keys/{key}     remove the key
+//	GET    /keys?prefix=p  the sorted keys starting with p
+//	GET    /stats          the store's statistics
+//
+// ETags are derived from the store's epoch and the revision of the change
+// that last wrote a key, so they change when the store is reopened or reset.
+// PUT and DELETE honour If-Match, and PUT honours If-None-Match: *, so a
+// client can update a key only if nobody has changed it since it was read.
+// GET honours If-None-Match with 304 Not Modified.
+//
+// The handler uses paths relative to where it is mounted; use
+// http.StripPrefix to serve it under a prefix of an existing mux.
+package kvhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aalpar/wile-extension-example/kvstore"
+)
+
+// maxBodySize bounds the request body of a PUT.
+const maxBodySize = 1 << 20
+
+// Handler is an http.Handler serving one store.
+type Handler struct {
+	store *kvstore.KVStore
+	mux   *http.ServeMux
+}
+
+// NewHandler returns a handler serving store.
+func NewHandler(store *kvstore.KVStore) *Handler {
+	h := &Handler{
+		store: store,
+		mux:   http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /keys/{key...}", h.getKey)
+	h.mux.HandleFunc("PUT /keys/{key...}", h.putKey)
+	h.mux.HandleFunc("DELETE /keys/{key...}", h.deleteKey)
+	h.mux.HandleFunc("GET /keys", h.listKeys)
+	h.mux.HandleFunc("GET /stats", h.stats)
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// entry is the JSON form of a key. TTLMillis is omitted for a key without
+// a TTL.
+type entry struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Revision  int64  `json:"revision"`
+	TTLMillis int64  `json:"ttl_ms,omitempty"`
+}
+
+// putRequest is the body of a PUT. A missing or zero TTLMillis stores the
+// key without a TTL.
+type putRequest struct {
+	Value     *string `json:"value"`
+	TTLMillis int64   `json:"ttl_ms"`
+}
+
+func (h *Handler) getKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	ent, found, err := h.store.Lookup(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !found {
+		writeJSON(w, http.StatusNotFound, errorBody(fmt.Sprintf("key %q not found", key)))
+		return
+	}
+	tag := etag(ent.Epoch, ent.Revision)
+	w.Header().Set("ETag", tag)
+	if etagMatches(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	e := entry{Key: key, Value: ent.Value, Revision: ent.Revision}
+	if !ent.Expires.IsZero() {
+		e.TTLMillis = max(time.Until(ent.Expires).Milliseconds(), 1)
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+func (h *Handler) putKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	var req putRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorBody("invalid body: "+err.Error()))
+		return
+	}
+	if req.Value == nil {
+		writeJSON(w, http.StatusBadRequest, errorBody(`invalid body: missing "value"`))
+		return
+	}
+	if req.TTLMillis < 0 || req.TTLMillis > math.MaxInt64/int64(time.Millisecond) {
+		writeJSON(w, http.StatusBadRequest, errorBody("invalid body: ttl_ms out of range"))
+		return
+	}
+	cond, ok := h.condition(r)
+	if !ok {
+		writePreconditionFailed(w, key)
+		return
+	}
+	ttl := time.Duration(req.TTLMillis) * time.Millisecond
+	rev, err := h.store.SetIf(key, *req.Value, ttl, cond)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag(h.store.Epoch(), rev))
+	writeJSON(w, http.StatusOK, entry{Key: key, Value: *req.Value, Revision: rev, TTLMillis: req.TTLMillis})
+}
+
+func (h *Handler) deleteKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	cond, ok := h.condition(r)
+	if !ok {
+		writePreconditionFailed(w, key)
+		return
+	}
+	found, err := h.store.DeleteIf(key, cond)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !found {
+		writeJSON(w, http.StatusNotFound, errorBody(fmt.Sprintf("key %q not found", key)))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) listKeys(w http.ResponseWriter, r *http.Request) {
+	keys := h.store.KeysWithPrefix(r.URL.Query().Get("prefix"))
+	if keys == nil {
+		keys = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"keys": keys})
+}
+
+func (h *Handler) stats(w http.ResponseWriter, _ *http.Request) {
+	st := h.store.Stats()
+	writeJSON(w, http.StatusOK, map[string]int64{
+		"hits":         st.Hits,
+		"misses":       st.Misses,
+		"sets":         st.Sets,
+		"deletes":      st.Deletes,
+		"expired":      st.Expired,
+		"clears":       st.Clears,
+		"evictions":    st.Evictions,
+		"bytes":        st.Bytes,
+		"lock_wait_ns": st.LockWait.Nanoseconds(),
+		"revision":     h.store.Revision(),
+	})
+}
+
+// etag returns the ETag of a key at rev in the store's epoch.
+func etag(epoch uint64, rev int64) string {
+	return `"` + strconv.FormatUint(epoch, 36) + "-" + strconv.FormatInt(rev, 10) + `"`
+}
+
+// condition returns the revision condition a write must meet from its
+// If-Match and If-None-Match headers. It reports false if If-Match lists no
+// ETag of the store's current epoch, which no key can match.
+func (h *Handler) condition(r *http.Request) (int64, bool) {
+	if inm := strings.TrimSpace(r.Header.Get("If-None-Match")); inm == "*" {
+		return kvstore.NoRevision, true
+	}
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		return kvstore.AnyRevision, true
+	}
+	for _, tag := range strings.Split(im, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			// Any current entry: require the revision it has now, so
+			// that a concurrent change still fails the write.
+			if ent, found, err := h.store.Lookup(r.PathValue("key")); err == nil && found {
+				return ent.Revision, true
+			}
+			return 0, false
+		}
+		prefix := `"` + strconv.FormatUint(h.store.Epoch(), 36) + "-"
+		if s, ok := strings.CutPrefix(tag, prefix); ok && strings.HasSuffix(s, `"`) {
+			if rev, err := strconv.ParseInt(strings.TrimSuffix(s, `"`), 10, 64); err == nil && rev >= 0 {
+				return rev, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// etagMatches reports whether an If-None-Match header lists tag, using the
+// weak comparison RFC 9110 specifies for it.
+func etagMatches(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func errorBody(msg string) errorResponse {
+	return errorResponse{Error: msg}
+}
+
+func writePreconditionFailed(w http.ResponseWriter, key string) {
+	writeJSON(w, http.StatusPreconditionFailed, errorBody(fmt.Sprintf("key %q does not match If-Match", key)))
+}
+
+// writeError maps a store error to a status code.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, kvstore.ErrRevisionMismatch):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, kvstore.ErrQuotaExceeded):
+		status = http.StatusInsufficientStorage
+	case errors.Is(err, kvstore.ErrInvalidTTL):
+		status = http.StatusBadRequest
+	case errors.Is(err, kvstore.ErrReadOnlyReplica):
+		status = http.StatusForbidden
+	}
+	writeJSON(w, status, errorBody(err.Error()))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
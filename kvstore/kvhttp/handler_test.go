@@ -0,0 +1,142 @@
+package kvhttp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aalpar/wile-extension-example/kvstore"
+)
+
+func newServer(t *testing.T) (*kvstore.KVStore, *httptest.Server) {
+	t.Helper()
+	store := kvstore.New()
+	mux := http.NewServeMux()
+	mux.Handle("/kv/", http.StripPrefix("/kv", NewHandler(store)))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.Close()
+		store.Close()
+	})
+	return store, srv
+}
+
+// do sends a request with the given header name/value pairs.
+func do(t *testing.T, method, url, body string, header ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func TestKeys(t *testing.T) {
+	store, srv := newServer(t)
+	base := srv.URL + "/kv"
+
+	resp := do(t, "PUT", base+"/keys/user/1", `{"value": "alice"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT: %s", resp.Status)
+	}
+	etag := resp.Header.Get("ETag")
+	if v, _, _ := store.Get("user/1"); v != "alice" {
+		t.Fatalf("store has %q after PUT", v)
+	}
+
+	resp = do(t, "GET", base+"/keys/user/1", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != etag {
+		t.Fatalf("GET: %s, ETag %q, want %q", resp.Status, resp.Header.Get("ETag"), etag)
+	}
+	if resp = do(t, "GET", base+"/keys/user/1", "", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional GET: %s", resp.Status)
+	}
+
+	// A write with a stale ETag fails; one with the current ETag succeeds.
+	if err := store.Set("user/1", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if resp = do(t, "PUT", base+"/keys/user/1", `{"value": "bob"}`, "If-Match", etag); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PUT with stale ETag: %s", resp.Status)
+	}
+	resp = do(t, "GET", base+"/keys/user/1", "")
+	etag = resp.Header.Get("ETag")
+	if resp = do(t, "PUT", base+"/keys/user/1", `{"value": "bob"}`, "If-Match", etag); resp.StatusCode != http.StatusOK {
+		t.Errorf("PUT with current ETag: %s", resp.Status)
+	}
+	if resp = do(t, "PUT", base+"/keys/user/1", `{"value": "eve"}`, "If-None-Match", "*"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("create-only PUT of an existing key: %s", resp.Status)
+	}
+
+	do(t, "PUT", base+"/keys/user/2", `{"value": "carol", "ttl_ms": 60000}`)
+	do(t, "PUT", base+"/keys/group/1", `{"value": "admins"}`)
+
+	var list struct{ Keys []string }
+	getJSON(t, base+"/keys?prefix=user/", &list)
+	if want := []string{"user/1", "user/2"}; !reflect.DeepEqual(list.Keys, want) {
+		t.Errorf("keys = %v, want %v", list.Keys, want)
+	}
+
+	if resp = do(t, "DELETE", base+"/keys/user/2", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE: %s", resp.Status)
+	}
+	if resp = do(t, "GET", base+"/keys/user/2", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after DELETE: %s", resp.Status)
+	}
+	if resp = do(t, "PUT", base+"/keys/bad", `{"val": 1}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PUT with a bad body: %s", resp.Status)
+	}
+
+	var stats map[string]int64
+	getJSON(t, base+"/stats", &stats)
+	if stats["deletes"] != 1 || stats["sets"] == 0 {
+		t.Errorf("stats = %v", stats)
+	}
+}
+
+func TestETagsAcrossReset(t *testing.T) {
+	store, srv := newServer(t)
+	base := srv.URL + "/kv"
+	old := do(t, "PUT", base+"/keys/k", `{"value": "a"}`).Header.Get("ETag")
+
+	// Revisions restart after a reset, so the same write gets the same
+	// revision; its ETag must still differ.
+	if err := store.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	resp := do(t, "PUT", base+"/keys/k", `{"value": "b"}`)
+	if tag := resp.Header.Get("ETag"); resp.StatusCode != http.StatusOK || tag == old {
+		t.Fatalf("PUT after reset: %s, ETag %q, want one other than %q", resp.Status, tag, old)
+	}
+	if resp = do(t, "PUT", base+"/keys/k", `{"value": "c"}`, "If-Match", old); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PUT with an ETag from before the reset: %s", resp.Status)
+	}
+	if v, _, _ := store.Get("k"); v != "b" {
+		t.Errorf("store has %q, want %q", v, "b")
+	}
+}
+
+func getJSON(t *testing.T, url string, v any) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
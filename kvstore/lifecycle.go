@@ -0,0 +1,132 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aalpar/wile/values"
+)
+
+// ErrStoreClosed is returned by operations on a store that is closing or
+// closed.
+var ErrStoreClosed = values.NewStaticError("store closed")
+
+// A store is open until Close, closing while Close waits for the operations
+// in progress, and closed once they have finished and the backend is closed.
+// Operations check the state after acquiring kv.mu, so none can start once
+// Close holds it for writing.
+const (
+	stateOpen int32 = iota
+	stateClosing
+	stateClosed
+)
+
+// opened returns ErrStoreClosed unless the store is open.
+func (kv *KVStore) opened() error {
+	if kv.state.Load() != stateOpen {
+		return ErrStoreClosed
+	}
+	return nil
+}
+
+// close closes the store if it is open.
+func (kv *KVStore) close() error {
+	kv.lifeMu.Lock()
+	defer kv.lifeMu.Unlock()
+	if kv.state.Load() != stateOpen {
+		return nil
+	}
+	return kv.shutdown()
+}
+
+// shutdown closes the named stores and then the store itself, after the
+// operations holding kv.mu have finished. Callers hold kv.lifeMu.
+func (kv *KVStore) shutdown() error {
+	kv.state.Store(stateClosing)
+	storesErr := kv.closeStores()
+	kv.stopJanitor()
+	kv.changes.close()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	count := kv.backend.Len()
+	err := errors.Join(storesErr, kv.backend.Close())
+	kv.state.Store(stateClosed)
+	if err != nil {
+		kv.logger.Error("close store", "entries", count, "err", err)
+	} else {
+		kv.logger.Info("store closed", "entries", count)
+	}
+	return err
+}
+
+// Reopen makes a closed store usable again, as New or Open left it: a store
+// from New starts out empty and one from Open recovers its log. The store
+// keeps its options and the watchers registered with Watch, so engines and
+// Go code holding it carry on; the watches registered with kv-watch by
+// engines that loaded the store were removed by Close. Snapshots taken before read as released, and
+// named stores opened with kv-open, statistics and history are gone.
+//
+// Reopen fails if the store is not closed, or if its backend was given with
+// WithBackend and so cannot be opened again.
+func (kv *KVStore) Reopen() error {
+	kv.lifeMu.Lock()
+	defer kv.lifeMu.Unlock()
+	return kv.restart(false)
+}
+
+// Reset discards the store's contents and reopens it, closing it first if it
+// is open, so that tests can share one store. The log of a store from Open
+// is emptied too.
+func (kv *KVStore) Reset() error {
+	kv.lifeMu.Lock()
+	defer kv.lifeMu.Unlock()
+	if kv.state.Load() == stateOpen {
+		if err := kv.shutdown(); err != nil {
+			return err
+		}
+	}
+	return kv.restart(true)
+}
+
+// restart opens a new backend for a closed store, emptied if empty is set,
+// and puts the store back in its initial state. Callers hold kv.lifeMu.
+func (kv *KVStore) restart(empty bool) error {
+	if kv.state.Load() != stateClosed {
+		return errors.New("kvstore: reopen: store is not closed")
+	}
+	if kv.openBackend == nil {
+		return errors.New("kvstore: reopen: store was created WithBackend")
+	}
+	b, err := kv.openBackend()
+	if err != nil {
+		return fmt.Errorf("kvstore: reopen: %w", err)
+	}
+	if empty {
+		if err := b.Clear(); err != nil {
+			return errors.Join(fmt.Errorf("kvstore: reset: %w", err), b.Close())
+		}
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.backend = concurrentBackend(b)
+	for i := range kv.segments {
+		seg := &kv.segments[i]
+		clear(seg.expires)
+		clear(seg.usage)
+		clear(seg.revs)
+	}
+	kv.index, kv.indexErr = nil, nil
+	kv.indexOnce = sync.Once{}
+	kv.changes.reset()
+	kv.snaps.reset()
+	kv.versions = nil
+	kv.stats.reset()
+	kv.history = history{perKey: kv.history.perKey, total: kv.history.total}
+	kv.tick.Store(0)
+	kv.state.Store(stateOpen)
+	kv.logger.Info("store reopened", "entries", kv.backend.Len(), "reset", empty)
+	return nil
+}
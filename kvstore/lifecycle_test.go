@@ -0,0 +1,120 @@
+package kvstore
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClose(t *testing.T) {
+	store := New()
+	engine := newEngine(t, store)
+	eval(t, engine, `(kv-set! "a" 1)`)
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	if err := store.Set("a", "v"); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("Set on a closed store = %v, want ErrStoreClosed", err)
+	}
+	if _, _, err := store.Get("a"); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("Get on a closed store = %v, want ErrStoreClosed", err)
+	}
+	checkRaises(t, engine, `(kv-get "a" #f)`, "store-closed")
+	checkRaises(t, engine, `(kv-set! "a" 2)`, "store-closed")
+}
+
+func TestCloseWaits(t *testing.T) {
+	store := New()
+	store.mu.RLock()
+	closed := make(chan error, 1)
+	go func() { closed <- store.Close() }()
+
+	// Close cannot finish while an operation holds the store.
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned %v during an operation", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := store.opened(); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("a closing store reports %v, want ErrStoreClosed", err)
+	}
+	store.mu.RUnlock()
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	store := New()
+	engine := newEngine(t, store)
+	eval(t, engine, `(kv-set! "a" 1)`)
+	if err := store.Reopen(); err == nil {
+		t.Error("Reopen of an open store succeeded")
+	}
+
+	// A store from New comes back empty, and the engine carries on using it.
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	check(t, engine, `(not (kv-get "a" #f))`)
+	eval(t, engine, `(kv-set! "b" 2)`)
+	check(t, engine, `(= (kv-get "b") 2)`)
+
+	// Reset empties an open store.
+	if err := store.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	check(t, engine, `(null? (kv-keys))`)
+
+	// A backend given with WithBackend cannot be opened again.
+	store = New(WithBackend(NewMemoryBackend()))
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reopen(); err == nil {
+		t.Error("Reopen of a store created WithBackend succeeded")
+	}
+}
+
+func TestReopenLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.close() })
+	if err := store.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A store from Open recovers its log when reopened, and Reset empties it.
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := store.Get("a"); err != nil || !ok || v != "1" {
+		t.Errorf("Get(a) after Reopen = %q, %v, %v", v, ok, err)
+	}
+	if err := store.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if n := store.Len(); n != 0 {
+		t.Errorf("Len() after Reset = %d", n)
+	}
+}
@@ -0,0 +1,197 @@
+package kvstore
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// SyncPolicy controls when a durable store fsyncs its write-ahead log.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every mutation. A mutation that returns has
+	// reached stable storage.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs from a background goroutine at the configured
+	// interval. A crash may lose mutations made since the last sync.
+	SyncInterval
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+const (
+	defaultSyncInterval        = time.Second
+	defaultCompactionInterval  = 30 * time.Second
+	defaultCompactionThreshold = 4 << 20
+	defaultJanitorInterval     = time.Second
+	defaultChangeLogSize       = 1024
+	defaultName                = "kvstore"
+	defaultPrefix              = "kv-"
+)
+
+// Option configures a KVStore.
+type Option func(*options)
+
+type options struct {
+	logger              *slog.Logger
+	name                string
+	prefix              string
+	category            string
+	backend             Backend
+	clock               func() time.Time
+	janitorInterval     time.Duration
+	changeLogSize       int
+	limits              limits
+	historyPerKey       int
+	historyTotal        int
+	shards              int
+	syncPolicy          SyncPolicy
+	syncInterval        time.Duration
+	compactionInterval  time.Duration
+	compactionThreshold int64
+}
+
+func defaultOptions() options {
+	return options{
+		logger:              slog.New(discardHandler{}),
+		name:                defaultName,
+		prefix:              defaultPrefix,
+		category:            defaultName,
+		clock:               time.Now,
+		janitorInterval:     defaultJanitorInterval,
+		changeLogSize:       defaultChangeLogSize,
+		shards:              defaultShards,
+		syncPolicy:          SyncAlways,
+		syncInterval:        defaultSyncInterval,
+		compactionInterval:  defaultCompactionInterval,
+		compactionThreshold: defaultCompactionThreshold,
+	}
+}
+
+// WithLogger sets the logger the store reports closing, evictions and
+// failures to as structured events. By default, or if l is nil, nothing is
+// logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		if l == nil {
+			l = slog.New(discardHandler{})
+		}
+		o.logger = l
+	}
+}
+
+// WithName sets the extension name returned by Name. The default is
+// "kvstore".
+func WithName(name string) Option {
+	return func(o *options) { o.name = name }
+}
+
+// WithPrimitivePrefix sets the prefix of every primitive's name in place of
+// "kv-", so that more than one store can be loaded into an engine. With
+// "cache-" the store registers cache-get, cache-store-get, cache-open,
+// cache-error? and so on.
+func WithPrimitivePrefix(prefix string) Option {
+	return func(o *options) { o.prefix = prefix }
+}
+
+// WithCategory sets the category the primitives are registered under. The
+// default is "kvstore".
+func WithCategory(category string) Option {
+	return func(o *options) { o.category = category }
+}
+
+// WithBackend sets the storage backend. The default is a MemoryBackend. The
+// store takes ownership of b and closes it on Close.
+func WithBackend(b Backend) Option {
+	return func(o *options) { o.backend = b }
+}
+
+// WithClock sets the function used to read the current time when setting and
+// checking TTLs. The default is time.Now; tests can inject a fake clock.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) { o.clock = now }
+}
+
+// WithJanitorInterval sets how often expired keys are evicted in the
+// background. Expired keys are invisible to reads whether or not the janitor
+// has run yet.
+func WithJanitorInterval(d time.Duration) Option {
+	return func(o *options) { o.janitorInterval = d }
+}
+
+// WithChangeLogSize sets how many recent changes the change feed keeps for
+// kv-changes-since and Changes. The default is 1024.
+func WithChangeLogSize(n int) Option {
+	return func(o *options) { o.changeLogSize = n }
+}
+
+// WithMaxEntries limits the store to n keys. Zero, the default, means no
+// limit. What happens at the limit depends on WithEvictionPolicy.
+func WithMaxEntries(n int) Option {
+	return func(o *options) { o.limits.maxEntries = n }
+}
+
+// WithMaxBytes limits the total size of the store's keys and encoded values
+// to n bytes. Zero, the default, means no limit.
+func WithMaxBytes(n int64) Option {
+	return func(o *options) { o.limits.maxBytes = n }
+}
+
+// WithEvictionPolicy sets how the store stays within WithMaxEntries and
+// WithMaxBytes. The default, EvictReject, fails writes that do not fit with
+// ErrQuotaExceeded.
+func WithEvictionPolicy(p EvictionPolicy) Option {
+	return func(o *options) { o.limits.policy = p }
+}
+
+// WithHistory keeps the last perKey versions of each key, with the time each
+// was made, for kv-history, kv-get-at and kv-revert!. At most total versions
+// are kept across all keys, dropping the oldest first; zero means no overall
+// bound. History is off by default and is held in memory only.
+func WithHistory(perKey, total int) Option {
+	return func(o *options) {
+		o.historyPerKey = perKey
+		o.historyTotal = total
+	}
+}
+
+// WithShards sets how many segments the store's keys are spread across.
+// Operations on keys in different segments do not wait for each other; one
+// segment makes every operation take the same lock. The default is 64.
+func WithShards(n int) Option {
+	return func(o *options) { o.shards = n }
+}
+
+// WithSyncPolicy sets when the write-ahead log is fsynced. The default is
+// SyncAlways.
+func WithSyncPolicy(p SyncPolicy) Option {
+	return func(o *options) { o.syncPolicy = p }
+}
+
+// WithSyncInterval sets how often the log is fsynced under SyncInterval.
+func WithSyncInterval(d time.Duration) Option {
+	return func(o *options) { o.syncInterval = d }
+}
+
+// WithCompactionInterval sets how often the background compactor checks
+// whether the log should be rewritten.
+func WithCompactionInterval(d time.Duration) Option {
+	return func(o *options) { o.compactionInterval = d }
+}
+
+// WithCompactionThreshold sets the minimum log size in bytes before the log
+// is considered for compaction. The log is only rewritten once it also holds
+// more than twice as many records as there are live keys.
+func WithCompactionThreshold(n int64) Option {
+	return func(o *options) { o.compactionThreshold = n }
+}
+
+// discardHandler is the handler of the default logger. It drops every record
+// without formatting it.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
@@ -0,0 +1,53 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aalpar/wile"
+)
+
+func TestPrimitivePrefix(t *testing.T) {
+	cache := New(WithName("cache"), WithPrimitivePrefix("cache-"))
+	if got := cache.Name(); got != "cache" {
+		t.Errorf("Name() = %q, want cache", got)
+	}
+	if got := New().Name(); got != "kvstore" {
+		t.Errorf("default Name() = %q, want kvstore", got)
+	}
+
+	// Two stores load side by side, each under its own prefix.
+	engine, err := wile.NewEngine(context.Background(), wile.WithExtension(New()), wile.WithExtension(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	eval(t, engine, `(kv-set! "k" "store") (cache-set! "k" "cache")`)
+	check(t, engine,
+		`(equal? (kv-get "k") "store")`,
+		`(equal? (cache-get "k") "cache")`,
+		`(eq? (guard (e ((cache-error? e) (cache-error-kind e))) (cache-get "missing")) 'key-not-found)`)
+	if v, _, err := cache.Get("k"); err != nil || !strings.Contains(v, "cache") {
+		t.Errorf("cache.Get(k) = %q, %v", v, err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	store := New(WithLogger(slog.New(slog.NewTextHandler(&buf, nil))))
+	if err := store.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{`msg="store closed"`, "extension=kvstore", "entries=1"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("logged %q, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aalpar/wile/machine"
+	"github.com/aalpar/wile/registry"
+	"github.com/aalpar/wile/values"
+)
+
+// ErrPermissionDenied is returned when an engine's Policy does not allow an
+// operation, or access to a key.
+var ErrPermissionDenied = values.NewStaticError("permission denied")
+
+// Policy limits what the primitives registered for one engine may do, so
+// that untrusted scripts can share a store with trusted code. The zero
+// Policy allows everything. Policies apply to Scheme only; the Go API is
+// unrestricted.
+type Policy struct {
+	// ReadOnly denies every operation that changes a store.
+	ReadOnly bool
+
+	// ReadPrefixes and WritePrefixes, if not nil, limit the keys that may
+	// be read or written to those starting with one of them. Keys that
+	// may not be read are left out of kv-keys, kv-range, kv-count, the
+	// change feed and watch events. Operations that read a key before
+	// writing it, such as kv-cas!, need both. Limiting writes also denies
+	// kv-clear!, which would remove keys outside the prefixes.
+	ReadPrefixes  []string
+	WritePrefixes []string
+
+	// DenyOps lists primitives that may not be called, by the names they
+	// are registered under, such as "kv-clear!". Denying a kv- primitive
+	// also denies its kv-store- twin.
+	DenyOps []string
+}
+
+// Restrict returns an extension that registers the store's primitives
+// limited by p. Load it into an engine in place of the store to give that
+// engine's scripts restricted access; engines loading the store itself are
+// unaffected. The extension does not close the store when the engine is
+// closed, but removes the watches the engine registered with kv-watch, so
+// give each engine its own. AddToRegistry fails if p.DenyOps names an unknown primitive.
+func (kv *KVStore) Restrict(p Policy) registry.Extension {
+	p.ReadPrefixes = slices.Clone(p.ReadPrefixes)
+	p.WritePrefixes = slices.Clone(p.WritePrefixes)
+	p.DenyOps = slices.Clone(p.DenyOps)
+	return &restricted{kv: kv, policy: &p}
+}
+
+// restricted is the extension returned by Restrict.
+type restricted struct {
+	kv     *KVStore
+	policy *Policy
+
+	mu       sync.Mutex
+	bindings []*binding
+}
+
+// Name returns the extension name.
+func (r *restricted) Name() string {
+	return r.kv.Name()
+}
+
+// AddToRegistry registers the store's primitives, bound to the policy.
+func (r *restricted) AddToRegistry(reg *registry.Registry) error {
+	prefix := r.kv.prefix
+	mutates := make(map[string]bool)
+	for _, p := range primitives() {
+		mutates[prefix+p.name] = p.mutates
+	}
+	b := newBinding(r.kv, r.policy)
+	r.mu.Lock()
+	r.bindings = append(r.bindings, b)
+	r.mu.Unlock()
+	specs := r.kv.primitiveSpecs(b)
+	names := make(map[string]bool, len(specs))
+	for _, s := range specs {
+		names[s.Name] = true
+	}
+	for _, op := range r.policy.DenyOps {
+		if !names[op] {
+			return fmt.Errorf("kvstore: policy denies unknown primitive %q", op)
+		}
+	}
+	for i, s := range specs {
+		op := opName(prefix, s.Name)
+		specs[i].Impl = r.policy.restrict(s.Name, op, s.Impl, mutates[op])
+	}
+	reg.AddPrimitives(specs, registry.PhaseRuntime)
+	return nil
+}
+
+// Close removes the watches registered with kv-watch by the engines the
+// extension was loaded into. It does not close the store. Implements
+// registry.Closeable.
+func (r *restricted) Close() error {
+	r.mu.Lock()
+	bindings := r.bindings
+	r.bindings = nil
+	r.mu.Unlock()
+	for _, b := range bindings {
+		b.release()
+	}
+	return nil
+}
+
+// opName returns the name of the primitive a kv-store- primitive is a
+// variant of, or its own name, given the prefix in place of kv-.
+func opName(prefix, name string) string {
+	if rest, ok := strings.CutPrefix(name, prefix+"store-"); ok {
+		return prefix + rest
+	}
+	return name
+}
+
+// restrict returns impl, registered as name, or a primitive that fails if p
+// denies it. op is the primitive name is a variant of. The primitives that
+// p allows find p in their context, placed there by the engine's binding,
+// and check keys against it.
+func (p *Policy) restrict(name, op string, impl machine.ForeignFunction, mutates bool) machine.ForeignFunction {
+	if p.ReadOnly && mutates || slices.Contains(p.DenyOps, op) || slices.Contains(p.DenyOps, name) {
+		return func(context.Context, *machine.MachineContext) error {
+			return values.WrapForeignErrorf(ErrPermissionDenied, "%s: not permitted for this engine", name)
+		}
+	}
+	return impl
+}
+
+// policyKey is the context key under which a primitive passes its engine's
+// policy to the store. Every primitive sets it, to nil if the engine is
+// unrestricted, so a policy never outlives the call it was set for.
+type policyKey struct{}
+
+// policyFrom returns the policy carried by ctx, or nil if the operation is
+// unrestricted. Policy methods treat nil as allowing everything.
+func policyFrom(ctx context.Context) *Policy {
+	p, _ := ctx.Value(policyKey{}).(*Policy)
+	return p
+}
+
+func (p *Policy) canRead(key string) bool {
+	return p == nil || p.ReadPrefixes == nil || hasPrefix(key, p.ReadPrefixes)
+}
+
+func (p *Policy) canWrite(key string) bool {
+	return p == nil || !p.ReadOnly && (p.WritePrefixes == nil || hasPrefix(key, p.WritePrefixes))
+}
+
+// canClear reports whether every key may be removed at once.
+func (p *Policy) canClear() bool {
+	return p == nil || !p.ReadOnly && p.WritePrefixes == nil
+}
+
+func (p *Policy) checkRead(key string) error {
+	if !p.canRead(key) {
+		return keyError(key, fmt.Errorf("%w: key %q may not be read", ErrPermissionDenied, key))
+	}
+	return nil
+}
+
+func (p *Policy) checkWrite(key string) error {
+	if !p.canWrite(key) {
+		return keyError(key, fmt.Errorf("%w: key %q may not be written", ErrPermissionDenied, key))
+	}
+	return nil
+}
+
+// readable returns the keys p allows reading.
+func (p *Policy) readable(keys []string) []string {
+	if p == nil || p.ReadPrefixes == nil {
+		return keys
+	}
+	return slices.DeleteFunc(keys, func(k string) bool { return !p.canRead(k) })
+}
+
+func hasPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// guard returns v limited by the policy in ctx, or v itself if there is
+// none.
+func guard(ctx context.Context, v view) view {
+	if p := policyFrom(ctx); p != nil {
+		return guardedView{view: v, p: p}
+	}
+	return v
+}
+
+// guardedView is a view that checks each key against a policy. Keys that
+// may not be read are hidden from listings rather than reported.
+type guardedView struct {
+	view
+	p *Policy
+}
+
+func (g guardedView) get(key string) (string, bool, error) {
+	if err := g.p.checkRead(key); err != nil {
+		return "", false, err
+	}
+	return g.view.get(key)
+}
+
+func (g guardedView) set(key, value string, ttl time.Duration) error {
+	if err := g.p.checkWrite(key); err != nil {
+		return err
+	}
+	return g.view.set(key, value, ttl)
+}
+
+func (g guardedView) setUntil(key, value string, deadline time.Time) error {
+	if err := g.p.checkWrite(key); err != nil {
+		return err
+	}
+	return g.view.setUntil(key, value, deadline)
+}
+
+func (g guardedView) delete(key string) error {
+	if err := g.p.checkWrite(key); err != nil {
+		return err
+	}
+	return g.view.delete(key)
+}
+
+func (g guardedView) clear() error {
+	if !g.p.canClear() {
+		return fmt.Errorf("%w: clearing the store", ErrPermissionDenied)
+	}
+	return g.view.clear()
+}
+
+func (g guardedView) keys() ([]string, error) {
+	keys, err := g.view.keys()
+	return g.p.readable(keys), err
+}
+
+func (g guardedView) scan(start, end string, reverse bool, limit int) ([]string, error) {
+	if g.p.ReadPrefixes == nil {
+		return g.view.scan(start, end, reverse, limit)
+	}
+	keys, err := g.view.scan(start, end, reverse, 0)
+	keys = g.p.readable(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, err
+}
+
+func (g guardedView) count() (int, error) {
+	if g.p.ReadPrefixes == nil {
+		return g.view.count()
+	}
+	keys, err := g.keys()
+	return len(keys), err
+}
@@ -0,0 +1,130 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aalpar/wile"
+)
+
+// restrictedEngines returns an engine with store loaded and one restricted
+// by p, sharing the store.
+func restrictedEngines(t *testing.T, store *KVStore, p Policy) (host, guest *wile.Engine) {
+	t.Helper()
+	return newEngine(t, store), newEngine(t, store.Restrict(p))
+}
+
+func TestPolicyReadOnly(t *testing.T) {
+	host, guest := restrictedEngines(t, New(), Policy{ReadOnly: true})
+	eval(t, host, `(kv-set! "a" 1) (define h (kv-open "named")) (kv-store-set! h "b" 2)`)
+
+	check(t, guest,
+		`(= (kv-get "a") 1)`,
+		`(equal? (kv-keys) '("a"))`,
+		`(= (kv-store-get (kv-open "named") "b") 2)`)
+	for _, code := range []string{
+		`(kv-set! "a" 2)`,
+		`(kv-delete! "a")`,
+		`(kv-clear!)`,
+		`(kv-incr! "a")`,
+		`(kv-cas! "a" 1 2)`,
+		`(kv-update! "a" (lambda (v) v))`,
+		`(kv-set-many! '(("x" . 1)))`,
+		`(kv-store-set! (kv-open "named") "b" 3)`,
+		`(kv-transaction (lambda () (kv-set! "a" 2)))`,
+	} {
+		checkRaises(t, guest, code, "permission-denied")
+	}
+	check(t, host, `(= (kv-get "a") 1)`, `(= (kv-store-get h "b") 2)`)
+}
+
+func TestPolicyPrefixes(t *testing.T) {
+	store := New()
+	host, guest := restrictedEngines(t, store, Policy{
+		ReadPrefixes:  []string{"pub/", "own/"},
+		WritePrefixes: []string{"own/"},
+	})
+	eval(t, host, `(kv-set! "pub/a" 1) (kv-set! "secret" 2) (kv-set! "own/b" 3)`)
+
+	// Unreadable keys are denied by name and hidden from listings.
+	check(t, guest,
+		`(= (kv-get "pub/a") 1)`,
+		`(equal? (kv-keys) '("own/b" "pub/a"))`,
+		`(= (kv-count) 2)`,
+		`(equal? (map car (kv-range "" "")) '("own/b" "pub/a"))`,
+		`(equal? (kv-keys-with-prefix "s") '())`)
+	checkRaises(t, guest, `(kv-get "secret")`, "permission-denied")
+
+	// Writes need a writable prefix, and reading writes need both.
+	eval(t, guest, `(kv-set! "own/c" 4)`)
+	checkRaises(t, guest, `(kv-set! "pub/a" 5)`, "permission-denied")
+	checkRaises(t, guest, `(kv-cas! "secret" 2 5)`, "permission-denied")
+	checkRaises(t, guest, `(kv-delete-many! '("own/b" "pub/a"))`, "permission-denied")
+	checkRaises(t, guest, `(kv-clear!)`, "permission-denied")
+	checkRaises(t, guest, `(kv-store-set! (kv-open "other") "x" 1)`, "permission-denied")
+	check(t, host,
+		`(equal? (kv-keys) '("own/b" "own/c" "pub/a" "secret"))`,
+		`(= (kv-get "pub/a") 1)`)
+
+	// The change feed leaves out changes to unreadable keys, but keeps
+	// clears.
+	eval(t, host, `(kv-delete! "secret") (kv-clear!) (kv-set! "secret" 6)`)
+	check(t, guest, `(equal? (map (lambda (r) (list (car r) (cadr r))) (kv-changes-since 0))
+	                         '((set "pub/a") (set "own/b") (set "own/c") (clear #f)))`)
+}
+
+func TestPolicyWatchEvents(t *testing.T) {
+	store := New()
+	host, guest := restrictedEngines(t, store, Policy{ReadPrefixes: []string{"pub/"}})
+	eval(t, guest, recordEvents(""))
+	eval(t, host, recordEvents(""))
+
+	eval(t, host, `(kv-set! "pub/a" 1) (kv-set! "secret" 2)`)
+	if err := store.Set("secret", "3"); err != nil {
+		t.Fatal(err)
+	}
+	check(t, guest,
+		`(= (kv-poll-watches) 1)`,
+		`(equal? (events-seen) '((set "pub/a" #f 1)))`)
+
+	// The guest's writes run the host's callbacks on the host, under no
+	// policy, so they may read what the guest cannot.
+	eval(t, host, `(kv-watch "pub/" (lambda (event key old new) (kv-set! "seen" (kv-get "secret"))))`)
+	eval(t, guest, `(kv-set! "pub/b" 4)`)
+	check(t, host, `(equal? (kv-get "seen") "3")`)
+	checkRaises(t, guest, `(kv-get "seen")`, "permission-denied")
+}
+
+func TestPolicyDenyOps(t *testing.T) {
+	host, guest := restrictedEngines(t, New(), Policy{DenyOps: []string{"kv-clear!", "kv-store-keys"}})
+	eval(t, host, `(kv-set! "a" 1)`)
+
+	// Denying a primitive denies its kv-store- twin; denying a twin leaves
+	// the primitive alone.
+	checkRaises(t, guest, `(kv-clear!)`, "permission-denied")
+	checkRaises(t, guest, `(kv-store-clear! (kv-open "n"))`, "permission-denied")
+	checkRaises(t, guest, `(kv-store-keys (kv-open "n"))`, "permission-denied")
+	check(t, guest, `(equal? (kv-keys) '("a"))`)
+	eval(t, host, `(kv-clear!)`)
+	check(t, host, `(null? (kv-keys))`)
+
+	_, err := wile.NewEngine(context.Background(),
+		wile.WithExtension(New().Restrict(Policy{DenyOps: []string{"kv-nonsense"}})))
+	if err == nil {
+		t.Error("a policy denying an unknown primitive was accepted")
+	}
+}
+
+func TestPolicyNotInherited(t *testing.T) {
+	// An unrestricted engine's primitives ignore a policy left in the
+	// context they are called with.
+	p := &Policy{ReadOnly: true}
+	ctx := context.WithValue(context.Background(), policyKey{}, p)
+	if got := policyFrom(newBinding(New(), nil).context(ctx, nil)); got != nil {
+		t.Errorf("unrestricted binding kept policy %+v", got)
+	}
+	q := &Policy{}
+	if got := policyFrom(newBinding(New(), q).context(ctx, nil)); got != q {
+		t.Errorf("restricted binding has policy %+v, want its own", got)
+	}
+}
@@ -2,186 +2,1479 @@ package kvstore
 
 import (
 	"context"
-	"sort"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/aalpar/wile/machine"
 	"github.com/aalpar/wile/registry"
 	"github.com/aalpar/wile/values"
 )
 
-// primitiveSpecs returns the PrimitiveSpec slice for all kvstore operations.
-// Each spec's Impl is a method on *KVStore, capturing state via the receiver.
-func (kv *KVStore) primitiveSpecs() []registry.PrimitiveSpec {
-	return []registry.PrimitiveSpec{
+// primitive describes one kvstore operation. Each is registered twice: as
+// kv-<name>, which operates on the store itself, and as kv-store-<name>,
+// which takes a store handle from kv-open as an extra first argument. The
+// kv- prefix can be changed with WithPrimitivePrefix.
+type primitive struct {
+	name     string
+	params   []string
+	variadic bool
+	mutates  bool // changes the store; denied by a read-only Policy
+	impl     func(*KVStore, context.Context, call) error
+	doc      string
+}
+
+// primitives lists every operation available on a store.
+func primitives() []primitive {
+	return []primitive{
 		{
-			Name:       "kv-set!",
-			ParamCount: 2,
-			Impl:       kv.primSet,
-			Doc:        "Set a key-value pair (both strings).",
-			ParamNames: []string{"key", "value"},
-			Category:   "kvstore",
+			name:     "set!",
+			mutates:  true,
+			params:   []string{"key", "value", "ttl-ms"},
+			variadic: true,
+			impl:     (*KVStore).primSet,
+			doc:      "Set a string key to any serializable value. Optional TTL in milliseconds.",
 		},
 		{
-			Name:       "kv-get",
-			ParamCount: 2,
-			IsVariadic: true,
-			Impl:       kv.primGet,
-			Doc:        "Get value by key. Optional default if key missing.",
-			ParamNames: []string{"key", "default"},
-			Category:   "kvstore",
+			name:     "get",
+			params:   []string{"key", "default"},
+			variadic: true,
+			impl:     (*KVStore).primGet,
+			doc:      "Get value by key. Optional default if key missing.",
 		},
 		{
-			Name:       "kv-delete!",
-			ParamCount: 1,
-			Impl:       kv.primDelete,
-			Doc:        "Delete a key.",
-			ParamNames: []string{"key"},
-			Category:   "kvstore",
+			name:   "ttl",
+			params: []string{"key"},
+			impl:   (*KVStore).primTTL,
+			doc:    "Return a key's remaining time to live in milliseconds, or -1 if it never expires.",
+		},
+		{
+			name:    "delete!",
+			mutates: true,
+			params:  []string{"key"},
+			impl:    (*KVStore).primDelete,
+			doc:     "Delete a key.",
+		},
+		{
+			name:     "set-many!",
+			mutates:  true,
+			params:   []string{"entries", "ttl-ms"},
+			variadic: true,
+			impl:     (*KVStore).primSetMany,
+			doc:      "Set every key in a hashtable or alist of (key . value) pairs atomically. Optional TTL in milliseconds.",
+		},
+		{
+			name:     "get-many",
+			params:   []string{"keys", "default"},
+			variadic: true,
+			impl:     (*KVStore).primGetMany,
+			doc:      "Return a hashtable of the values of a list of keys. Missing keys are omitted, or mapped to default if given.",
+		},
+		{
+			name:    "delete-many!",
+			mutates: true,
+			params:  []string{"keys"},
+			impl:    (*KVStore).primDeleteMany,
+			doc:     "Delete a list of keys atomically. Returns the number of keys that were present.",
+		},
+		{
+			name: "keys",
+			impl: (*KVStore).primKeys,
+			doc:  "Return a sorted list of all keys.",
+		},
+		{
+			name:   "keys-with-prefix",
+			params: []string{"prefix"},
+			impl:   (*KVStore).primKeysWithPrefix,
+			doc:    "Return a sorted list of the keys that start with prefix.",
+		},
+		{
+			name:     "range",
+			params:   []string{"start", "end", "limit"},
+			variadic: true,
+			impl:     (*KVStore).primRange,
+			doc:      "Return (key . value) pairs with start <= key < end in ascending order. Empty end is unbounded.",
+		},
+		{
+			name:     "range-reverse",
+			params:   []string{"start", "end", "limit"},
+			variadic: true,
+			impl:     (*KVStore).primRangeReverse,
+			doc:      "Like kv-range, but in descending key order.",
+		},
+		{
+			name: "count",
+			impl: (*KVStore).primCount,
+			doc:  "Return the number of entries.",
+		},
+		{
+			name:    "clear!",
+			mutates: true,
+			impl:    (*KVStore).primClear,
+			doc:     "Remove all entries.",
+		},
+		{
+			name:    "cas!",
+			mutates: true,
+			params:  []string{"key", "expected", "new"},
+			impl:    (*KVStore).primCAS,
+			doc:     "Replace key's value with new if it currently equals expected. Returns #t on success.",
+		},
+		{
+			name:    "set-if-absent!",
+			mutates: true,
+			params:  []string{"key", "value"},
+			impl:    (*KVStore).primSetIfAbsent,
+			doc:     "Set key only if it is missing. Returns #t if the value was set.",
+		},
+		{
+			name:     "update!",
+			mutates:  true,
+			params:   []string{"key", "proc", "default"},
+			variadic: true,
+			impl:     (*KVStore).primUpdate,
+			doc:      "Atomically replace key's value with (proc value). Optional default if key missing.",
 		},
 		{
-			Name:       "kv-keys",
-			ParamCount: 0,
-			Impl:       kv.primKeys,
-			Doc:        "Return a sorted list of all keys.",
-			Category:   "kvstore",
+			name:    "incr!",
+			mutates: true,
+			params:  []string{"key"},
+			impl:    (*KVStore).primIncr,
+			doc:     "Atomically add 1 to an integer key, creating it at 0. Returns the new value.",
 		},
 		{
-			Name:       "kv-count",
-			ParamCount: 0,
-			Impl:       kv.primCount,
-			Doc:        "Return the number of entries.",
-			Category:   "kvstore",
+			name:    "decr!",
+			mutates: true,
+			params:  []string{"key"},
+			impl:    (*KVStore).primDecr,
+			doc:     "Atomically subtract 1 from an integer key, creating it at 0. Returns the new value.",
 		},
 		{
-			Name:       "kv-clear!",
-			ParamCount: 0,
-			Impl:       kv.primClear,
-			Doc:        "Remove all entries.",
-			Category:   "kvstore",
+			name:    "add!",
+			mutates: true,
+			params:  []string{"key", "delta"},
+			impl:    (*KVStore).primAdd,
+			doc:     "Atomically add delta to an integer key, creating it at 0. Returns the new value.",
+		},
+		{
+			name:   "watch",
+			params: []string{"prefix", "proc"},
+			impl:   (*KVStore).primWatch,
+			doc:    "Call (proc event key old new) after each change to a key starting with prefix. Returns a token for kv-unwatch.",
+		},
+		{
+			name:   "unwatch",
+			params: []string{"token"},
+			impl:   (*KVStore).primUnwatch,
+			doc:    "Remove the watch with the given token. Returns #t if it was registered.",
+		},
+		{
+			name: "revision",
+			impl: (*KVStore).primRevision,
+			doc:  "Return the revision of the most recent change, or 0 if there has been none.",
+		},
+		{
+			name:     "changes-since",
+			params:   []string{"rev", "limit"},
+			variadic: true,
+			impl:     (*KVStore).primChangesSince,
+			doc:      "Return the changes after rev as (op key old new rev) records, oldest first. Optional limit.",
+		},
+		{
+			name:   "history",
+			params: []string{"key"},
+			impl:   (*KVStore).primHistory,
+			doc:    "Return the retained versions of key, oldest first, as (rev time-ms op value) records.",
+		},
+		{
+			name:     "get-at",
+			params:   []string{"key", "time-ms", "default"},
+			variadic: true,
+			impl:     (*KVStore).primGetAt,
+			doc:      "Get key's value as of a time in milliseconds since the Unix epoch. Optional default if key missing.",
+		},
+		{
+			name:    "revert!",
+			mutates: true,
+			params:  []string{"key", "rev"},
+			impl:    (*KVStore).primRevert,
+			doc:     "Restore key to the version made at revision rev.",
+		},
+		{
+			name: "stats",
+			impl: (*KVStore).primStats,
+			doc:  "Return the store's statistics as an alist: hits, misses, sets, deletes, expired, clears, evictions, bytes and lock-wait-ns.",
+		},
+		{
+			name: "snapshot",
+			impl: (*KVStore).primSnapshot,
+			doc:  "Return an immutable snapshot of the store for kv-snapshot-get and kv-snapshot-keys.",
+		},
+		{
+			name:   "transaction",
+			params: []string{"thunk"},
+			impl:   (*KVStore).primTransaction,
+			doc:    "Call thunk, committing its writes atomically on return or discarding them if it raises.",
+		},
+	}
+}
+
+// primitiveSpecs returns the PrimitiveSpec slice for all kvstore operations.
+// Each spec's Impl is a method on *KVStore, capturing state via the receiver.
+func (kv *KVStore) primitiveSpecs(b *binding) []registry.PrimitiveSpec {
+	prims := primitives()
+	specs := make([]registry.PrimitiveSpec, 0, 2*len(prims)+5+len(errorClasses)+3)
+	for _, p := range prims {
+		name := kv.prefix + p.name
+		specs = append(specs, registry.PrimitiveSpec{
+			Name:       name,
+			ParamCount: len(p.params),
+			IsVariadic: p.variadic,
+			Impl:       kv.bind(b, name, p.impl),
+			Doc:        p.doc,
+			ParamNames: p.params,
+			Category:   kv.category,
+		})
+	}
+	for _, p := range prims {
+		name := kv.prefix + "store-" + p.name
+		specs = append(specs, registry.PrimitiveSpec{
+			Name:       name,
+			ParamCount: len(p.params) + 1,
+			IsVariadic: p.variadic,
+			Impl:       kv.bindHandle(b, name, p.impl),
+			Doc:        fmt.Sprintf("Like %s%s, on a store handle returned by %sopen.", kv.prefix, p.name, kv.prefix),
+			ParamNames: append([]string{"store"}, p.params...),
+			Category:   kv.category,
+		})
+	}
+	specs = append(specs,
+		registry.PrimitiveSpec{
+			Name:       kv.prefix + "open",
+			ParamCount: 1,
+			Impl:       kv.primOpen,
+			Doc:        "Return a handle to the named store, creating it on first use.",
+			ParamNames: []string{"name"},
+			Category:   kv.category,
+		},
+		registry.PrimitiveSpec{
+			Name:     kv.prefix + "poll-watches",
+			Impl:     b.primPollWatches,
+			Doc:      "Call this engine's kv-watch procedures for the changes queued since it last used the store. Returns how many were called.",
+			Category: kv.category,
+		},
+		registry.PrimitiveSpec{
+			Name:       kv.prefix + "snapshot-get",
+			ParamCount: 3,
+			IsVariadic: true,
+			Impl:       kv.bind(b, kv.prefix+"snapshot-get", (*KVStore).primSnapshotGet),
+			Doc:        "Get a key's value as of the snapshot. Optional default if key missing.",
+			ParamNames: []string{"snapshot", "key", "default"},
+			Category:   kv.category,
 		},
+		registry.PrimitiveSpec{
+			Name:       kv.prefix + "snapshot-keys",
+			ParamCount: 1,
+			Impl:       kv.bind(b, kv.prefix+"snapshot-keys", (*KVStore).primSnapshotKeys),
+			Doc:        "Return a sorted list of the keys present in the snapshot.",
+			ParamNames: []string{"snapshot"},
+			Category:   kv.category,
+		},
+		registry.PrimitiveSpec{
+			Name:       kv.prefix + "snapshot-release!",
+			ParamCount: 1,
+			Impl:       kv.bind(b, kv.prefix+"snapshot-release!", (*KVStore).primSnapshotRelease),
+			Doc:        "Release a snapshot so the store can discard the values kept for it.",
+			ParamNames: []string{"snapshot"},
+			Category:   kv.category,
+		},
+	)
+	return append(specs, kv.errorSpecs()...)
+}
+
+// bind adapts impl to a ForeignFunction operating on kv, registered with b.
+// Watch events queued for b's engine are delivered first.
+func (kv *KVStore) bind(b *binding, name string, impl func(*KVStore, context.Context, call) error) machine.ForeignFunction {
+	return func(ctx context.Context, mc *machine.MachineContext) error {
+		ctx = b.enter(ctx, mc)
+		return impl(kv, ctx, call{mc: mc, name: name})
+	}
+}
+
+// bindHandle adapts impl to a ForeignFunction operating on the store whose
+// handle is its first argument.
+func (kv *KVStore) bindHandle(b *binding, name string, impl func(*KVStore, context.Context, call) error) machine.ForeignFunction {
+	return func(ctx context.Context, mc *machine.MachineContext) error {
+		target, err := requireStore(mc, 0, name)
+		if err != nil {
+			return err
+		}
+		ctx = b.enter(ctx, mc)
+		return impl(target, ctx, call{mc: mc, name: name, base: 1})
+	}
+}
+
+// enter returns the context for a primitive called on mc, after delivering
+// the watch events queued for b's engine.
+func (b *binding) enter(ctx context.Context, mc *machine.MachineContext) context.Context {
+	ctx = b.context(ctx, mc)
+	b.deliver(ctx, mc)
+	return ctx
+}
+
+// primPollWatches implements (kv-poll-watches) → count.
+func (b *binding) primPollWatches(ctx context.Context, mc *machine.MachineContext) error {
+	mc.SetValue(values.NewInteger(int64(b.deliver(ctx, mc))))
+	return nil
+}
+
+// primOpen implements (kv-open name) → store handle.
+func (kv *KVStore) primOpen(_ context.Context, mc *machine.MachineContext) error {
+	prim := kv.prefix + "open"
+	name, err := requireString(mc, 0, prim)
+	if err != nil {
+		return err
 	}
+
+	s, err := kv.namedStore(name)
+	if err != nil {
+		return values.WrapForeignErrorf(err, "%s: %v", prim, err)
+	}
+	mc.SetValue(&storeHandle{name: name, kv: s})
+	return nil
 }
 
-// primSet implements (kv-set! key value).
-func (kv *KVStore) primSet(_ context.Context, mc *machine.MachineContext) error {
-	key, err := requireString(mc, 0, "kv-set!")
+// primSet implements (kv-set! key value [ttl-ms]).
+// Setting a key without a TTL clears any expiry it had.
+func (kv *KVStore) primSet(ctx context.Context, c call) error {
+	key, err := c.str(0)
 	if err != nil {
 		return err
 	}
-	val, err := requireString(mc, 1, "kv-set!")
+	val, err := c.value(1)
 	if err != nil {
 		return err
 	}
+	ttlArg, hasTTL, err := c.optional(2)
+	if err != nil {
+		return err
+	}
+	var ttl time.Duration
+	if hasTTL {
+		ms, err := c.integer(ttlArg, 2)
+		if err != nil {
+			return err
+		}
+		if ms <= 0 {
+			return c.errorf(ErrInvalidTTL, "TTL must be positive but got %d", ms)
+		}
+		ttl = time.Duration(ms) * time.Millisecond
+	}
 
-	kv.mu.Lock()
-	kv.data[key] = val
-	kv.mu.Unlock()
+	err = kv.writeKey(ctx, key, func(v view) error {
+		return v.set(key, val, ttl)
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
 
-	mc.SetValue(values.Void)
+	c.mc.SetValue(values.Void)
 	return nil
 }
 
 // primGet implements (kv-get key [default]).
-func (kv *KVStore) primGet(_ context.Context, mc *machine.MachineContext) error {
-	key, err := requireString(mc, 0, "kv-get")
+func (kv *KVStore) primGet(ctx context.Context, c call) error {
+	key, err := c.str(0)
 	if err != nil {
 		return err
 	}
-
-	// Parse optional default from rest args.
-	rest := mc.Arg(1)
-	var defaultVal values.Value
-	hasDefault := false
-	if !values.IsEmptyList(rest) {
-		tuple, ok := rest.(values.Tuple)
-		if ok {
-			defaultVal = tuple.Car()
-			hasDefault = true
-			if !values.IsEmptyList(tuple.Cdr()) {
-				return values.WrapForeignErrorf(values.ErrWrongNumberOfArguments,
-					"kv-get: expected 1 or 2 arguments")
-			}
-		}
+	defaultVal, hasDefault, err := c.optional(1)
+	if err != nil {
+		return err
 	}
 
-	kv.mu.RLock()
-	val, found := kv.data[key]
-	kv.mu.RUnlock()
+	var val string
+	var found bool
+	err = kv.readKey(ctx, key, func(v view) error {
+		val, found, err = v.get(key)
+		return err
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
 
 	if !found {
 		if hasDefault {
-			mc.SetValue(defaultVal)
+			c.mc.SetValue(defaultVal)
 			return nil
 		}
-		return values.WrapForeignErrorf(ErrKeyNotFound,
-			"kv-get: key %q not found", key)
+		return c.keyErrorf(ErrKeyNotFound, key, "key %q not found", key)
+	}
+
+	result, err := decodeValue(val)
+	if err != nil {
+		return c.keyErrorf(ErrStorage, key, "key %q: %v", key, err)
+	}
+	c.mc.SetValue(result)
+	return nil
+}
+
+// primTTL implements (kv-ttl key) → remaining milliseconds, or -1.
+func (kv *KVStore) primTTL(ctx context.Context, c call) error {
+	key, err := c.str(0)
+	if err != nil {
+		return err
+	}
+
+	var found, hasTTL bool
+	var deadline time.Time
+	err = kv.readKey(ctx, key, func(v view) error {
+		_, found, err = v.get(key)
+		deadline, hasTTL = v.expiry(key)
+		return err
+	})
+	if err != nil {
+		return c.storeError(err)
 	}
 
-	mc.SetValue(values.NewString(val))
+	if !found {
+		return c.keyErrorf(ErrKeyNotFound, key, "key %q not found", key)
+	}
+	remaining := int64(-1)
+	if hasTTL {
+		remaining = deadline.Sub(kv.now()).Milliseconds()
+	}
+	c.mc.SetValue(values.NewInteger(remaining))
 	return nil
 }
 
 // primDelete implements (kv-delete! key).
-func (kv *KVStore) primDelete(_ context.Context, mc *machine.MachineContext) error {
-	key, err := requireString(mc, 0, "kv-delete!")
+func (kv *KVStore) primDelete(ctx context.Context, c call) error {
+	key, err := c.str(0)
+	if err != nil {
+		return err
+	}
+
+	err = kv.writeKey(ctx, key, func(v view) error {
+		return v.delete(key)
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.mc.SetValue(values.Void)
+	return nil
+}
+
+// primSetMany implements (kv-set-many! entries [ttl-ms]).
+// Every value is validated before any is written, and the entries are
+// committed as one batch, so a write that fails leaves the store unchanged.
+func (kv *KVStore) primSetMany(ctx context.Context, c call) error {
+	entries, err := c.entries(0)
+	if err != nil {
+		return err
+	}
+	ttlArg, hasTTL, err := c.optional(1)
+	if err != nil {
+		return err
+	}
+	var ttl time.Duration
+	if hasTTL {
+		ms, err := c.integer(ttlArg, 1)
+		if err != nil {
+			return err
+		}
+		if ms <= 0 {
+			return c.errorf(ErrInvalidTTL, "TTL must be positive but got %d", ms)
+		}
+		ttl = time.Duration(ms) * time.Millisecond
+	}
+	pol := policyFrom(ctx)
+	for _, e := range entries {
+		if err := pol.checkWrite(e.key); err != nil {
+			return c.storeError(err)
+		}
+	}
+
+	err = kv.atomically(ctx, func(_ context.Context, v view) error {
+		for _, e := range entries {
+			if err := v.set(e.key, e.value, ttl); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.mc.SetValue(values.Void)
+	return nil
+}
+
+// primGetMany implements (kv-get-many keys [default]) → hashtable.
+func (kv *KVStore) primGetMany(ctx context.Context, c call) error {
+	keys, err := c.strs(0)
+	if err != nil {
+		return err
+	}
+	defaultVal, hasDefault, err := c.optional(1)
+	if err != nil {
+		return err
+	}
+
+	vals := make([]string, len(keys))
+	found := make([]bool, len(keys))
+	err = kv.read(ctx, func(v view) error {
+		for i, key := range keys {
+			var err error
+			if vals[i], found[i], err = v.get(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	h := values.NewHashtable()
+	for i, key := range keys {
+		switch {
+		case found[i]:
+			val, err := decodeValue(vals[i])
+			if err != nil {
+				return c.keyErrorf(ErrStorage, key, "key %q: %v", key, err)
+			}
+			h.Set(values.NewString(key), val)
+		case hasDefault:
+			h.Set(values.NewString(key), defaultVal)
+		}
+	}
+	c.mc.SetValue(h)
+	return nil
+}
+
+// primDeleteMany implements (kv-delete-many! keys) → count.
+// Every key is checked against the policy before any is deleted.
+func (kv *KVStore) primDeleteMany(ctx context.Context, c call) error {
+	keys, err := c.strs(0)
 	if err != nil {
 		return err
 	}
+	pol := policyFrom(ctx)
+	for _, key := range keys {
+		if err := errors.Join(pol.checkRead(key), pol.checkWrite(key)); err != nil {
+			return c.storeError(err)
+		}
+	}
 
-	kv.mu.Lock()
-	delete(kv.data, key)
-	kv.mu.Unlock()
+	var deleted int
+	err = kv.atomically(ctx, func(_ context.Context, v view) error {
+		deleted, err = deleteKeys(v, keys)
+		return err
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
 
-	mc.SetValue(values.Void)
+	c.mc.SetValue(values.NewInteger(int64(deleted)))
 	return nil
 }
 
+// deleteKeys deletes the keys present in v and returns how many there were.
+func deleteKeys(v view, keys []string) (int, error) {
+	deleted := 0
+	for _, key := range keys {
+		_, found, err := v.get(key)
+		if err != nil {
+			return deleted, err
+		}
+		if !found {
+			continue
+		}
+		if err := v.delete(key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
 // primKeys implements (kv-keys) → sorted list of all keys.
-func (kv *KVStore) primKeys(_ context.Context, mc *machine.MachineContext) error {
-	kv.mu.RLock()
-	keys := make([]string, 0, len(kv.data))
-	for k := range kv.data {
-		keys = append(keys, k)
+func (kv *KVStore) primKeys(ctx context.Context, c call) error {
+	var keys []string
+	err := kv.read(ctx, func(v view) error {
+		var err error
+		keys, err = v.keys()
+		return err
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.mc.SetValue(stringList(keys))
+	return nil
+}
+
+// primKeysWithPrefix implements (kv-keys-with-prefix prefix) → sorted list of
+// the keys that start with prefix.
+func (kv *KVStore) primKeysWithPrefix(ctx context.Context, c call) error {
+	prefix, err := c.str(0)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	err = kv.read(ctx, func(v view) error {
+		var err error
+		keys, err = v.scan(prefix, prefixEnd(prefix), false, 0)
+		return err
+	})
+	if err != nil {
+		return c.storeError(err)
 	}
-	kv.mu.RUnlock()
 
-	sort.Strings(keys)
+	c.mc.SetValue(stringList(keys))
+	return nil
+}
+
+// primRange implements (kv-range start end [limit]).
+func (kv *KVStore) primRange(ctx context.Context, c call) error {
+	return kv.rangeImpl(ctx, c, false)
+}
+
+// primRangeReverse implements (kv-range-reverse start end [limit]).
+func (kv *KVStore) primRangeReverse(ctx context.Context, c call) error {
+	return kv.rangeImpl(ctx, c, true)
+}
+
+// rangeImpl returns an alist of the (key . value) pairs with start <= key <
+// end, in ascending or descending key order, stopping after limit pairs. An
+// empty end string means no upper bound.
+func (kv *KVStore) rangeImpl(ctx context.Context, c call, reverse bool) error {
+	start, err := c.str(0)
+	if err != nil {
+		return err
+	}
+	end, err := c.str(1)
+	if err != nil {
+		return err
+	}
+	limitArg, hasLimit, err := c.optional(2)
+	if err != nil {
+		return err
+	}
+	limit := int64(0)
+	if hasLimit {
+		if limit, err = c.integer(limitArg, 2); err != nil {
+			return err
+		}
+	}
 
-	elems := make([]values.Value, len(keys))
-	for i, k := range keys {
-		elems[i] = values.NewString(k)
+	var pairs []values.Value
+	err = kv.read(ctx, func(v view) error {
+		keys, err := v.scan(start, end, reverse, int(limit))
+		if err != nil {
+			return err
+		}
+		pairs = make([]values.Value, 0, len(keys))
+		for _, k := range keys {
+			val, found, err := v.get(k)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+			datum, err := decodeValue(val)
+			if err != nil {
+				return fmt.Errorf("key %q: %w", k, err)
+			}
+			pairs = append(pairs, values.NewCons(values.NewString(k), datum))
+		}
+		return nil
+	})
+	if err != nil {
+		return c.storeError(err)
 	}
-	mc.SetValue(values.List(elems...))
+
+	c.mc.SetValue(values.List(pairs...))
 	return nil
 }
 
 // primCount implements (kv-count) → number of entries.
-func (kv *KVStore) primCount(_ context.Context, mc *machine.MachineContext) error {
-	kv.mu.RLock()
-	n := len(kv.data)
-	kv.mu.RUnlock()
+func (kv *KVStore) primCount(ctx context.Context, c call) error {
+	var n int
+	err := kv.read(ctx, func(v view) error {
+		var err error
+		n, err = v.count()
+		return err
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
 
-	mc.SetValue(values.NewInteger(int64(n)))
+	c.mc.SetValue(values.NewInteger(int64(n)))
 	return nil
 }
 
 // primClear implements (kv-clear!) → removes all entries.
-func (kv *KVStore) primClear(_ context.Context, mc *machine.MachineContext) error {
-	kv.mu.Lock()
-	clear(kv.data)
-	kv.mu.Unlock()
+func (kv *KVStore) primClear(ctx context.Context, c call) error {
+	err := kv.write(ctx, func(v view) error {
+		return v.clear()
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
 
-	mc.SetValue(values.Void)
+	c.mc.SetValue(values.Void)
 	return nil
 }
 
-// requireString extracts a string argument from the given index.
-func requireString(mc *machine.MachineContext, index int, name string) (string, error) {
-	v := mc.Arg(index)
-	s, ok := v.(*values.String)
-	if !ok {
-		return "", values.WrapForeignErrorf(values.ErrNotAString,
-			"%s: expected string at argument %d but got %T", name, index+1, v)
+// primTransaction implements (kv-transaction thunk). The thunk's writes are
+// buffered and committed as one batch when it returns normally, and
+// discarded if it raises. If a concurrent write changes what the thunk read,
+// it runs once more holding the store's write lock.
+func (kv *KVStore) primTransaction(ctx context.Context, c call) error {
+	if kv.txnFrom(ctx) != nil {
+		return c.errorf(ErrNestedTransaction, "already inside a transaction on this store")
 	}
-	return s.Value, nil
+	thunk := c.arg(0)
+
+	var result values.Value
+	var thunkErr error
+	err := kv.atomically(ctx, func(ctx context.Context, _ view) error {
+		result, thunkErr = callProcedure(ctx, c.mc, thunk)
+		return thunkErr
+	})
+	if thunkErr != nil {
+		return thunkErr
+	}
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.mc.SetValue(result)
+	return nil
+}
+
+// primCAS implements (kv-cas! key expected new) → #t if key held a datum
+// equal to expected and was replaced by new, #f otherwise. The key keeps no
+// TTL.
+func (kv *KVStore) primCAS(ctx context.Context, c call) error {
+	key, err := c.str(0)
+	if err != nil {
+		return err
+	}
+	expected, err := c.value(1)
+	if err != nil {
+		return err
+	}
+	val, err := c.value(2)
+	if err != nil {
+		return err
+	}
+
+	swapped := false
+	err = kv.writeKey(ctx, key, func(v view) error {
+		cur, found, err := v.get(key)
+		if err != nil || !found || cur != expected {
+			return err
+		}
+		swapped = true
+		return v.set(key, val, 0)
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.mc.SetValue(boolean(swapped))
+	return nil
+}
+
+// primSetIfAbsent implements (kv-set-if-absent! key value) → #t if key was
+// missing and has been set, #f if it already existed.
+func (kv *KVStore) primSetIfAbsent(ctx context.Context, c call) error {
+	key, err := c.str(0)
+	if err != nil {
+		return err
+	}
+	val, err := c.value(1)
+	if err != nil {
+		return err
+	}
+
+	set := false
+	err = kv.writeKey(ctx, key, func(v view) error {
+		_, found, err := v.get(key)
+		if err != nil || found {
+			return err
+		}
+		set = true
+		return v.set(key, val, 0)
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.mc.SetValue(boolean(set))
+	return nil
+}
+
+// primUpdate implements (kv-update! key proc [default]) → new value.
+// proc is called with the current value, or default if the key is missing;
+// its result, which must be serializable, replaces the value. proc runs once,
+// holding the store's write lock; kvstore calls it makes on the store join
+// the update as a transaction.
+func (kv *KVStore) primUpdate(ctx context.Context, c call) error {
+	key, err := c.str(0)
+	if err != nil {
+		return err
+	}
+	proc := c.arg(1)
+	defaultVal, hasDefault, err := c.optional(2)
+	if err != nil {
+		return err
+	}
+
+	var result values.Value
+	var failure error
+	err = kv.locked(ctx, func(ctx context.Context, v view) error {
+		cur, found, err := v.get(key)
+		if err != nil {
+			return err
+		}
+		arg := defaultVal
+		if found {
+			if arg, err = decodeValue(cur); err != nil {
+				return err
+			}
+		} else if !hasDefault {
+			failure = c.keyErrorf(ErrKeyNotFound, key, "key %q not found", key)
+			return failure
+		}
+		result, err = callProcedure(ctx, c.mc, proc, arg)
+		if err != nil {
+			failure = err
+			return err
+		}
+		enc, err := encodeResult(result, c.name)
+		if err != nil {
+			failure = err
+			return err
+		}
+		return v.set(key, enc, 0)
+	})
+	if failure != nil {
+		return failure
+	}
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.mc.SetValue(result)
+	return nil
+}
+
+// primIncr implements (kv-incr! key) → new value.
+func (kv *KVStore) primIncr(ctx context.Context, c call) error {
+	return kv.addImpl(ctx, c, 1)
+}
+
+// primDecr implements (kv-decr! key) → new value.
+func (kv *KVStore) primDecr(ctx context.Context, c call) error {
+	return kv.addImpl(ctx, c, -1)
+}
+
+// primAdd implements (kv-add! key delta) → new value.
+func (kv *KVStore) primAdd(ctx context.Context, c call) error {
+	delta, err := c.integer(c.arg(1), 1)
+	if err != nil {
+		return err
+	}
+	return kv.addImpl(ctx, c, delta)
+}
+
+// addImpl adds delta to the integer stored under the key in argument 0. A
+// counter stored as a decimal string stays a string; a missing key becomes an
+// integer. The key keeps the deadline it had, if any.
+func (kv *KVStore) addImpl(ctx context.Context, c call, delta int64) error {
+	key, err := c.str(0)
+	if err != nil {
+		return err
+	}
+
+	var n int64
+	var failure error
+	err = kv.writeKey(ctx, key, func(v view) error {
+		old, found, err := v.get(key)
+		if err != nil {
+			return err
+		}
+		var cur int64
+		asString := false
+		if found {
+			if cur, asString, err = counterValue(old); err != nil {
+				failure = c.keyErrorf(ErrNotAnInteger, key, "key %q: %v", key, err)
+				return failure
+			}
+		}
+		n = cur + delta
+		if (delta > 0 && n < cur) || (delta < 0 && n > cur) {
+			failure = c.keyErrorf(ErrOverflow, key, "key %q: %d %+d overflows", key, cur, delta)
+			return failure
+		}
+		deadline, _ := v.expiry(key)
+		var enc string
+		if asString {
+			enc = encodeString(strconv.FormatInt(n, 10))
+		} else if enc, err = encodeValue(values.NewInteger(n)); err != nil {
+			return err
+		}
+		return v.setUntil(key, enc, deadline)
+	})
+	if failure != nil {
+		return failure
+	}
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.mc.SetValue(values.NewInteger(n))
+	return nil
+}
+
+// counterValue parses a stored counter, an integer or a string holding a
+// decimal integer, reporting whether it was a string.
+func counterValue(enc string) (int64, bool, error) {
+	v, err := decodeValue(enc)
+	if err != nil {
+		return 0, false, err
+	}
+	switch v := v.(type) {
+	case *values.Integer:
+		return v.Value, false, nil
+	case *values.String:
+		n, err := strconv.ParseInt(v.Value, 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("value %q is not an integer", v.Value)
+		}
+		return n, true, nil
+	}
+	return 0, false, fmt.Errorf("value %s is not an integer", v.SchemeString())
+}
+
+// primWatch implements (kv-watch prefix proc) → token.
+func (kv *KVStore) primWatch(ctx context.Context, c call) error {
+	prefix, err := c.str(0)
+	if err != nil {
+		return err
+	}
+
+	b := bindingFrom(ctx)
+	w := schemeWatcher(prefix, c.arg(1), b)
+	if pol := policyFrom(ctx); pol != nil {
+		// Events for keys the engine may not read are not delivered.
+		fn := w.fn
+		w.fn = func(ch change) error {
+			if !pol.canRead(ch.key) {
+				return nil
+			}
+			return fn(ch)
+		}
+	}
+	token := kv.watch(w)
+	b.track(kv, token)
+	c.mc.SetValue(values.NewInteger(token))
+	return nil
+}
+
+// primUnwatch implements (kv-unwatch token) → boolean.
+func (kv *KVStore) primUnwatch(ctx context.Context, c call) error {
+	token, err := c.integer(c.arg(0), 0)
+	if err != nil {
+		return err
+	}
+
+	bindingFrom(ctx).untrack(kv, token)
+	c.mc.SetValue(boolean(kv.unwatch(token)))
+	return nil
+}
+
+// primRevision implements (kv-revision).
+func (kv *KVStore) primRevision(_ context.Context, c call) error {
+	c.mc.SetValue(values.NewInteger(kv.changes.revision()))
+	return nil
+}
+
+// primChangesSince implements (kv-changes-since rev [limit]).
+func (kv *KVStore) primChangesSince(ctx context.Context, c call) error {
+	rev, err := c.integer(c.arg(0), 0)
+	if err != nil {
+		return err
+	}
+	limitArg, hasLimit, err := c.optional(1)
+	if err != nil {
+		return err
+	}
+	limit := int64(0)
+	if hasLimit {
+		if limit, err = c.integer(limitArg, 1); err != nil {
+			return err
+		}
+	}
+
+	changes, _, ok := kv.changes.since(rev, int(limit))
+	if !ok {
+		return c.errorf(ErrChangesTruncated, "changes after revision %d are no longer held", rev)
+	}
+	pol := policyFrom(ctx)
+	records := make([]values.Value, 0, len(changes))
+	for _, ch := range changes {
+		if ch.op == opClear || pol.canRead(ch.key) {
+			records = append(records, changeRecord(ch))
+		}
+	}
+	c.mc.SetValue(values.List(records...))
+	return nil
+}
+
+// primHistory implements (kv-history key) → list of versions.
+func (kv *KVStore) primHistory(ctx context.Context, c call) error {
+	key, err := c.str(0)
+	if err != nil {
+		return err
+	}
+	if !kv.history.enabled() {
+		return c.errorf(ErrHistoryDisabled, "the store was created without WithHistory")
+	}
+	if err := policyFrom(ctx).checkRead(key); err != nil {
+		return c.storeError(err)
+	}
+
+	var records []values.Value
+	err = kv.read(ctx, func(view) error {
+		for _, e := range kv.history.entries[key] {
+			records = append(records, historyRecord(e))
+		}
+		return nil
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.mc.SetValue(values.List(records...))
+	return nil
+}
+
+// primGetAt implements (kv-get-at key time-ms [default]).
+func (kv *KVStore) primGetAt(ctx context.Context, c call) error {
+	key, err := c.str(0)
+	if err != nil {
+		return err
+	}
+	ms, err := c.integer(c.arg(1), 1)
+	if err != nil {
+		return err
+	}
+	defaultVal, hasDefault, err := c.optional(2)
+	if err != nil {
+		return err
+	}
+	if !kv.history.enabled() {
+		return c.errorf(ErrHistoryDisabled, "the store was created without WithHistory")
+	}
+	if err := policyFrom(ctx).checkRead(key); err != nil {
+		return c.storeError(err)
+	}
+
+	var e historyEntry
+	var found bool
+	err = kv.read(ctx, func(view) error {
+		e, found = kv.history.at(key, time.UnixMilli(ms))
+		return nil
+	})
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	if !found || !e.present() {
+		if hasDefault {
+			c.mc.SetValue(defaultVal)
+			return nil
+		}
+		return c.keyErrorf(ErrKeyNotFound, key, "key %q not found at %d", key, ms)
+	}
+
+	result, err := decodeValue(e.value)
+	if err != nil {
+		return c.keyErrorf(ErrStorage, key, "key %q: %v", key, err)
+	}
+	c.mc.SetValue(result)
+	return nil
+}
+
+// primRevert implements (kv-revert! key rev). Reverting to a version that
+// removed the key deletes it. The revert is itself a new version.
+func (kv *KVStore) primRevert(ctx context.Context, c call) error {
+	key, err := c.str(0)
+	if err != nil {
+		return err
+	}
+	rev, err := c.integer(c.arg(1), 1)
+	if err != nil {
+		return err
+	}
+	if !kv.history.enabled() {
+		return c.errorf(ErrHistoryDisabled, "the store was created without WithHistory")
+	}
+
+	var failure error
+	err = kv.write(ctx, func(v view) error {
+		e, ok := kv.history.find(key, rev)
+		if !ok {
+			failure = c.keyErrorf(ErrVersionNotFound, key, "key %q has no retained version at revision %d", key, rev)
+			return failure
+		}
+		if e.present() {
+			return v.set(key, e.value, 0)
+		}
+		return v.delete(key)
+	})
+	if failure != nil {
+		return failure
+	}
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.mc.SetValue(values.Void)
+	return nil
+}
+
+// primStats implements (kv-stats) → alist.
+func (kv *KVStore) primStats(_ context.Context, c call) error {
+	s := kv.Stats()
+	stat := func(name string, n int64) values.Value {
+		return values.NewCons(values.NewSymbol(name), values.NewInteger(n))
+	}
+	c.mc.SetValue(values.List(
+		stat("hits", s.Hits),
+		stat("misses", s.Misses),
+		stat("sets", s.Sets),
+		stat("deletes", s.Deletes),
+		stat("expired", s.Expired),
+		stat("clears", s.Clears),
+		stat("evictions", s.Evictions),
+		stat("bytes", s.Bytes),
+		stat("lock-wait-ns", int64(s.LockWait)),
+	))
+	return nil
+}
+
+// primSnapshot implements (kv-snapshot) → snapshot.
+func (kv *KVStore) primSnapshot(ctx context.Context, c call) error {
+	snap, err := kv.snapshot(ctx)
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.mc.SetValue(&snapshotHandle{snap: snap})
+	return nil
+}
+
+// primSnapshotGet implements (kv-snapshot-get snapshot key [default]).
+func (*KVStore) primSnapshotGet(ctx context.Context, c call) error {
+	snap, err := c.snapshot(0)
+	if err != nil {
+		return err
+	}
+	key, err := c.str(1)
+	if err != nil {
+		return err
+	}
+	defaultVal, hasDefault, err := c.optional(2)
+	if err != nil {
+		return err
+	}
+	if err := policyFrom(ctx).checkRead(key); err != nil {
+		return c.storeError(err)
+	}
+
+	val, found, err := snap.get(ctx, key)
+	if errors.Is(err, ErrSnapshotReleased) {
+		return c.errorf(ErrSnapshotReleased, "snapshot at revision %d was released", snap.rev)
+	}
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	if !found {
+		if hasDefault {
+			c.mc.SetValue(defaultVal)
+			return nil
+		}
+		return c.keyErrorf(ErrKeyNotFound, key, "key %q not found", key)
+	}
+
+	result, err := decodeValue(val)
+	if err != nil {
+		return c.keyErrorf(ErrStorage, key, "key %q: %v", key, err)
+	}
+	c.mc.SetValue(result)
+	return nil
+}
+
+// primSnapshotKeys implements (kv-snapshot-keys snapshot).
+func (*KVStore) primSnapshotKeys(ctx context.Context, c call) error {
+	snap, err := c.snapshot(0)
+	if err != nil {
+		return err
+	}
+
+	keys, err := snap.keys(ctx)
+	if errors.Is(err, ErrSnapshotReleased) {
+		return c.errorf(ErrSnapshotReleased, "snapshot at revision %d was released", snap.rev)
+	}
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.mc.SetValue(stringList(policyFrom(ctx).readable(keys)))
+	return nil
+}
+
+// primSnapshotRelease implements (kv-snapshot-release! snapshot).
+func (*KVStore) primSnapshotRelease(ctx context.Context, c call) error {
+	snap, err := c.snapshot(0)
+	if err != nil {
+		return err
+	}
+
+	snap.release(ctx)
+	c.mc.SetValue(values.Void)
+	return nil
+}
+
+// call gives a primitive access to its arguments. Store-handle variants take
+// the handle as their first argument, so base shifts every other index.
+type call struct {
+	mc   *machine.MachineContext
+	name string
+	base int
+}
+
+// arg returns the argument at index i.
+func (c call) arg(i int) values.Value {
+	return c.mc.Arg(c.base + i)
+}
+
+// str extracts a string argument.
+func (c call) str(i int) (string, error) {
+	return requireString(c.mc, c.base+i, c.name)
+}
+
+// value encodes an argument for storage.
+func (c call) value(i int) (string, error) {
+	return requireValue(c.mc, c.base+i, c.name)
+}
+
+// optional returns the optional last argument, collected in the rest list at
+// index i.
+func (c call) optional(i int) (values.Value, bool, error) {
+	n := c.base + i
+	return optionalArg(c.mc, n, c.name, fmt.Sprintf("%d or %d", n, n+1))
+}
+
+// integer converts v, the argument at index i, to an int64.
+func (c call) integer(v values.Value, i int) (int64, error) {
+	return toInteger(v, c.base+i, c.name)
+}
+
+// storeError reports an error from reading or writing the store. An error
+// of one of the kinds in errorKinds, such as ErrQuotaExceeded, is kept with
+// any key it carries; anything else is a storage failure.
+func (c call) storeError(err error) error {
+	if errorKind(err) != "" {
+		return values.WrapForeignErrorf(err, "%s: %v", c.name, err)
+	}
+	return c.errorf(ErrStorage, "%v", err)
+}
+
+// snapshot extracts a snapshot argument.
+func (c call) snapshot(i int) (*Snapshot, error) {
+	v := c.arg(i)
+	h, ok := v.(*snapshotHandle)
+	if !ok {
+		return nil, values.WrapForeignErrorf(ErrNotASnapshot,
+			"%s: expected kv-snapshot at argument %d but got %T", c.name, c.base+i+1, v)
+	}
+	return h.snap, nil
+}
+
+// entry is a key and its encoded value.
+type entry struct {
+	key, value string
+}
+
+// entries extracts a hashtable or an alist of (key . value) pairs with
+// string keys, encoding each value for storage.
+func (c call) entries(i int) ([]entry, error) {
+	var pairs [][2]values.Value
+	switch v := c.arg(i).(type) {
+	case *values.Hashtable:
+		for _, k := range v.Keys() {
+			val, _ := v.Get(k)
+			pairs = append(pairs, [2]values.Value{k, val})
+		}
+	default:
+		elems, ok := listElements(v)
+		if !ok {
+			return nil, c.errorf(ErrNotAList, "expected hashtable or alist at argument %d but got %T", c.base+i+1, v)
+		}
+		for _, e := range elems {
+			pair, ok := e.(values.Tuple)
+			if !ok || values.IsEmptyList(e) {
+				return nil, c.errorf(ErrNotAList, "argument %d: expected (key . value) pair but got %T", c.base+i+1, e)
+			}
+			pairs = append(pairs, [2]values.Value{pair.Car(), pair.Cdr()})
+		}
+	}
+
+	entries := make([]entry, len(pairs))
+	for j, p := range pairs {
+		key, ok := p[0].(*values.String)
+		if !ok {
+			return nil, c.errorf(ErrNotAString, "argument %d: expected string key but got %T", c.base+i+1, p[0])
+		}
+		enc, err := encodeValue(p[1])
+		if err != nil {
+			return nil, c.keyErrorf(ErrNotSerializable, key.Value, "argument %d: key %q: %v", c.base+i+1, key.Value, err)
+		}
+		entries[j] = entry{key: key.Value, value: enc}
+	}
+	return entries, nil
+}
+
+// strs extracts a list of strings.
+func (c call) strs(i int) ([]string, error) {
+	v := c.arg(i)
+	elems, ok := listElements(v)
+	if !ok {
+		return nil, c.errorf(ErrNotAList, "expected list of strings at argument %d but got %T", c.base+i+1, v)
+	}
+	ss := make([]string, len(elems))
+	for j, e := range elems {
+		s, ok := e.(*values.String)
+		if !ok {
+			return nil, c.errorf(ErrNotAString, "argument %d: expected string but got %T", c.base+i+1, e)
+		}
+		ss[j] = s.Value
+	}
+	return ss, nil
+}
+
+// errorf wraps err with a message prefixed by the primitive's name.
+func (c call) errorf(err error, format string, args ...any) error {
+	return values.WrapForeignErrorf(err, "%s: %s", c.name, fmt.Sprintf(format, args...))
+}
+
+// keyErrorf is errorf for an error about key, which kv-error-key returns.
+func (c call) keyErrorf(err error, key, format string, args ...any) error {
+	return c.errorf(keyError(key, err), format, args...)
+}
+
+// requireString extracts a string argument from the given index.
+func requireString(mc *machine.MachineContext, index int, name string) (string, error) {
+	v := mc.Arg(index)
+	s, ok := v.(*values.String)
+	if !ok {
+		return "", values.WrapForeignErrorf(ErrNotAString,
+			"%s: expected string at argument %d but got %T", name, index+1, v)
+	}
+	return s.Value, nil
+}
+
+// requireValue encodes the argument at the given index for storage.
+func requireValue(mc *machine.MachineContext, index int, name string) (string, error) {
+	v := mc.Arg(index)
+	enc, err := encodeValue(v)
+	if err != nil {
+		return "", values.WrapForeignErrorf(ErrNotSerializable,
+			"%s: argument %d: %v", name, index+1, err)
+	}
+	return enc, nil
+}
+
+// encodeResult encodes a value returned by a Scheme procedure for storage.
+func encodeResult(v values.Value, name string) (string, error) {
+	enc, err := encodeValue(v)
+	if err != nil {
+		return "", values.WrapForeignErrorf(ErrNotSerializable,
+			"%s: procedure result: %v", name, err)
+	}
+	return enc, nil
+}
+
+// optionalArg returns the single optional argument collected in the rest
+// list at index, reporting whether it was supplied. arity describes the
+// accepted argument counts for the error message.
+func optionalArg(mc *machine.MachineContext, index int, name, arity string) (values.Value, bool, error) {
+	rest := mc.Arg(index)
+	if values.IsEmptyList(rest) {
+		return nil, false, nil
+	}
+	tuple, ok := rest.(values.Tuple)
+	if !ok {
+		return nil, false, nil
+	}
+	if !values.IsEmptyList(tuple.Cdr()) {
+		return nil, false, values.WrapForeignErrorf(values.ErrWrongNumberOfArguments,
+			"%s: expected %s arguments", name, arity)
+	}
+	return tuple.Car(), true, nil
+}
+
+// listElements returns the elements of a proper list, reporting false if v
+// is not one.
+func listElements(v values.Value) ([]values.Value, bool) {
+	var elems []values.Value
+	for !values.IsEmptyList(v) {
+		pair, ok := v.(values.Tuple)
+		if !ok {
+			return nil, false
+		}
+		elems = append(elems, pair.Car())
+		v = pair.Cdr()
+	}
+	return elems, true
+}
+
+// stringList returns a Scheme list of strings.
+func stringList(ss []string) values.Value {
+	elems := make([]values.Value, len(ss))
+	for i, s := range ss {
+		elems[i] = values.NewString(s)
+	}
+	return values.List(elems...)
+}
+
+// boolean returns the Scheme boolean for b.
+func boolean(b bool) values.Value {
+	if b {
+		return values.TrueValue
+	}
+	return values.FalseValue
+}
+
+// toInteger converts v, the argument at the given index, to an int64.
+func toInteger(v values.Value, index int, name string) (int64, error) {
+	i, ok := v.(*values.Integer)
+	if !ok {
+		return 0, values.WrapForeignErrorf(ErrNotAnInteger,
+			"%s: expected integer at argument %d but got %T", name, index+1, v)
+	}
+	return i.Value, nil
 }
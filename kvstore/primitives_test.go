@@ -0,0 +1,219 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCounters(t *testing.T) {
+	engine := newEngine(t, New())
+
+	// A missing key starts at zero and becomes an integer; a counter
+	// stored as a decimal string stays a string.
+	eval(t, engine, `(kv-set! "s" "41")`)
+	check(t, engine,
+		`(= (kv-incr! "n") 1)`,
+		`(= (kv-add! "n" 9) 10)`,
+		`(= (kv-decr! "n") 9)`,
+		`(eqv? (kv-get "n") 9)`,
+		`(= (kv-incr! "s") 42)`,
+		`(equal? (kv-get "s") "42")`,
+		`(= (kv-add! "s" -50) -8)`,
+		`(equal? (kv-get "s") "-8")`)
+
+	eval(t, engine, `(kv-set! "word" "abc") (kv-set! "real" 1.5)`)
+	checkRaises(t, engine, `(kv-incr! "word")`, "not-an-integer")
+	checkRaises(t, engine, `(kv-incr! "real")`, "not-an-integer")
+	checkRaises(t, engine, `(kv-add! "n" "1")`, "not-an-integer")
+
+	// An overflowing update fails and leaves the counter unchanged.
+	eval(t, engine, fmt.Sprintf(`(kv-set! "max" %d) (kv-set! "min" "%d")`, math.MaxInt64, math.MinInt64))
+	checkRaises(t, engine, `(kv-incr! "max")`, "overflow")
+	checkRaises(t, engine, `(kv-decr! "min")`, "overflow")
+	checkRaises(t, engine, `(kv-add! "n" -9223372036854775807) (kv-add! "n" -9223372036854775807)`, "overflow")
+	check(t, engine,
+		fmt.Sprintf(`(= (kv-get "max") %d)`, math.MaxInt64),
+		fmt.Sprintf(`(equal? (kv-get "min") "%d")`, math.MinInt64),
+		`(= (kv-add! "max" -1) 9223372036854775806)`)
+}
+
+func TestCounterKeepsDeadline(t *testing.T) {
+	clock := newFakeClock()
+	engine := newEngine(t, New(WithClock(clock.now), WithJanitorInterval(time.Hour)))
+
+	eval(t, engine, `(kv-set! "c" 1 1000)`)
+	clock.advance(400 * time.Millisecond)
+	check(t, engine, `(= (kv-incr! "c") 2)`, `(= (kv-ttl "c") 600)`)
+	eval(t, engine, `(kv-transaction (lambda () (kv-incr! "c")))`)
+	check(t, engine, `(= (kv-ttl "c") 600)`)
+	clock.advance(600 * time.Millisecond)
+	check(t, engine, `(eq? (kv-get "c" 'gone) 'gone)`)
+
+	// A counter whose deadline passes while it is being updated must not
+	// lose its TTL. With a clock that moves on every reading, some of these
+	// deadlines fall between the update's reads.
+	var mu sync.Mutex
+	at := clock.now()
+	ticking := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		at = at.Add(time.Millisecond)
+		return at
+	}
+	engine = newEngine(t, New(WithClock(ticking), WithJanitorInterval(time.Hour)))
+	for ttl := 1; ttl <= 20; ttl++ {
+		key := fmt.Sprintf("c%d", ttl)
+		eval(t, engine, fmt.Sprintf(`(kv-set! %q 0 %d) (kv-incr! %q)`, key, ttl, key))
+		check(t, engine, fmt.Sprintf(`(guard (e (#t (kv-key-not-found-error? e))) (not (= (kv-ttl %q) -1)))`, key))
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	engine := newEngine(t, New())
+	eval(t, engine, `(kv-set! "k" '(1 "two"))`)
+
+	// Values compare structurally, and a missing key never matches.
+	check(t, engine,
+		`(not (kv-cas! "k" '(1 "2") 'x))`,
+		`(kv-cas! "k" (list 1 "two") 'x)`,
+		`(eq? (kv-get "k") 'x)`,
+		`(not (kv-cas! "missing" #f 1))`,
+		`(eq? (kv-get "missing" 'none) 'none)`)
+
+	check(t, engine,
+		`(kv-set-if-absent! "new" 1)`,
+		`(not (kv-set-if-absent! "new" 2))`,
+		`(= (kv-get "new") 1)`)
+}
+
+func TestUpdate(t *testing.T) {
+	engine := newEngine(t, New())
+	eval(t, engine, `(kv-set! "list" '(1))`)
+	check(t, engine,
+		`(equal? (kv-update! "list" (lambda (l) (cons 0 l))) '(0 1))`,
+		`(equal? (kv-get "list") '(0 1))`,
+		`(= (kv-update! "n" (lambda (n) (+ n 1)) 41) 42)`,
+		`(= (kv-get "n") 42)`)
+	checkRaises(t, engine, `(kv-update! "missing" (lambda (v) v))`, "key-not-found")
+
+	// A procedure that raises, or returns something unserializable, leaves
+	// the value unchanged.
+	check(t, engine,
+		`(eq? (guard (e (#t 'raised)) (kv-update! "n" (lambda (n) (raise 'boom)))) 'raised)`,
+		`(= (kv-get "n") 42)`)
+	checkRaises(t, engine, `(kv-update! "n" (lambda (n) (lambda () n)))`, "not-serializable")
+	check(t, engine, `(= (kv-get "n") 42)`)
+}
+
+// TestUpdateContended runs kv-update! from several engines at once. Each
+// call's procedure runs exactly once, under the write lock, so no update is
+// lost or repeated.
+func TestUpdateContended(t *testing.T) {
+	store := New()
+	const engines, rounds = 4, 20
+	var wg sync.WaitGroup
+	for range engines {
+		engine := newEngine(t, store)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := engine.EvalMultiple(context.Background(), fmt.Sprintf(`
+				(define calls 0)
+				(define (slowly-incr n)
+				  (set! calls (+ calls 1))
+				  (let spin ((k 0))
+				    (if (< k 1000) (spin (+ k 1)) (+ n 1))))
+				(let loop ((i 0))
+				  (when (< i %d)
+				    (kv-update! "n" slowly-incr 0)
+				    (loop (+ i 1))))
+				calls`, rounds))
+			if err != nil {
+				t.Error(err)
+			} else if got := v.SchemeString(); got != fmt.Sprint(rounds) {
+				t.Errorf("procedure called %s times for %d updates", got, rounds)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, _, err := store.Get("n"); err != nil || got != fmt.Sprint(engines*rounds) {
+		t.Errorf("n = %q, %v; want %d", got, err, engines*rounds)
+	}
+}
+
+func TestBatches(t *testing.T) {
+	engine := newEngine(t, New())
+	eval(t, engine, `
+		(kv-set-many! '(("host" . "db") ("port" . 5432)))
+		(define table (make-hashtable))
+		(hashtable-set! table "user" 'admin)
+		(kv-set-many! table)`)
+	check(t, engine,
+		`(equal? (kv-keys) '("host" "port" "user"))`,
+		`(= (kv-get "port") 5432)`,
+		`(eq? (kv-get "user") 'admin)`)
+
+	// Missing keys are omitted unless a default is given.
+	check(t, engine,
+		`(let ((h (kv-get-many '("host" "nobody"))))
+		   (and (= (hashtable-size h) 1) (equal? (hashtable-ref h "host" #f) "db")))`,
+		`(let ((h (kv-get-many '("host" "nobody") 'unset)))
+		   (and (= (hashtable-size h) 2) (eq? (hashtable-ref h "nobody" #f) 'unset)))`)
+
+	// A bad entry anywhere in a batch leaves the store unchanged.
+	checkRaises(t, engine, `(kv-set-many! '(("a" . 1) (2 . 2)))`, "not-a-string")
+	checkRaises(t, engine, `(kv-set-many! (list (cons "a" 1) (cons "b" (lambda () 1))))`, "not-serializable")
+	checkRaises(t, engine, `(kv-set-many! 5)`, "not-a-list")
+	checkRaises(t, engine, `(kv-delete-many! '("host" 1))`, "not-a-string")
+	check(t, engine,
+		`(equal? (kv-keys) '("host" "port" "user"))`,
+		`(= (kv-delete-many! '("host" "port" "nobody")) 2)`,
+		`(equal? (kv-keys) '("user"))`)
+}
+
+func TestBatchAtomic(t *testing.T) {
+	store := New(WithMaxEntries(3), WithEvictionPolicy(EvictLRU))
+	engine := newEngine(t, store)
+	eval(t, engine, `(kv-set! "a" 1)`)
+
+	// Making room evicts only keys the batch does not write, and a batch
+	// that cannot fit writes nothing.
+	eval(t, engine, `(kv-set-many! '(("b" . 2) ("c" . 3) ("d" . 4)))`)
+	check(t, engine, `(equal? (kv-keys) '("b" "c" "d"))`)
+	checkRaises(t, engine, `(kv-set-many! '(("1" . 1) ("2" . 2) ("3" . 3) ("4" . 4)))`, "quota-exceeded")
+	check(t, engine,
+		`(equal? (kv-keys) '("b" "c" "d"))`,
+		`(= (cdr (assq 'evictions (kv-stats))) 1)`)
+
+	// A failing backend write leaves the whole batch unapplied.
+	backend := &flakyBackend{MemoryBackend: NewMemoryBackend()}
+	engine = newEngine(t, New(WithBackend(backend)))
+	backend.failAt = 2
+	checkRaises(t, engine, `(kv-set-many! '(("x" . 1) ("y" . 2) ("z" . 3)))`, "storage")
+	check(t, engine, `(null? (kv-keys))`)
+}
+
+func TestScans(t *testing.T) {
+	engine := newEngine(t, New())
+	eval(t, engine, `(for-each (lambda (k) (kv-set! k k))
+	                           '("config/db/port" "config/app" "config/db/host" "configs" "a" "z"))`)
+	check(t, engine,
+		`(equal? (kv-keys) '("a" "config/app" "config/db/host" "config/db/port" "configs" "z"))`,
+		`(equal? (kv-keys-with-prefix "config/db/") '("config/db/host" "config/db/port"))`,
+		`(equal? (kv-keys-with-prefix "config/") '("config/app" "config/db/host" "config/db/port"))`,
+		`(equal? (kv-keys-with-prefix "nothing") '())`,
+		`(equal? (kv-range "config/" "config0") '(("config/app" . "config/app") ("config/db/host" . "config/db/host") ("config/db/port" . "config/db/port")))`,
+		`(equal? (map car (kv-range "b" "" 2)) '("config/app" "config/db/host"))`,
+		`(equal? (map car (kv-range "" "")) (kv-keys))`,
+		`(equal? (map car (kv-range-reverse "" "" 2)) '("z" "configs"))`,
+		`(equal? (map car (kv-range-reverse "config/" "configs")) '("config/db/port" "config/db/host" "config/app"))`,
+		`(null? (kv-range "m" "b"))`)
+
+	// Deleted keys leave the index.
+	eval(t, engine, `(kv-delete! "config/app")`)
+	check(t, engine, `(equal? (kv-keys-with-prefix "config/") '("config/db/host" "config/db/port"))`)
+}
@@ -0,0 +1,456 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aalpar/wile-extension-example/kvstore/internal/netserve"
+	"github.com/aalpar/wile/values"
+)
+
+// ErrReadOnlyReplica is returned by writes to a store that is following a
+// leader. Promote the follower to make the store writable again.
+var ErrReadOnlyReplica = values.NewStaticError("store is a read-only replica")
+
+// ErrAlreadyFollowing is returned by Follow if the store is already a
+// replica.
+var ErrAlreadyFollowing = values.NewStaticError("store is already following a leader")
+
+// ErrLeaderClosed is returned by Leader.Serve after Close.
+var ErrLeaderClosed = errors.New("kvstore: replication leader closed")
+
+// Replication timing. The leader sends a heartbeat when it has had nothing
+// else to send for heartbeatInterval; either side drops a connection that
+// has been silent or blocked for replicationTimeout.
+const (
+	heartbeatInterval  = time.Second
+	replicationTimeout = 3 * heartbeatInterval
+	maxRetryInterval   = 5 * time.Second
+	replicationBatch   = 256
+)
+
+// Replication frames. A follower opens a connection with a frameHello
+// carrying the epoch and revision it has applied up to. The leader answers
+// with a frameHello if it can resume from there, or with a snapshot
+// otherwise, and then streams its changes as they are made.
+const (
+	frameHello     = iota + 1 // Epoch and the leader's Rev
+	frameSnapshot             // a snapshot at Rev follows
+	frameEntry                // Key, Value and Expires of a snapshot entry
+	frameSnapEnd              // the snapshot is complete
+	frameChange               // one change: Op, Key, Value, Expires, Rev
+	frameHeartbeat            // the leader's current Rev
+)
+
+// frame is the unit of the replication protocol, sent gob-encoded over TCP.
+// Values are in the store's own encoding, so every datum kvstore can hold
+// replicates exactly.
+type frame struct {
+	Kind    int
+	Epoch   uint64
+	Rev     int64
+	Op      string
+	Key     string
+	Value   string
+	Expires time.Time
+}
+
+// writable returns ErrReadOnlyReplica if kv is following a leader.
+func (kv *KVStore) writable() error {
+	if kv.replica.Load() {
+		return ErrReadOnlyReplica
+	}
+	return nil
+}
+
+// dump returns the live entries of the store as snapshot frames, with the
+// revision they are current at.
+func (kv *KVStore) dump() ([]frame, int64, error) {
+	var entries []frame
+	var rev int64
+	err := kv.read(context.Background(), func(view) error {
+		// Every segment is held for reading, so no change can be
+		// recorded while the entries are copied.
+		rev = kv.changes.revision()
+		now := kv.now()
+		var err error
+		kv.index.ascend("", "", func(k string) bool {
+			var v version
+			if v, err = kv.current(k); err != nil {
+				return false
+			}
+			if v.visibleAt(now) {
+				entries = append(entries, frame{Kind: frameEntry, Key: k, Value: v.value, Expires: v.expires})
+			}
+			return true
+		})
+		return err
+	})
+	return entries, rev, err
+}
+
+// Leader serves a store's change feed to followers over TCP. Each follower
+// is sent the changes it has not applied, or a snapshot of the store if the
+// change feed no longer holds them; see WithChangeLogSize.
+type Leader struct {
+	store *KVStore
+	conns *netserve.Group
+}
+
+// NewLeader returns a leader for store. The leader does not own the store;
+// closing the leader leaves it open.
+func NewLeader(store *KVStore) *Leader {
+	return &Leader{store: store, conns: netserve.New(ErrLeaderClosed)}
+}
+
+// ListenAndServe listens on the TCP address addr and serves followers until
+// Close.
+func (l *Leader) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return l.Serve(ln)
+}
+
+// Serve accepts followers on ln until Close, which also closes ln. It always
+// returns a non-nil error, ErrLeaderClosed after Close.
+func (l *Leader) Serve(ln net.Listener) error {
+	return l.conns.Serve(ln, l.serveFollower)
+}
+
+// Close stops every listener and disconnects every follower.
+func (l *Leader) Close() error {
+	return l.conns.Close()
+}
+
+// serveFollower streams changes to the follower on c until either side
+// closes the connection or the store is closed.
+func (l *Leader) serveFollower(c net.Conn) {
+	var hello frame
+	c.SetReadDeadline(time.Now().Add(replicationTimeout))
+	if err := gob.NewDecoder(bufio.NewReader(c)).Decode(&hello); err != nil || hello.Kind != frameHello {
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	bw := bufio.NewWriter(c)
+	enc := gob.NewEncoder(bw)
+	send := func(f frame) error {
+		c.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		return enc.Encode(f)
+	}
+	flush := func() error {
+		c.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		return bw.Flush()
+	}
+
+	kv := l.store
+	epoch := kv.changes.epoch.Load()
+	rev := hello.Rev
+	resume := hello.Epoch == epoch
+	if resume {
+		_, _, resume = kv.changes.since(rev, 1)
+	}
+	if resume {
+		if send(frame{Kind: frameHello, Epoch: epoch, Rev: kv.Revision()}) != nil {
+			return
+		}
+	} else if rev = l.sendSnapshot(send); rev < 0 {
+		return
+	}
+
+	heartbeat := time.NewTimer(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		batch, wake, ok := kv.changes.since(rev, replicationBatch)
+		switch {
+		case !ok:
+			// The follower fell behind the change feed.
+			if rev = l.sendSnapshot(send); rev < 0 {
+				return
+			}
+			continue
+		case len(batch) > 0:
+			for _, ch := range batch {
+				f := frame{Kind: frameChange, Rev: ch.rev, Op: ch.op, Key: ch.key, Value: ch.new, Expires: ch.expires}
+				if send(f) != nil {
+					return
+				}
+				rev = ch.rev
+			}
+			continue
+		}
+		if flush() != nil || wake == nil {
+			return
+		}
+		heartbeat.Reset(heartbeatInterval)
+		select {
+		case <-wake:
+		case <-l.conns.Done():
+			return
+		case <-heartbeat.C:
+			if send(frame{Kind: frameHeartbeat, Rev: kv.Revision()}) != nil {
+				return
+			}
+		}
+	}
+}
+
+// sendSnapshot sends the store's entries and returns the revision they are
+// current at, or -1 if the follower could not be sent them.
+func (l *Leader) sendSnapshot(send func(frame) error) int64 {
+	entries, rev, err := l.store.dump()
+	if err != nil || send(frame{Kind: frameSnapshot, Epoch: l.store.changes.epoch.Load(), Rev: rev}) != nil {
+		return -1
+	}
+	for _, f := range entries {
+		if send(f) != nil {
+			return -1
+		}
+	}
+	if send(frame{Kind: frameSnapEnd, Rev: rev}) != nil {
+		return -1
+	}
+	return rev
+}
+
+// ReplicationStatus describes a follower's progress. Revisions are the
+// leader's.
+type ReplicationStatus struct {
+	Leader         string    // the leader's address
+	Connected      bool      // whether the follower is connected to it
+	Applied        int64     // the last revision applied
+	LeaderRevision int64     // the latest revision the leader has reported
+	Resyncs        int       // snapshots loaded, including the first
+	LastContact    time.Time // when the leader was last heard from
+	Err            error     // why the last connection ended, if it did
+}
+
+// Lag returns how many of the leader's changes the follower has yet to
+// apply.
+func (s ReplicationStatus) Lag() int64 {
+	return max(s.LeaderRevision-s.Applied, 0)
+}
+
+// Follower keeps a store a replica of a leader's, applying the leader's
+// changes in revision order. It reconnects when the connection is lost,
+// resuming where it left off, and reloads the store from a snapshot when
+// the leader can no longer send the changes it missed.
+type Follower struct {
+	store  *KVStore
+	addr   string
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	status ReplicationStatus
+	epoch  uint64
+}
+
+// Follow makes store a replica of the leader serving at addr. Writes to the
+// store fail with ErrReadOnlyReplica until the follower is promoted; its
+// contents are replaced by the leader's when the first snapshot arrives.
+// Expiry deadlines are replicated as absolute times, so the two processes'
+// clocks should agree.
+func Follow(store *KVStore, addr string) (*Follower, error) {
+	if !store.replica.CompareAndSwap(false, true) {
+		return nil, ErrAlreadyFollowing
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Follower{
+		store:  store,
+		addr:   addr,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		status: ReplicationStatus{Leader: addr},
+	}
+	go f.run(ctx)
+	return f, nil
+}
+
+// Status returns the follower's progress.
+func (f *Follower) Status() ReplicationStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// Lag returns how many of the leader's changes the follower has yet to
+// apply.
+func (f *Follower) Lag() int64 {
+	return f.Status().Lag()
+}
+
+// Close stops following. The store remains a read-only replica holding
+// what it last applied.
+func (f *Follower) Close() error {
+	f.cancel()
+	<-f.done
+	return nil
+}
+
+// Promote stops following and makes the store writable, so that it can
+// take over from the leader.
+func (f *Follower) Promote() {
+	f.Close()
+	f.store.replica.Store(false)
+}
+
+// run connects to the leader until ctx is cancelled, waiting longer after
+// each attempt that fails to connect.
+func (f *Follower) run(ctx context.Context) {
+	defer close(f.done)
+	const minRetry = 50 * time.Millisecond
+	retry := minRetry
+	for {
+		err := f.session(ctx)
+		f.mu.Lock()
+		connected := f.status.Connected
+		if connected {
+			retry = minRetry
+		}
+		f.status.Connected = false
+		f.status.Err = err
+		f.mu.Unlock()
+		switch {
+		case ctx.Err() != nil:
+		case connected:
+			f.store.logger.Warn("replication interrupted", "leader", f.addr, "err", err)
+		default:
+			f.store.logger.Debug("connect to leader", "leader", f.addr, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(2*retry, maxRetryInterval)
+	}
+}
+
+// session replicates over one connection until it fails or ctx is done.
+func (f *Follower) session(ctx context.Context) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", f.addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	f.mu.Lock()
+	hello := frame{Kind: frameHello, Epoch: f.epoch, Rev: f.status.Applied}
+	f.mu.Unlock()
+	c.SetWriteDeadline(time.Now().Add(replicationTimeout))
+	if err := gob.NewEncoder(c).Encode(hello); err != nil {
+		return err
+	}
+
+	dec := gob.NewDecoder(bufio.NewReader(c))
+	var snap []frame
+	var snapEpoch uint64
+	for {
+		var fr frame
+		c.SetReadDeadline(time.Now().Add(replicationTimeout))
+		if err := dec.Decode(&fr); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		f.mu.Lock()
+		f.status.Connected = true
+		f.status.LastContact = time.Now()
+		applied := f.status.Applied
+		f.mu.Unlock()
+
+		switch fr.Kind {
+		case frameHello, frameHeartbeat:
+			f.progress(applied, fr.Rev)
+		case frameSnapshot:
+			snap, snapEpoch = snap[:0], fr.Epoch
+		case frameEntry:
+			snap = append(snap, fr)
+		case frameSnapEnd:
+			if err := f.store.load(snap); err != nil {
+				return err
+			}
+			f.mu.Lock()
+			f.epoch = snapEpoch
+			f.status.Resyncs++
+			f.mu.Unlock()
+			f.progress(fr.Rev, fr.Rev)
+			snap = nil
+		case frameChange:
+			if fr.Rev != applied+1 {
+				return fmt.Errorf("replication: got revision %d after %d", fr.Rev, applied)
+			}
+			if err := f.store.apply(fr); err != nil {
+				return err
+			}
+			f.progress(fr.Rev, fr.Rev)
+		default:
+			return errors.New("replication: unknown frame " + strconv.Itoa(fr.Kind))
+		}
+	}
+}
+
+// progress records that the follower has applied up to applied and the
+// leader has reached at least leaderRev.
+func (f *Follower) progress(applied, leaderRev int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status.Applied = applied
+	f.status.LeaderRevision = max(f.status.LeaderRevision, leaderRev)
+}
+
+// load replaces the contents of the store with a snapshot's entries in one
+// step.
+func (kv *KVStore) load(entries []frame) error {
+	return kv.mutate(context.Background(), func(sv *storeView) error {
+		if err := sv.clear(); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := sv.replay(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// apply makes one change received from the leader.
+func (kv *KVStore) apply(fr frame) error {
+	return kv.mutate(context.Background(), func(sv *storeView) error {
+		switch fr.Op {
+		case opSet:
+			return sv.replay(fr)
+		case opClear:
+			return sv.clear()
+		default:
+			return sv.remove(fr.Key, fr.Op)
+		}
+	})
+}
+
+// replay stores a replicated entry with the leader's deadline. An entry
+// whose deadline has already passed is removed as expired.
+func (sv *storeView) replay(fr frame) error {
+	var ttl time.Duration
+	if !fr.Expires.IsZero() {
+		if ttl = fr.Expires.Sub(sv.now()); ttl <= 0 {
+			return sv.remove(fr.Key, opExpire)
+		}
+	}
+	return sv.set(fr.Key, fr.Value, ttl)
+}
@@ -0,0 +1,170 @@
+package kvstore
+
+import (
+	"errors"
+	"maps"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// lead serves store's changes on addr, or on a new localhost port if addr
+// is empty, and returns the leader and its address.
+func lead(t *testing.T, store *KVStore, addr string) (*Leader, string) {
+	t.Helper()
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLeader(store)
+	done := make(chan error, 1)
+	go func() { done <- l.Serve(ln) }()
+	t.Cleanup(func() {
+		l.Close()
+		if err := <-done; !errors.Is(err, ErrLeaderClosed) {
+			t.Errorf("Serve returned %v, want ErrLeaderClosed", err)
+		}
+	})
+	return l, ln.Addr().String()
+}
+
+// follow makes a new store follow the leader at addr.
+func follow(t *testing.T, addr string) (*KVStore, *Follower) {
+	t.Helper()
+	store := New()
+	f, err := Follow(store, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		store.close()
+	})
+	return store, f
+}
+
+// waitFor fails the test if cond does not hold within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// caughtUp reports whether f has applied every change made to leader.
+func caughtUp(leader *KVStore, f *Follower) func() bool {
+	return func() bool { return f.Status().Applied == leader.Revision() }
+}
+
+func contents(t *testing.T, kv *KVStore) map[string]string {
+	t.Helper()
+	m := make(map[string]string)
+	for k, v := range kv.All() {
+		m[k] = v
+	}
+	return m
+}
+
+func TestReplication(t *testing.T) {
+	leader := New()
+	t.Cleanup(func() { leader.close() })
+	leader.Set("before", "snapshot")
+	_, addr := lead(t, leader, "")
+	replica, f := follow(t, addr)
+
+	waitFor(t, "initial snapshot", caughtUp(leader, f))
+	if got, _, _ := replica.Get("before"); got != "snapshot" {
+		t.Errorf("before = %q, want snapshot", got)
+	}
+
+	leader.Set("a", "1")
+	leader.SetWithTTL("b", "2", time.Hour)
+	leader.Set("c", "3")
+	leader.Delete("a")
+	leader.Set("c", "4")
+	waitFor(t, "changes", caughtUp(leader, f))
+
+	want := map[string]string{"before": "snapshot", "b": "2", "c": "4"}
+	if got := contents(t, replica); !maps.Equal(got, want) {
+		t.Errorf("replica = %v, want %v", got, want)
+	}
+	if ttl, _, _ := replica.TTL("b"); ttl <= 59*time.Minute {
+		t.Errorf("replicated TTL = %v, want about an hour", ttl)
+	}
+	if st := f.Status(); st.Lag() != 0 || !st.Connected || st.Resyncs != 1 {
+		t.Errorf("status = %+v, want connected with no lag and one resync", st)
+	}
+
+	leader.Clear()
+	waitFor(t, "clear", caughtUp(leader, f))
+	if n := replica.Len(); n != 0 {
+		t.Errorf("replica has %d keys after clear", n)
+	}
+
+	if err := replica.Set("local", "x"); !errors.Is(err, ErrReadOnlyReplica) {
+		t.Errorf("Set on replica = %v, want ErrReadOnlyReplica", err)
+	}
+	if _, err := Follow(replica, addr); !errors.Is(err, ErrAlreadyFollowing) {
+		t.Errorf("second Follow = %v, want ErrAlreadyFollowing", err)
+	}
+	f.Promote()
+	if err := replica.Set("local", "x"); err != nil {
+		t.Errorf("Set after Promote = %v", err)
+	}
+	if f.Status().Connected {
+		t.Error("follower still connected after Promote")
+	}
+
+	// Promote has stopped the follower, so once another follower has
+	// received a later change, the promoted store cannot have applied it.
+	_, g := follow(t, addr)
+	leader.Set("after", "promotion")
+	waitFor(t, "second follower", caughtUp(leader, g))
+	if _, found, _ := replica.Get("after"); found {
+		t.Error("promoted store still applies the leader's changes")
+	}
+}
+
+func TestReplicationReconnect(t *testing.T) {
+	leader := New(WithChangeLogSize(4))
+	t.Cleanup(func() { leader.close() })
+	l, addr := lead(t, leader, "")
+	replica, f := follow(t, addr)
+	leader.Set("k0", "v")
+	waitFor(t, "initial sync", caughtUp(leader, f))
+
+	// A follower that missed fewer changes than the feed holds resumes.
+	l.Close()
+	waitFor(t, "disconnect", func() bool { return !f.Status().Connected })
+	leader.Set("k1", "v")
+	leader.Set("k2", "v")
+	l, _ = lead(t, leader, addr)
+	waitFor(t, "resume", caughtUp(leader, f))
+	if n := f.Status().Resyncs; n != 1 {
+		t.Errorf("resyncs after resume = %d, want 1", n)
+	}
+
+	// One that missed more is sent a snapshot.
+	l.Close()
+	waitFor(t, "disconnect", func() bool { return !f.Status().Connected })
+	for _, k := range []string{"k3", "k4", "k5", "k6", "k7", "k8"} {
+		leader.Set(k, "v")
+	}
+	leader.Delete("k0")
+	lead(t, leader, addr)
+	waitFor(t, "resync", caughtUp(leader, f))
+	if n := f.Status().Resyncs; n != 2 {
+		t.Errorf("resyncs after falling behind = %d, want 2", n)
+	}
+	if got, want := replica.Keys(), leader.Keys(); !slices.Equal(got, want) {
+		t.Errorf("replica keys = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,40 @@
+package resp
+
+import (
+	"bufio"
+	"net"
+	"time"
+)
+
+// Client is a minimal RESP2 client, enough to drive a Server from tests and
+// tools. It sends one command at a time and is not safe for concurrent use.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    writer
+}
+
+// Dial connects to the server at the TCP address addr.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, r: bufio.NewReader(conn), w: newWriter(conn)}, nil
+}
+
+// Do sends a command and returns its reply: a string for a simple or bulk
+// string, an int64 for an integer, []any for an array and nil for a null.
+// An error reply is returned as an Error.
+func (c *Client) Do(args ...string) (any, error) {
+	c.w.array(args)
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,233 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aalpar/wile-extension-example/kvstore"
+)
+
+// command is a handler and its arity, counting the command name: n means
+// exactly n arguments, -n at least n.
+type command struct {
+	arity int
+	run   func(s *Server, args []string, w writer)
+}
+
+var commands = map[string]command{
+	"ping":    {-1, cmdPing},
+	"get":     {2, cmdGet},
+	"set":     {-3, cmdSet},
+	"del":     {-2, cmdDel},
+	"keys":    {2, cmdKeys},
+	"dbsize":  {1, cmdDBSize},
+	"flushdb": {-1, cmdFlushDB},
+	"expire":  {3, cmdExpire},
+	"pexpire": {3, cmdExpire},
+	"ttl":     {2, cmdTTL},
+	"pttl":    {2, cmdTTL},
+	"quit":    {1, cmdQuit},
+}
+
+// exec runs one command and writes its reply, reporting whether the client
+// asked to disconnect.
+func (s *Server) exec(args []string, w writer) (quit bool) {
+	name := strings.ToLower(args[0])
+	cmd, ok := commands[name]
+	switch {
+	case !ok:
+		w.errorReply(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	case cmd.arity >= 0 && len(args) != cmd.arity,
+		cmd.arity < 0 && len(args) < -cmd.arity:
+		w.errorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return false
+	}
+	cmd.run(s, args, w)
+	return name == "quit"
+}
+
+// storeError replies with an error from the store. Writes to a replica get
+// the READONLY error Redis replicas send.
+func storeError(w writer, err error) {
+	if errors.Is(err, kvstore.ErrReadOnlyReplica) {
+		w.errorReply("READONLY " + err.Error())
+		return
+	}
+	w.errorReply("ERR " + err.Error())
+}
+
+// PING [message]
+func cmdPing(_ *Server, args []string, w writer) {
+	switch len(args) {
+	case 1:
+		w.simple("PONG")
+	case 2:
+		w.bulk(args[1])
+	default:
+		w.errorReply("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+// GET key
+func cmdGet(s *Server, args []string, w writer) {
+	val, found, err := s.store.Get(args[1])
+	switch {
+	case err != nil:
+		storeError(w, err)
+	case !found:
+		w.null()
+	default:
+		w.bulk(val)
+	}
+}
+
+// SET key value [EX seconds | PX milliseconds]
+func cmdSet(s *Server, args []string, w writer) {
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		unit := time.Duration(0)
+		switch strings.ToLower(args[i]) {
+		case "ex":
+			unit = time.Second
+		case "px":
+			unit = time.Millisecond
+		}
+		if unit == 0 || ttl != 0 || i+1 == len(args) {
+			w.errorReply("ERR syntax error")
+			return
+		}
+		i++
+		n, err := strconv.ParseInt(args[i], 10, 64)
+		if err != nil {
+			w.errorReply("ERR value is not an integer or out of range")
+			return
+		}
+		if ttl = expireTime(n, unit); ttl <= 0 {
+			w.errorReply("ERR invalid expire time in 'set' command")
+			return
+		}
+	}
+	var err error
+	if ttl > 0 {
+		err = s.store.SetWithTTL(args[1], args[2], ttl)
+	} else {
+		err = s.store.Set(args[1], args[2])
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	w.simple("OK")
+}
+
+// DEL key [key ...]
+func cmdDel(s *Server, args []string, w writer) {
+	n, err := s.store.DeleteMany(args[1:]...)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	w.integer(int64(n))
+}
+
+// KEYS pattern
+func cmdKeys(s *Server, args []string, w writer) {
+	var keys []string
+	for _, k := range s.store.Keys() {
+		if match(args[1], k) {
+			keys = append(keys, k)
+		}
+	}
+	w.array(keys)
+}
+
+// DBSIZE
+func cmdDBSize(s *Server, _ []string, w writer) {
+	w.integer(int64(s.store.Len()))
+}
+
+// FLUSHDB [ASYNC | SYNC]
+func cmdFlushDB(s *Server, args []string, w writer) {
+	if len(args) > 2 || len(args) == 2 &&
+		!strings.EqualFold(args[1], "async") && !strings.EqualFold(args[1], "sync") {
+		w.errorReply("ERR syntax error")
+		return
+	}
+	if err := s.store.Clear(); err != nil {
+		storeError(w, err)
+		return
+	}
+	w.simple("OK")
+}
+
+// EXPIRE key seconds, PEXPIRE key milliseconds. A TTL of zero or less
+// deletes the key, as in Redis.
+func cmdExpire(s *Server, args []string, w writer) {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		w.errorReply("ERR value is not an integer or out of range")
+		return
+	}
+	unit := time.Second
+	if strings.EqualFold(args[0], "pexpire") {
+		unit = time.Millisecond
+	}
+	if n > 0 && expireTime(n, unit) <= 0 {
+		w.errorReply("ERR invalid expire time in '" + strings.ToLower(args[0]) + "' command")
+		return
+	}
+	var found bool
+	if n <= 0 {
+		var deleted int
+		deleted, err = s.store.DeleteMany(args[1])
+		found = deleted > 0
+	} else {
+		found, err = s.store.Expire(args[1], expireTime(n, unit))
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if found {
+		w.integer(1)
+	} else {
+		w.integer(0)
+	}
+}
+
+// TTL key, PTTL key: the time left in seconds or milliseconds, -1 if the key
+// has no TTL and -2 if it does not exist.
+func cmdTTL(s *Server, args []string, w writer) {
+	ttl, found, err := s.store.TTL(args[1])
+	switch {
+	case err != nil:
+		storeError(w, err)
+	case !found:
+		w.integer(-2)
+	case ttl < 0:
+		w.integer(-1)
+	case strings.EqualFold(args[0], "pttl"):
+		w.integer(ttl.Milliseconds())
+	default:
+		w.integer(int64((ttl + 500*time.Millisecond) / time.Second))
+	}
+}
+
+// expireTime returns n units as a duration, or zero if n is not positive
+// or the duration would overflow.
+func expireTime(n int64, unit time.Duration) time.Duration {
+	if n <= 0 || n > math.MaxInt64/int64(unit) {
+		return 0
+	}
+	return time.Duration(n) * unit
+}
+
+// QUIT
+func cmdQuit(_ *Server, _ []string, w writer) {
+	w.simple("OK")
+}
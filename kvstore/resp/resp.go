@@ -0,0 +1,204 @@
+// Package resp serves a kvstore.KVStore over RESP2, the Redis serialization
+// protocol, so that redis-cli and Redis client libraries can inspect and
+// change a live store.
+//
+// The server understands the commands needed to browse and edit a store:
+// PING, GET, SET (with EX or PX), DEL, KEYS, DBSIZE, FLUSHDB, EXPIRE,
+// PEXPIRE, TTL, PTTL and QUIT. Values are exchanged as strings; a value
+// stored from Scheme that is not a string is returned in its written form.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxBulkLen bounds a single argument, maxArgs the number of arguments
+	// in one command and maxLineLen an inline command or header line, so a
+	// bad client cannot make the server allocate without limit.
+	maxBulkLen = 64 << 20
+	maxArgs    = 1 << 20
+	maxLineLen = 64 << 10
+)
+
+// Error is an error reply, such as "ERR unknown command 'foo'".
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// protocolError reports input that is not valid RESP. The server answers it
+// with an error reply and closes the connection.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// readCommand reads one command, either an array of bulk strings or an
+// inline command line as typed into telnet. An empty inline line yields no
+// arguments.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+	args := make([]string, 0, min(max(n, 0), 64))
+	for range n {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%.1s'", line))
+		}
+		arg, err := readBulk(r, line[1:])
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// readLine reads a line terminated by CRLF, or by a bare LF from an inline
+// client, without the terminator. A line longer than maxLineLen is a
+// protocol error.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineLen {
+			return "", protocolError("line too long")
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return strings.TrimSuffix(string(line[:len(line)-1]), "\r"), nil
+	}
+}
+
+// readBulk reads the body of a bulk string whose header gave size.
+func readBulk(r *bufio.Reader, size string) (string, error) {
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 || n > maxBulkLen {
+		return "", protocolError("invalid bulk length")
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", protocolError("bulk string not terminated by CRLF")
+	}
+	return string(buf[:n]), nil
+}
+
+// writer encodes replies. Errors are sticky in the underlying bufio.Writer
+// and surface from Flush.
+type writer struct {
+	*bufio.Writer
+}
+
+func newWriter(w io.Writer) writer {
+	return writer{bufio.NewWriter(w)}
+}
+
+func (w writer) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w writer) errorReply(msg string) {
+	w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(msg) + "\r\n")
+}
+
+func (w writer) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w writer) bulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w writer) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) array(ss []string) {
+	w.WriteString("*" + strconv.Itoa(len(ss)) + "\r\n")
+	for _, s := range ss {
+		w.bulk(s)
+	}
+}
+
+// readReply decodes one reply: a string for a simple or bulk string, an
+// int64 for an integer, []any for an array and nil for a null. An error
+// reply is returned as an Error.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, protocolError("empty reply")
+	}
+	switch body := line[1:]; line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, Error(body)
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, protocolError("invalid integer reply")
+		}
+		return n, nil
+	case '$':
+		if body == "-1" {
+			return nil, nil
+		}
+		return readBulk(r, body)
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > maxArgs {
+			return nil, protocolError("invalid array length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				var e Error
+				if !errors.As(err, &e) {
+					return nil, err
+				}
+				items[i] = e
+			}
+		}
+		return items, nil
+	}
+	return nil, protocolError(fmt.Sprintf("unknown reply type '%c'", line[0]))
+}
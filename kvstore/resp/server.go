@@ -0,0 +1,80 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+
+	"github.com/aalpar/wile-extension-example/kvstore"
+	"github.com/aalpar/wile-extension-example/kvstore/internal/netserve"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close.
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server serves one store to any number of RESP clients. Commands from a
+// connection run in order; commands from different connections run
+// concurrently, with the store's own locking.
+type Server struct {
+	store *kvstore.KVStore
+	conns *netserve.Group
+}
+
+// NewServer returns a server for store. The server does not own the store;
+// closing the server leaves it open.
+func NewServer(store *kvstore.KVStore) *Server {
+	return &Server{store: store, conns: netserve.New(ErrServerClosed)}
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients until
+// Close.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts clients on l until Close, which also closes l. It always
+// returns a non-nil error, ErrServerClosed after Close.
+func (s *Server) Serve(l net.Listener) error {
+	return s.conns.Serve(l, s.serveConn)
+}
+
+// Close stops every listener, disconnects every client and waits for the
+// commands in progress to finish.
+func (s *Server) Close() error {
+	return s.conns.Close()
+}
+
+// serveConn reads and runs commands from c until it disconnects, sends
+// QUIT or breaks the protocol. Replies are flushed once no further
+// pipelined command is waiting.
+func (s *Server) serveConn(c net.Conn) {
+	r := bufio.NewReader(c)
+	w := newWriter(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				w.errorReply("ERR " + perr.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.exec(args, w)
+		if quit || r.Buffered() == 0 {
+			if w.Flush() != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aalpar/wile-extension-example/kvstore"
+)
+
+// serve starts a server for a new store on a localhost port and returns a
+// client connected to it.
+func serve(t *testing.T) (*kvstore.KVStore, *Client) {
+	t.Helper()
+	store := kvstore.New()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(store)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(l) }()
+	c, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		if err := srv.Close(); err != nil {
+			t.Error(err)
+		}
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+		store.Close()
+	})
+	return store, c
+}
+
+func TestCommands(t *testing.T) {
+	store, c := serve(t)
+	if err := store.Set("from-go", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		args []string
+		want any
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"ping", "hi"}, "hi"},
+		{[]string{"GET", "from-go"}, "hello"},
+		{[]string{"GET", "missing"}, nil},
+		{[]string{"SET", "user:1", "alice"}, "OK"},
+		{[]string{"SET", "user:2", "bob", "EX", "100"}, "OK"},
+		{[]string{"SET", "user:10", "carol"}, "OK"},
+		{[]string{"DBSIZE"}, int64(4)},
+		{[]string{"KEYS", "user:?"}, []any{"user:1", "user:2"}},
+		{[]string{"KEYS", "*"}, []any{"from-go", "user:1", "user:10", "user:2"}},
+		{[]string{"TTL", "user:2"}, int64(100)},
+		{[]string{"TTL", "user:1"}, int64(-1)},
+		{[]string{"TTL", "missing"}, int64(-2)},
+		{[]string{"EXPIRE", "user:1", "50"}, int64(1)},
+		{[]string{"EXPIRE", "missing", "50"}, int64(0)},
+		{[]string{"TTL", "user:1"}, int64(50)},
+		{[]string{"PEXPIRE", "user:10", "0"}, int64(1)},
+		{[]string{"DEL", "user:1", "user:2", "missing"}, int64(2)},
+		{[]string{"DBSIZE"}, int64(1)},
+		{[]string{"FLUSHDB"}, "OK"},
+		{[]string{"DBSIZE"}, int64(0)},
+	}
+	for _, step := range steps {
+		got, err := c.Do(step.args...)
+		if err != nil {
+			t.Fatalf("%v: %v", step.args, err)
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%v = %#v, want %#v", step.args, got, step.want)
+		}
+	}
+	if _, found, _ := store.Get("user:1"); found {
+		t.Error("DEL through the server did not reach the store")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, c := serve(t)
+	for _, args := range [][]string{
+		{"NOSUCH"},
+		{"GET"},
+		{"SET", "k", "v", "EX"},
+		{"SET", "k", "v", "EX", "0"},
+		{"EXPIRE", "k", "soon"},
+	} {
+		_, err := c.Do(args...)
+		var e Error
+		if !errors.As(err, &e) {
+			t.Errorf("%v: got %v, want an error reply", args, err)
+		}
+	}
+	// The connection survives error replies.
+	if got, err := c.Do("PING"); err != nil || got != "PONG" {
+		t.Errorf("PING after errors = %v, %v", got, err)
+	}
+}
+
+func TestLineLimit(t *testing.T) {
+	long := strings.Repeat("a", maxLineLen)
+	for _, input := range []string{
+		"GET " + long,
+		"*" + long,
+		"*1\r\n$" + long,
+	} {
+		_, err := readCommand(bufio.NewReader(strings.NewReader(input)))
+		var perr protocolError
+		if !errors.As(err, &perr) {
+			t.Errorf("%.10q...: got %v, want a protocol error", input, err)
+		}
+	}
+	if args, err := readCommand(bufio.NewReader(strings.NewReader("SET k " + long[:maxLineLen-8] + "\r\n"))); err != nil || len(args) != 3 {
+		t.Errorf("a line at the limit = %d args, %v", len(args), err)
+	}
+
+	// The server answers a line that never ends with an error and hangs up
+	// once it has read a buffer past the limit.
+	_, c := serve(t)
+	conn, err := net.Dial("tcp", c.conn.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(long + strings.Repeat("a", 4096))); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(reply, "-ERR Protocol error: line too long") {
+		t.Errorf("reply %q, %v; want a protocol error", reply, err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:42", true},
+		{"user:*", "users", false},
+		{"h?llo", "hallo", true},
+		{"h[ae]llo", "hello", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"*a*b", "xxaxxb", true},
+	} {
+		if got := match(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
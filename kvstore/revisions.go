@@ -0,0 +1,124 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aalpar/wile/values"
+)
+
+// ErrRevisionMismatch is returned by SetIf and DeleteIf when the key's
+// revision is not the one required.
+var ErrRevisionMismatch = values.NewStaticError("revision mismatch")
+
+// Conditions for SetIf and DeleteIf besides a specific revision.
+const (
+	// AnyRevision matches whether or not the key is present.
+	AnyRevision int64 = -1
+	// NoRevision matches only a key that is not present.
+	NoRevision int64 = -2
+)
+
+// revision returns the revision of the change that last wrote key, or 0 if
+// it has not been written since the store was opened. Callers hold key's
+// segment.
+func (kv *KVStore) revision(key string) int64 {
+	return kv.segment(key).revs[key]
+}
+
+// Entry is a key's value as returned by Lookup, with the revision of the
+// change that last wrote it and its expiry. Keys loaded from a durable
+// backend and not written since have revision 0. Revisions restart when the
+// store is reopened, so Epoch tells which run of revisions Revision is from.
+type Entry struct {
+	Value    string
+	Revision int64
+	Epoch    uint64
+	Expires  time.Time // zero if the key has no TTL
+}
+
+// Lookup is Get that also returns key's revision and expiry, all read at
+// once.
+func (kv *KVStore) Lookup(key string) (Entry, bool, error) {
+	var val string
+	var e Entry
+	var found bool
+	err := kv.readKey(context.Background(), key, func(v view) error {
+		var err error
+		val, found, err = v.get(key)
+		e.Revision, e.Epoch = kv.revision(key), kv.Epoch()
+		e.Expires, _ = v.expiry(key)
+		return err
+	})
+	if err != nil || !found {
+		return Entry{}, false, err
+	}
+	if e.Value, err = displayValue(val); err != nil {
+		return Entry{}, false, err
+	}
+	return e, true, nil
+}
+
+// SetIf stores value under key if the key's revision is rev, or if rev is
+// AnyRevision or NoRevision and the key's presence matches, and returns the
+// new revision. A positive ttl makes the key expire; zero clears any TTL.
+// Otherwise it fails with ErrRevisionMismatch and leaves the key unchanged.
+func (kv *KVStore) SetIf(key, value string, ttl time.Duration, rev int64) (int64, error) {
+	if ttl < 0 {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidTTL, ttl)
+	}
+	var newRev int64
+	err := kv.writeKey(context.Background(), key, func(v view) error {
+		if err := kv.checkRevision(v, key, rev); err != nil {
+			return err
+		}
+		if err := v.set(key, encodeString(value), ttl); err != nil {
+			return err
+		}
+		newRev = kv.revision(key)
+		return nil
+	})
+	return newRev, err
+}
+
+// DeleteIf removes key under the same conditions as SetIf, reporting
+// whether it was present.
+func (kv *KVStore) DeleteIf(key string, rev int64) (bool, error) {
+	var found bool
+	err := kv.writeKey(context.Background(), key, func(v view) error {
+		if err := kv.checkRevision(v, key, rev); err != nil {
+			return err
+		}
+		var err error
+		if _, found, err = v.get(key); err != nil || !found {
+			return err
+		}
+		return v.delete(key)
+	})
+	return found, err
+}
+
+// checkRevision fails with ErrRevisionMismatch unless key meets the
+// condition rev.
+func (kv *KVStore) checkRevision(v view, key string, rev int64) error {
+	if rev == AnyRevision {
+		return nil
+	}
+	_, found, err := v.get(key)
+	if err != nil {
+		return err
+	}
+	cur := kv.revision(key)
+	switch {
+	case rev == NoRevision && found:
+		return keyError(key, fmt.Errorf("%w: key %q is present at revision %d", ErrRevisionMismatch, key, cur))
+	case rev == NoRevision:
+		return nil
+	case !found:
+		return keyError(key, fmt.Errorf("%w: key %q is not present", ErrRevisionMismatch, key))
+	case cur != rev:
+		return keyError(key, fmt.Errorf("%w: key %q is at revision %d, not %d", ErrRevisionMismatch, key, cur, rev))
+	}
+	return nil
+}
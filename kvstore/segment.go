@@ -0,0 +1,80 @@
+package kvstore
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// defaultShards is the number of segments a store is split into unless
+// WithShards says otherwise.
+const defaultShards = 64
+
+// segment holds the per-key state of the keys that hash to it, and the lock
+// that orders operations on them.
+//
+// An operation on a single key holds kv.mu for reading and the key's
+// segment lock for reading or writing, so operations on keys in different
+// segments run in parallel. An operation that reads many keys, such as
+// kv-keys, holds kv.mu and every segment lock for reading and so sees no
+// write in progress. An operation that changes many keys at once, such as
+// kv-clear! or a transaction, holds kv.mu for writing and needs no segment
+// locks.
+type segment struct {
+	mu sync.RWMutex
+
+	// Expiry deadlines for keys set with a TTL, loaded from the backend
+	// if it is an ExpiringBackend.
+	expires map[string]time.Time
+
+	// Key usage tracked to choose what to evict.
+	usage map[string]*usage
+
+	// Revision of the change that last wrote each key. Keys loaded from a
+	// durable backend and not written since have none.
+	revs map[string]int64
+}
+
+func newSegments(n int) []segment {
+	segs := make([]segment, max(n, 1))
+	for i := range segs {
+		segs[i].expires = make(map[string]time.Time)
+		segs[i].revs = make(map[string]int64)
+	}
+	return segs
+}
+
+// segment returns the segment key hashes to.
+func (kv *KVStore) segment(key string) *segment {
+	return &kv.segments[maphash.String(kv.seed, key)%uint64(len(kv.segments))]
+}
+
+// rlockSegments acquires every segment lock for reading, in order. Callers
+// hold kv.mu for reading.
+func (kv *KVStore) rlockSegments() {
+	for i := range kv.segments {
+		seg := &kv.segments[i]
+		kv.acquire(seg.mu.TryRLock, seg.mu.RLock)
+	}
+}
+
+func (kv *KVStore) runlockSegments() {
+	for i := range kv.segments {
+		kv.segments[i].mu.RUnlock()
+	}
+}
+
+// lockSegment acquires kv.mu for reading and seg for writing. It fails as
+// rlock does.
+func (kv *KVStore) lockSegment(seg *segment) error {
+	if err := kv.rlock(); err != nil {
+		return err
+	}
+	kv.acquire(seg.mu.TryLock, seg.mu.Lock)
+	return nil
+}
+
+func (kv *KVStore) unlockSegment(seg *segment) {
+	seg.mu.Unlock()
+	kv.mu.RUnlock()
+}
@@ -0,0 +1,312 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aalpar/wile/values"
+)
+
+// ErrSnapshotReleased is returned when a snapshot is read after Release.
+var ErrSnapshotReleased = values.NewStaticError("snapshot released")
+
+// ErrNotASnapshot is returned when a kv-snapshot-* primitive is given
+// something other than a snapshot from kv-snapshot.
+var ErrNotASnapshot = values.NewStaticError("not a kv-snapshot")
+
+// version is a value of a key as it was up to revision rev, when it was
+// overwritten, deleted or cleared. present is false if the key was absent.
+type version struct {
+	rev     int64
+	value   string
+	present bool
+	expires time.Time
+}
+
+// size is the number of bytes the version contributes to Stats.Bytes as the
+// value of key.
+func (v version) size(key string) int64 {
+	if !v.present {
+		return 0
+	}
+	return storedSize(key, v.value)
+}
+
+// visibleAt reports whether the key held a live value at time t.
+func (v version) visibleAt(t time.Time) bool {
+	return v.present && (v.expires.IsZero() || t.Before(v.expires))
+}
+
+// snapshots tracks the open snapshots by revision. While any are open,
+// every change keeps the value it replaced in kv.versions so the snapshots
+// can still read it.
+//
+// gen counts the times the store has been reopened. Snapshots taken before
+// are no longer tracked and read as released. It changes only with both mu
+// and kv.mu held for writing, so holding either is enough to read it.
+type snapshots struct {
+	mu    sync.Mutex
+	open  map[int64]int // revision → open snapshots at it
+	count atomic.Int64  // total open, read by writers without mu
+	gen   int64
+}
+
+// add registers a snapshot at rev and returns the generation it belongs to.
+func (s *snapshots) add(rev int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.open == nil {
+		s.open = make(map[int64]int)
+	}
+	s.open[rev]++
+	s.count.Add(1)
+	return s.gen
+}
+
+func (s *snapshots) remove(rev, gen int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gen != s.gen {
+		return
+	}
+	if s.open[rev]--; s.open[rev] <= 0 {
+		delete(s.open, rev)
+	}
+	s.count.Add(-1)
+}
+
+// reset forgets every snapshot and starts a new generation.
+func (s *snapshots) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.open = nil
+	s.count.Store(0)
+	s.gen++
+}
+
+// oldest returns the revision of the oldest open snapshot.
+func (s *snapshots) oldest() (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var min int64
+	found := false
+	for rev := range s.open {
+		if !found || rev < min {
+			min, found = rev, true
+		}
+	}
+	return min, found
+}
+
+// snapshotsOpen reports whether any snapshot of kv is open.
+func (kv *KVStore) snapshotsOpen() bool {
+	return kv.snaps.count.Load() > 0
+}
+
+// retain keeps prev, the value key held before the change at rev, for the
+// open snapshots. Callers hold key's segment for writing, or kv.mu.
+func (kv *KVStore) retain(key string, prev version, rev int64) {
+	if !kv.snapshotsOpen() {
+		return
+	}
+	kv.versMu.Lock()
+	defer kv.versMu.Unlock()
+	if kv.versions == nil {
+		kv.versions = make(map[string][]version)
+	}
+	prev.rev = rev
+	kv.versions[key] = append(kv.versions[key], prev)
+}
+
+// pruneVersions drops the versions no open snapshot can read: those replaced
+// at or before the oldest open snapshot's revision. Callers hold kv.mu for
+// writing.
+func (kv *KVStore) pruneVersions() {
+	oldest, ok := kv.snaps.oldest()
+	if !ok {
+		kv.versions = nil
+		return
+	}
+	for key, vs := range kv.versions {
+		i := sort.Search(len(vs), func(i int) bool { return vs[i].rev > oldest })
+		if i == len(vs) {
+			delete(kv.versions, key)
+		} else if i > 0 {
+			kv.versions[key] = append([]version(nil), vs[i:]...)
+		}
+	}
+}
+
+// versionAt returns the value key held at revision rev. Callers hold every
+// segment, or kv.mu.
+func (kv *KVStore) versionAt(key string, rev int64) (version, error) {
+	vs := kv.versions[key]
+	if i := sort.Search(len(vs), func(i int) bool { return vs[i].rev > rev }); i < len(vs) {
+		return vs[i], nil
+	}
+	return kv.current(key)
+}
+
+// Snapshot is an immutable view of a store as of one revision. Later writes
+// do not affect what it reads. The values it needs are kept until it is
+// released, either by Release or when it is garbage-collected.
+type Snapshot struct {
+	kv       *KVStore
+	rev      int64
+	gen      int64
+	at       time.Time
+	released atomic.Bool
+}
+
+// Snapshot returns a snapshot of the store's current contents, or nil if the
+// store is closed.
+func (kv *KVStore) Snapshot() *Snapshot {
+	s, _ := kv.snapshot(context.Background())
+	return s
+}
+
+func (kv *KVStore) snapshot(ctx context.Context) (*Snapshot, error) {
+	var s *Snapshot
+	err := kv.exclusive(ctx, func(view) error {
+		// Holding kv.mu for writing excludes every writer, so the
+		// revision cannot move until the snapshot is registered.
+		s = &Snapshot{kv: kv, rev: kv.changes.revision(), at: kv.now()}
+		s.gen = kv.snaps.add(s.rev)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	runtime.SetFinalizer(s, func(s *Snapshot) { s.release(context.Background()) })
+	return s, nil
+}
+
+// Revision returns the revision the snapshot was taken at.
+func (s *Snapshot) Revision() int64 {
+	return s.rev
+}
+
+// Get returns the value key held when the snapshot was taken.
+func (s *Snapshot) Get(key string) (string, bool, error) {
+	val, found, err := s.get(context.Background(), key)
+	if err != nil || !found {
+		return "", false, err
+	}
+	d, err := displayValue(val)
+	if err != nil {
+		return "", false, err
+	}
+	return d, true, nil
+}
+
+// Keys returns the keys present when the snapshot was taken, sorted.
+func (s *Snapshot) Keys() ([]string, error) {
+	return s.keys(context.Background())
+}
+
+// Release lets the store discard the values kept for the snapshot. Reads
+// after Release, or after the store is reopened, fail with
+// ErrSnapshotReleased. Release is idempotent.
+func (s *Snapshot) Release() {
+	s.release(context.Background())
+}
+
+func (s *Snapshot) release(ctx context.Context) {
+	if s.released.Swap(true) {
+		return
+	}
+	runtime.SetFinalizer(s, nil)
+	s.kv.snaps.remove(s.rev, s.gen)
+	_ = s.kv.exclusive(ctx, func(view) error {
+		s.kv.pruneVersions()
+		return nil
+	})
+}
+
+// stale reports whether the snapshot has been released, or taken before the
+// store was reopened. Callers hold kv.mu.
+func (s *Snapshot) stale() bool {
+	return s.released.Load() || s.gen != s.kv.snaps.gen
+}
+
+func (s *Snapshot) get(ctx context.Context, key string) (string, bool, error) {
+	var v version
+	err := s.kv.read(ctx, func(view) error {
+		if s.stale() {
+			return ErrSnapshotReleased
+		}
+		var err error
+		v, err = s.kv.versionAt(key, s.rev)
+		return err
+	})
+	if err != nil || !v.visibleAt(s.at) {
+		return "", false, err
+	}
+	return v.value, true, nil
+}
+
+func (s *Snapshot) keys(ctx context.Context) ([]string, error) {
+	var keys []string
+	err := s.kv.read(ctx, func(view) error {
+		if s.stale() {
+			return ErrSnapshotReleased
+		}
+		// Candidates are the keys stored now and those with kept
+		// versions; each is resolved as of the snapshot.
+		candidates := make(map[string]struct{}, len(s.kv.versions))
+		for k := range s.kv.versions {
+			candidates[k] = struct{}{}
+		}
+		var err error
+		visit := func(k string) bool {
+			delete(candidates, k)
+			var v version
+			if v, err = s.kv.versionAt(k, s.rev); err != nil {
+				return false
+			}
+			if v.visibleAt(s.at) {
+				keys = append(keys, k)
+			}
+			return true
+		}
+		s.kv.index.ascend("", "", visit)
+		if err != nil {
+			return err
+		}
+		for k := range candidates {
+			if !visit(k) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// snapshotHandle is the Scheme value returned by kv-snapshot. It prints as
+// #<kv-snapshot rev>.
+type snapshotHandle struct {
+	snap *Snapshot
+}
+
+func (h *snapshotHandle) SchemeString() string {
+	return fmt.Sprintf("#<kv-snapshot %d>", h.snap.rev)
+}
+
+func (h *snapshotHandle) IsVoid() bool {
+	return false
+}
+
+func (h *snapshotHandle) EqualTo(v values.Value) bool {
+	o, ok := v.(*snapshotHandle)
+	return ok && o.snap == h.snap
+}
@@ -0,0 +1,90 @@
+package kvstore
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	store := New()
+	engine := newEngine(t, store)
+	eval(t, engine, `
+		(kv-set! "host" "db1") (kv-set! "port" 5432)
+		(define snap (kv-snapshot))
+		(kv-set! "host" "db2") (kv-delete! "port") (kv-set! "user" "admin")`)
+
+	// Later writes, deletes and clears do not change what it reads.
+	check(t, engine,
+		`(equal? (kv-snapshot-get snap "host") "db1")`,
+		`(= (kv-snapshot-get snap "port") 5432)`,
+		`(eq? (kv-snapshot-get snap "user" 'none) 'none)`,
+		`(equal? (kv-snapshot-keys snap) '("host" "port"))`,
+		`(equal? (kv-get "host") "db2")`)
+	eval(t, engine, `(kv-clear!)`)
+	check(t, engine, `(equal? (kv-snapshot-keys snap) '("host" "port"))`)
+	checkRaises(t, engine, `(kv-snapshot-get snap "user")`, "key-not-found")
+	checkRaises(t, engine, `(kv-snapshot-get "snap" "host")`, "not-a-snapshot")
+
+	// Releasing the last snapshot discards the values kept for it.
+	if len(store.versions) == 0 {
+		t.Error("no versions kept for an open snapshot")
+	}
+	eval(t, engine, `(kv-snapshot-release! snap) (kv-snapshot-release! snap)`)
+	checkRaises(t, engine, `(kv-snapshot-get snap "host")`, "snapshot-released")
+	checkRaises(t, engine, `(kv-snapshot-keys snap)`, "snapshot-released")
+	if n := len(store.versions); n != 0 {
+		t.Errorf("%d keys still have kept versions after release", n)
+	}
+}
+
+func TestSnapshotGoAPI(t *testing.T) {
+	store := New()
+	t.Cleanup(func() { store.close() })
+	if err := store.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	older := store.Snapshot()
+	if err := store.Set("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	newer := store.Snapshot()
+	if err := store.Set("b", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _, err := older.Get("a"); err != nil || v != "1" {
+		t.Errorf("older Get(a) = %q, %v", v, err)
+	}
+	if v, _, err := newer.Get("a"); err != nil || v != "2" {
+		t.Errorf("newer Get(a) = %q, %v", v, err)
+	}
+	if keys, err := newer.Keys(); err != nil || !slices.Equal(keys, []string{"a"}) {
+		t.Errorf("newer Keys() = %v, %v", keys, err)
+	}
+	if older.Revision() != 1 || newer.Revision() != 2 {
+		t.Errorf("revisions %d and %d, want 1 and 2", older.Revision(), newer.Revision())
+	}
+
+	// Releasing one snapshot keeps what the other still needs.
+	older.Release()
+	if v, _, err := newer.Get("a"); err != nil || v != "2" {
+		t.Errorf("newer Get(a) after releasing older = %q, %v", v, err)
+	}
+	if _, _, err := older.Get("a"); !errors.Is(err, ErrSnapshotReleased) {
+		t.Errorf("older Get after Release = %v, want ErrSnapshotReleased", err)
+	}
+
+	// Snapshots taken before a reset read as released.
+	if err := store.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newer.Keys(); !errors.Is(err, ErrSnapshotReleased) {
+		t.Errorf("Keys after Reset = %v, want ErrSnapshotReleased", err)
+	}
+	newer.Release()
+	store.close()
+	if s := store.Snapshot(); s != nil {
+		t.Error("Snapshot of a closed store is not nil")
+	}
+}
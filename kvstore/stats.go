@@ -0,0 +1,98 @@
+package kvstore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// counters holds the store's operational statistics. They are updated with
+// atomic operations so reading them never contends with the store's lock.
+type counters struct {
+	hits      atomic.Int64
+	misses    atomic.Int64
+	sets      atomic.Int64
+	deletes   atomic.Int64
+	expired   atomic.Int64
+	clears    atomic.Int64
+	evictions atomic.Int64
+	bytes     atomic.Int64
+	lockWait  atomic.Int64 // nanoseconds
+}
+
+// reset zeroes every counter.
+func (c *counters) reset() {
+	for _, n := range []*atomic.Int64{
+		&c.hits, &c.misses, &c.sets, &c.deletes, &c.expired,
+		&c.clears, &c.evictions, &c.bytes, &c.lockWait,
+	} {
+		n.Store(0)
+	}
+}
+
+// Stats is a point-in-time copy of a store's statistics. The counts are
+// cumulative since the store was created or last reopened.
+type Stats struct {
+	Hits      int64         // lookups that found a live key
+	Misses    int64         // lookups that did not
+	Sets      int64         // keys written
+	Deletes   int64         // keys removed by a delete
+	Expired   int64         // keys removed because their TTL ran out
+	Clears    int64         // calls to clear
+	Evictions int64         // keys removed to stay within capacity limits
+	Bytes     int64         // current size of the stored keys and values
+	LockWait  time.Duration // total time spent waiting for the store's locks
+}
+
+// Stats returns the store's statistics. It does not take the store's lock.
+func (kv *KVStore) Stats() Stats {
+	return Stats{
+		Hits:      kv.stats.hits.Load(),
+		Misses:    kv.stats.misses.Load(),
+		Sets:      kv.stats.sets.Load(),
+		Deletes:   kv.stats.deletes.Load(),
+		Expired:   kv.stats.expired.Load(),
+		Clears:    kv.stats.clears.Load(),
+		Evictions: kv.stats.evictions.Load(),
+		Bytes:     kv.stats.bytes.Load(),
+		LockWait:  time.Duration(kv.stats.lockWait.Load()),
+	}
+}
+
+// lock acquires kv.mu for writing, adding the time spent waiting to the
+// statistics. It fails with ErrStoreClosed, and releases kv.mu, if the store
+// is closing or closed.
+func (kv *KVStore) lock() error {
+	kv.acquire(kv.mu.TryLock, kv.mu.Lock)
+	if err := kv.opened(); err != nil {
+		kv.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// rlock is lock for reading.
+func (kv *KVStore) rlock() error {
+	kv.acquire(kv.mu.TryRLock, kv.mu.RLock)
+	if err := kv.opened(); err != nil {
+		kv.mu.RUnlock()
+		return err
+	}
+	return nil
+}
+
+// acquire takes a lock with tryLock, or failing that with lock, adding the
+// time spent waiting to the statistics. An uncontended lock is taken without
+// reading the clock.
+func (kv *KVStore) acquire(tryLock func() bool, lock func()) {
+	if tryLock() {
+		return
+	}
+	start := time.Now()
+	lock()
+	kv.stats.lockWait.Add(int64(time.Since(start)))
+}
+
+// storedSize is the number of bytes an entry contributes to Stats.Bytes.
+func storedSize(key, value string) int64 {
+	return int64(len(key) + len(value))
+}
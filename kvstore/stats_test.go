@@ -0,0 +1,44 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.now), WithJanitorInterval(time.Hour))
+	engine := newEngine(t, store)
+	eval(t, engine, `
+		(kv-set! "a" "1") (kv-set! "b" "22") (kv-set! "a" "333")
+		(kv-get "a") (kv-get "missing" #f) (kv-get "b")
+		(kv-delete! "b") (kv-delete! "b")
+		(kv-set! "ttl" "x" 10)`)
+	clock.advance(10 * time.Millisecond)
+	store.evictExpired()
+
+	want := Stats{Hits: 2, Misses: 1, Sets: 4, Deletes: 1, Expired: 1, Bytes: storedSize("a", "333")}
+	got := store.Stats()
+	got.LockWait = 0
+	if got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	check(t, engine,
+		`(= (cdr (assq 'hits (kv-stats))) 2)`,
+		`(= (cdr (assq 'bytes (kv-stats))) 4)`,
+		`(equal? (map car (kv-stats))
+		         '(hits misses sets deletes expired clears evictions bytes lock-wait-ns))`)
+
+	eval(t, engine, `(kv-clear!)`)
+	if st := store.Stats(); st.Clears != 1 || st.Bytes != 0 {
+		t.Errorf("after clear, Stats() = %+v", st)
+	}
+
+	// Reopening starts the counts over.
+	if err := store.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if st := store.Stats(); st != (Stats{}) {
+		t.Errorf("after Reset, Stats() = %+v", st)
+	}
+}
@@ -0,0 +1,459 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// view is the set of operations primitives perform on stored data. A
+// storeView is the store as seen by one locked operation; a transaction is
+// a view that buffers writes until commit.
+type view interface {
+	get(key string) (string, bool, error)
+	set(key, value string, ttl time.Duration) error
+	setUntil(key, value string, deadline time.Time) error
+	delete(key string) error
+	clear() error
+	keys() ([]string, error)
+	scan(start, end string, reverse bool, limit int) ([]string, error)
+	count() (int, error)
+	expiry(key string) (time.Time, bool)
+}
+
+// storeView is the store as seen by one operation holding its locks. The
+// changes it makes are collected in rec for the watchers, if there are any.
+// Reads are promoted from KVStore; writes are storeView methods.
+type storeView struct {
+	*KVStore
+	rec *recorder
+}
+
+// read runs fn against the transaction active in ctx, or against the store
+// with every segment locked for reading. The view fn is given is limited by
+// the Policy in ctx, as it is for the other entry points below.
+func (kv *KVStore) read(ctx context.Context, fn func(view) error) error {
+	if tx := kv.txnFrom(ctx); tx != nil {
+		return tx.join(ctx, fn)
+	}
+	if err := kv.rlock(); err != nil {
+		return err
+	}
+	defer kv.mu.RUnlock()
+	if err := kv.loadIndex(); err != nil {
+		return err
+	}
+	kv.rlockSegments()
+	defer kv.runlockSegments()
+	return fn(guard(ctx, &storeView{KVStore: kv}))
+}
+
+// readKey is read for a function that reads only key. It locks only key's
+// segment, so it runs alongside operations on other segments.
+func (kv *KVStore) readKey(ctx context.Context, key string, fn func(view) error) error {
+	if tx := kv.txnFrom(ctx); tx != nil {
+		return tx.join(ctx, fn)
+	}
+	seg := kv.segment(key)
+	if err := kv.rlock(); err != nil {
+		return err
+	}
+	defer kv.mu.RUnlock()
+	if err := kv.loadIndex(); err != nil {
+		return err
+	}
+	kv.acquire(seg.mu.TryRLock, seg.mu.RLock)
+	defer seg.mu.RUnlock()
+	return fn(guard(ctx, &storeView{KVStore: kv}))
+}
+
+// write runs fn against the transaction active in ctx, or against the store
+// under the write lock, notifying watchers of its changes once the lock is
+// released. It fails with ErrReadOnlyReplica if the store is following a
+// leader.
+func (kv *KVStore) write(ctx context.Context, fn func(view) error) error {
+	if err := kv.writable(); err != nil {
+		return err
+	}
+	if tx := kv.txnFrom(ctx); tx != nil {
+		return tx.join(ctx, fn)
+	}
+	return kv.mutate(ctx, func(sv *storeView) error {
+		return fn(guard(ctx, sv))
+	})
+}
+
+// exclusive is write for operations that need the write lock but change no
+// keys, such as taking a snapshot, so it is allowed on a replica. It takes
+// the lock even inside an optimistic transaction, which holds no locks
+// between operations; inside a held one, fn runs under the lock it holds.
+func (kv *KVStore) exclusive(ctx context.Context, fn func(view) error) error {
+	if tx := kv.txnFrom(ctx); tx != nil && tx.held {
+		return fn(guard(ctx, &storeView{KVStore: kv}))
+	}
+	return kv.mutate(ctx, func(sv *storeView) error {
+		return fn(guard(ctx, sv))
+	})
+}
+
+// writeKey is write for a function that changes only key. It locks only
+// key's segment, so writes to other segments proceed in parallel. A store
+// with capacity limits takes the write lock instead, since making room may
+// evict keys in any segment.
+func (kv *KVStore) writeKey(ctx context.Context, key string, fn func(view) error) error {
+	if err := kv.writable(); err != nil {
+		return err
+	}
+	if kv.limits.enabled() {
+		return kv.write(ctx, fn)
+	}
+	if tx := kv.txnFrom(ctx); tx != nil {
+		return tx.join(ctx, fn)
+	}
+	seg := kv.segment(key)
+	changes, err := kv.recordChanges(
+		func() error { return kv.lockSegment(seg) },
+		func() { kv.unlockSegment(seg) },
+		func(sv *storeView) error { return fn(guard(ctx, sv)) })
+	kv.notify(ctx, changes)
+	return err
+}
+
+// loadIndex builds the key index from the backend on first use, and totals
+// the size of the stored entries for Stats. Callers hold kv.mu.
+func (kv *KVStore) loadIndex() error {
+	kv.indexOnce.Do(func() {
+		keys, err := kv.backend.Keys()
+		if err != nil {
+			kv.indexErr = fmt.Errorf("load key index: %w", err)
+		}
+		kv.index = newKeyIndex(keys)
+		var size int64
+		for _, k := range keys {
+			val, _, err := kv.backend.Get(k)
+			if err != nil {
+				kv.indexErr = fmt.Errorf("load key index: %w", err)
+				break
+			}
+			size += storedSize(k, val)
+			kv.track(k)
+		}
+		kv.stats.bytes.Store(size)
+		if err := kv.loadExpiries(); err != nil && kv.indexErr == nil {
+			kv.indexErr = fmt.Errorf("load expiries: %w", err)
+		}
+	})
+	return kv.indexErr
+}
+
+func (kv *KVStore) get(key string) (string, bool, error) {
+	val, found, err := kv.backend.Get(key)
+	if err != nil {
+		return "", false, err
+	}
+	if !found || kv.expired(key) {
+		kv.stats.misses.Add(1)
+		return "", false, nil
+	}
+	kv.stats.hits.Add(1)
+	kv.touch(key)
+	return val, true, nil
+}
+
+func (sv *storeView) set(key, value string, ttl time.Duration) error {
+	return sv.setUntil(key, value, sv.deadline(ttl))
+}
+
+// setUntil sets key to value expiring at deadline, or never if it is zero.
+func (sv *storeView) setUntil(key, value string, deadline time.Time) error {
+	prev, err := sv.current(key)
+	if err != nil {
+		return err
+	}
+	if err := sv.makeRoom(key, value, prev); err != nil {
+		return err
+	}
+	if err := sv.storeEntry(key, value, deadline); err != nil {
+		sv.logger.Error("storage failure", "op", opSet, "key", key, "err", err)
+		return err
+	}
+	sv.didSet(key, value, deadline, prev)
+	return nil
+}
+
+// didSet brings the rest of the store up to date once the backend holds
+// value under key in place of prev.
+func (sv *storeView) didSet(key, value string, deadline time.Time, prev version) {
+	if !prev.present {
+		sv.indexMu.Lock()
+		sv.index.insert(key)
+		sv.indexMu.Unlock()
+	}
+	sv.setExpiry(key, deadline)
+	sv.track(key)
+	sv.stats.sets.Add(1)
+	sv.stats.bytes.Add(storedSize(key, value) - prev.size(key))
+	rev := sv.record(change{
+		op: opSet, key: key,
+		old: prev.value, hadOld: prev.visibleAt(sv.now()),
+		new: value, hasNew: true,
+		expires: deadline,
+	})
+	sv.segment(key).revs[key] = rev
+	sv.retain(key, prev, rev)
+}
+
+// delete removes key. Removing a key whose TTL has run out is recorded as an
+// expiry rather than a delete.
+func (sv *storeView) delete(key string) error {
+	op := opDelete
+	if sv.expired(key) {
+		op = opExpire
+	}
+	return sv.remove(key, op)
+}
+
+// remove deletes key from the store, recording the change as op.
+func (sv *storeView) remove(key, op string) error {
+	prev, err := sv.current(key)
+	if err != nil {
+		return err
+	}
+	if err := sv.backend.Delete(key); err != nil {
+		sv.logger.Error("storage failure", "op", op, "key", key, "err", err)
+		return err
+	}
+	sv.didRemove(key, op, prev)
+	return nil
+}
+
+// didRemove brings the rest of the store up to date once the backend no
+// longer holds key, which held prev.
+func (sv *storeView) didRemove(key, op string, prev version) {
+	seg := sv.segment(key)
+	delete(seg.expires, key)
+	delete(seg.usage, key)
+	delete(seg.revs, key)
+	if prev.present {
+		sv.indexMu.Lock()
+		sv.index.remove(key)
+		sv.indexMu.Unlock()
+		switch op {
+		case opExpire:
+			sv.stats.expired.Add(1)
+		case opDelete:
+			sv.stats.deletes.Add(1)
+		}
+		sv.stats.bytes.Add(-prev.size(key))
+		rev := sv.record(change{op: op, key: key, old: prev.value, hadOld: true})
+		sv.retain(key, prev, rev)
+	}
+}
+
+// clear removes every key. The change feed gets a single clear record;
+// watchers are told about each watched key it removed. Callers hold kv.mu
+// for writing.
+func (sv *storeView) clear() error {
+	keys, prevs, err := sv.clearing(false)
+	if err != nil {
+		return err
+	}
+	if err := sv.backend.Clear(); err != nil {
+		sv.logger.Error("storage failure", "op", opClear, "err", err)
+		return err
+	}
+	sv.didClear(keys, prevs)
+	return nil
+}
+
+// clearing returns the keys a clear would remove and their versions, if
+// watchers or snapshots need them or all is set, and nothing otherwise.
+func (sv *storeView) clearing(all bool) ([]string, []version, error) {
+	if !all && sv.rec == nil && !sv.snapshotsOpen() {
+		return nil, nil, nil
+	}
+	var keys []string
+	var prevs []version
+	var err error
+	sv.index.ascend("", "", func(k string) bool {
+		var v version
+		if v, err = sv.current(k); err != nil {
+			return false
+		}
+		keys = append(keys, k)
+		prevs = append(prevs, v)
+		return true
+	})
+	return keys, prevs, err
+}
+
+// didClear brings the rest of the store up to date once the backend has
+// been cleared of keys, which held prevs.
+func (sv *storeView) didClear(keys []string, prevs []version) {
+	sv.index.clear()
+	for i := range sv.segments {
+		clear(sv.segments[i].expires)
+		clear(sv.segments[i].usage)
+		clear(sv.segments[i].revs)
+	}
+	sv.stats.clears.Add(1)
+	sv.stats.bytes.Store(0)
+	rev := sv.changes.append(change{op: opClear})
+	sv.rememberClear(rev)
+	now := sv.now()
+	for i, k := range keys {
+		if sv.rec != nil && sv.rec.watches(k) && prevs[i].visibleAt(now) {
+			sv.rec.changes = append(sv.rec.changes, change{
+				op: opClear, key: k, old: prevs[i].value, hadOld: true, rev: rev,
+			})
+		}
+		sv.retain(k, prevs[i], rev)
+	}
+}
+
+// applyBatch applies ops in order as one atomic step. A Clear may only come
+// first. The ops reach the backend as a single batch if it is a
+// BatchBackend, or otherwise one at a time, undoing those already applied
+// if one fails; the rest of the store is updated once all of them have been
+// applied. Callers hold kv.mu for writing.
+func (sv *storeView) applyBatch(ops []BatchOp) error {
+	if err := sv.makeRoomForBatch(ops); err != nil {
+		return err
+	}
+	_, atomic := batchBackend(sv.backend)
+	cleared := len(ops) > 0 && ops[0].Clear
+	var keys []string
+	var prevs []version
+	if cleared {
+		var err error
+		if keys, prevs, err = sv.clearing(!atomic); err != nil {
+			return err
+		}
+	}
+	// Work out the version each op replaces, given the ops before it.
+	replaced := make([]version, len(ops))
+	pending := make(map[string]version)
+	for i, op := range ops {
+		if op.Clear {
+			continue
+		}
+		prev, ok := pending[op.Key]
+		if !ok && !cleared {
+			var err error
+			if prev, err = sv.current(op.Key); err != nil {
+				return err
+			}
+		}
+		replaced[i] = prev
+		if op.Delete {
+			pending[op.Key] = version{}
+		} else {
+			pending[op.Key] = version{value: op.Value, present: true, expires: op.Expires}
+		}
+	}
+
+	if err := sv.writeBatch(ops, replaced, keys, prevs); err != nil {
+		sv.logger.Error("storage failure", "op", "batch", "err", err)
+		return err
+	}
+	now := sv.now()
+	for i, op := range ops {
+		switch {
+		case op.Clear:
+			sv.didClear(keys, prevs)
+		case op.Delete && replaced[i].present && !replaced[i].visibleAt(now):
+			sv.didRemove(op.Key, opExpire, replaced[i])
+		case op.Delete:
+			sv.didRemove(op.Key, opDelete, replaced[i])
+		default:
+			sv.didSet(op.Key, op.Value, op.Expires, replaced[i])
+		}
+	}
+	return nil
+}
+
+// writeBatch writes ops to the backend for applyBatch. replaced holds the
+// version each op replaces, and keys and prevs the entries a leading Clear
+// removes, for undoing the ops if the backend is not a BatchBackend.
+func (sv *storeView) writeBatch(ops []BatchOp, replaced []version, keys []string, prevs []version) error {
+	if bb, ok := batchBackend(sv.backend); ok {
+		return bb.Apply(ops)
+	}
+	for i, op := range ops {
+		var err error
+		switch {
+		case op.Clear:
+			err = sv.backend.Clear()
+		case op.Delete:
+			err = sv.backend.Delete(op.Key)
+		default:
+			err = sv.storeEntry(op.Key, op.Value, op.Expires)
+		}
+		if err == nil {
+			continue
+		}
+		// Restore what the ops before this one replaced, newest first.
+		for j := i - 1; j >= 0; j-- {
+			if ops[j].Clear {
+				for k, key := range keys {
+					err = errors.Join(err, sv.storeEntry(key, prevs[k].value, prevs[k].expires))
+				}
+				continue
+			}
+			err = errors.Join(err, sv.restore(ops[j].Key, replaced[j]))
+		}
+		return err
+	}
+	return nil
+}
+
+// restore puts prev back as key's entry in the backend.
+func (sv *storeView) restore(key string, prev version) error {
+	if !prev.present {
+		return sv.backend.Delete(key)
+	}
+	return sv.storeEntry(key, prev.value, prev.expires)
+}
+
+// current returns key's stored value and deadline, including a value whose
+// TTL has run out but that has not been evicted yet.
+func (kv *KVStore) current(key string) (version, error) {
+	val, found, err := kv.backend.Get(key)
+	if err != nil || !found {
+		return version{}, err
+	}
+	return version{value: val, present: true, expires: kv.segment(key).expires[key]}, nil
+}
+
+func (kv *KVStore) keys() ([]string, error) {
+	return kv.scan("", "", false, 0)
+}
+
+// scan returns the live keys in [start, end) in index order, descending if
+// reverse is set. An empty end means no upper bound; a limit of zero or less
+// means no limit.
+func (kv *KVStore) scan(start, end string, reverse bool, limit int) ([]string, error) {
+	var keys []string
+	visit := func(k string) bool {
+		if !kv.expired(k) {
+			keys = append(keys, k)
+		}
+		return limit <= 0 || len(keys) < limit
+	}
+	if reverse {
+		kv.index.descend(start, end, visit)
+	} else {
+		kv.index.ascend(start, end, visit)
+	}
+	return keys, nil
+}
+
+func (kv *KVStore) count() (int, error) {
+	return kv.backend.Len() - kv.countExpired(), nil
+}
+
+func (kv *KVStore) expiry(key string) (time.Time, bool) {
+	deadline, ok := kv.segment(key).expires[key]
+	return deadline, ok
+}
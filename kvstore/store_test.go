@@ -0,0 +1,89 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentAccess runs writers, readers, clears and snapshots side by
+// side, with one segment and with the default number, for the race detector
+// to check.
+func TestConcurrentAccess(t *testing.T) {
+	for _, shards := range []int{1, defaultShards} {
+		t.Run(fmt.Sprintf("shards=%d", shards), func(t *testing.T) {
+			store := New(WithShards(shards))
+			t.Cleanup(func() { store.close() })
+			engine := newEngine(t, store)
+
+			const rounds = 200
+			var wg sync.WaitGroup
+			run := func(fn func(i int) error) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range rounds {
+						if err := fn(i); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+
+			for w := range 4 {
+				run(func(i int) error {
+					key := fmt.Sprintf("w%d/%03d", w, i%50)
+					if i%3 == 2 {
+						return store.Delete(key)
+					}
+					return store.Set(key, fmt.Sprint(i))
+				})
+			}
+			// x and y are only ever written together.
+			run(func(i int) error {
+				_, err := engine.EvalMultiple(context.Background(),
+					fmt.Sprintf(`(kv-set-many! '(("x" . %d) ("y" . %d)))`, i, i))
+				return err
+			})
+			run(func(int) error {
+				if keys := store.Keys(); !slices.IsSorted(keys) {
+					return fmt.Errorf("Keys() not sorted: %v", keys)
+				}
+				return nil
+			})
+			run(func(i int) error {
+				if i%20 != 0 {
+					if keys := store.KeysWithPrefix("w1/"); !slices.IsSorted(keys) {
+						return fmt.Errorf("KeysWithPrefix(w1/) not sorted: %v", keys)
+					}
+					return nil
+				}
+				return store.Clear()
+			})
+			run(func(int) error {
+				snap := store.Snapshot()
+				defer snap.Release()
+				x, hasX, err := snap.Get("x")
+				if err != nil {
+					return err
+				}
+				y, hasY, err := snap.Get("y")
+				if err != nil {
+					return err
+				}
+				if hasX != hasY || x != y {
+					return fmt.Errorf("snapshot at %d has x=%q (%v), y=%q (%v)", snap.Revision(), x, hasX, y, hasY)
+				}
+				return nil
+			})
+			wg.Wait()
+
+			if n, keys := store.Len(), store.Keys(); n != len(keys) {
+				t.Errorf("Len() = %d; Keys() has %d", n, len(keys))
+			}
+		})
+	}
+}
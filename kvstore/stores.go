@@ -0,0 +1,85 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aalpar/wile/machine"
+	"github.com/aalpar/wile/values"
+)
+
+// ErrNotAStore is returned when a kv-store-* primitive is given something
+// other than a handle from kv-open.
+var ErrNotAStore = values.NewStaticError("not a kv-store handle")
+
+// storeHandle is the Scheme value returned by kv-open. Handles to the same
+// name refer to the same store and print as #<kv-store "name">.
+type storeHandle struct {
+	name string
+	kv   *KVStore
+}
+
+func (h *storeHandle) SchemeString() string {
+	return fmt.Sprintf("#<kv-store %q>", h.name)
+}
+
+func (h *storeHandle) IsVoid() bool {
+	return false
+}
+
+func (h *storeHandle) EqualTo(v values.Value) bool {
+	o, ok := v.(*storeHandle)
+	return ok && o.kv == h.kv
+}
+
+// namedStore returns the store registered under name, creating it on first
+// use. Named stores are kept in memory and share the parent's clock,
+// janitor interval, shard count, capacity limits and history settings; they
+// are closed along with the parent. It fails with ErrStoreClosed once the
+// parent is closing.
+func (kv *KVStore) namedStore(name string) (*KVStore, error) {
+	kv.storesMu.Lock()
+	defer kv.storesMu.Unlock()
+	if kv.state.Load() != stateOpen {
+		return nil, ErrStoreClosed
+	}
+	if s, ok := kv.stores[name]; ok {
+		return s, nil
+	}
+	if kv.stores == nil {
+		kv.stores = make(map[string]*KVStore)
+	}
+	s := New(WithClock(kv.now), WithJanitorInterval(kv.janitorInterval), WithShards(len(kv.segments)))
+	s.limits = kv.limits
+	s.history = history{perKey: kv.history.perKey, total: kv.history.total}
+	s.logger = kv.logger.With("store", name)
+	kv.stores[name] = s
+	return s, nil
+}
+
+// closeStores closes every named store and forgets them.
+func (kv *KVStore) closeStores() error {
+	kv.storesMu.Lock()
+	stores := kv.stores
+	kv.stores = nil
+	kv.storesMu.Unlock()
+
+	var errs []error
+	for _, s := range stores {
+		if err := s.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// requireStore extracts a store handle argument from the given index.
+func requireStore(mc *machine.MachineContext, index int, name string) (*KVStore, error) {
+	v := mc.Arg(index)
+	h, ok := v.(*storeHandle)
+	if !ok {
+		return nil, values.WrapForeignErrorf(ErrNotAStore,
+			"%s: expected kv-store at argument %d but got %T", name, index+1, v)
+	}
+	return h.kv, nil
+}
@@ -0,0 +1,40 @@
+package kvstore
+
+import "testing"
+
+func TestNamedStores(t *testing.T) {
+	store := New()
+	engine := newEngine(t, store)
+	eval(t, engine, `
+		(define sessions (kv-open "sessions"))
+		(kv-store-set! sessions "alice" "token-1")
+		(kv-set! "alice" "default")`)
+
+	// Each name is its own store, shared by every handle to it and by
+	// every engine loading the same parent.
+	check(t, engine,
+		`(equal? (kv-store-get sessions "alice") "token-1")`,
+		`(equal? (kv-get "alice") "default")`,
+		`(equal? (kv-store-get (kv-open "sessions") "alice") "token-1")`,
+		`(equal? (kv-open "sessions") sessions)`,
+		`(not (equal? (kv-open "other") sessions))`,
+		`(null? (kv-store-keys (kv-open "other")))`,
+		`(= (kv-store-incr! sessions "n") 1)`,
+		`(equal? (kv-store-keys sessions) '("alice" "n"))`)
+	if got := eval(t, engine, `sessions`).SchemeString(); got != `#<kv-store "sessions">` {
+		t.Errorf("handle prints as %s", got)
+	}
+	other := newEngine(t, store)
+	check(t, other, `(equal? (kv-store-get (kv-open "sessions") "alice") "token-1")`)
+
+	checkRaises(t, engine, `(kv-store-get "sessions" "alice")`, "not-a-store")
+	checkRaises(t, engine, `(kv-store-get sessions "bob")`, "key-not-found")
+	checkRaises(t, engine, `(kv-open 1)`, "not-a-string")
+
+	// Closing the parent closes its named stores.
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkRaises(t, engine, `(kv-store-get sessions "alice")`, "store-closed")
+	checkRaises(t, engine, `(kv-open "sessions")`, "store-closed")
+}
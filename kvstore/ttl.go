@@ -0,0 +1,153 @@
+package kvstore
+
+import (
+	"context"
+	"time"
+)
+
+// deadline returns the time a key set now with ttl expires, or the zero
+// time if ttl is zero.
+func (kv *KVStore) deadline(ttl time.Duration) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return kv.now().Add(ttl)
+}
+
+// setExpiry records that key expires at deadline, or clears its expiry when
+// deadline is zero. The first TTL starts the janitor. Callers hold key's
+// segment for writing.
+func (kv *KVStore) setExpiry(key string, deadline time.Time) {
+	seg := kv.segment(key)
+	if deadline.IsZero() {
+		delete(seg.expires, key)
+		return
+	}
+	seg.expires[key] = deadline
+	kv.startJanitor()
+}
+
+// storeEntry writes value under key to the backend, with its deadline if the
+// backend keeps them.
+func (kv *KVStore) storeEntry(key, value string, deadline time.Time) error {
+	if eb, ok := kv.backend.(ExpiringBackend); ok {
+		return eb.SetExpiring(key, value, deadline)
+	}
+	return kv.backend.Set(key, value)
+}
+
+// loadExpiries restores the deadlines kept by the backend. Callers hold
+// kv.mu and are building the index.
+func (kv *KVStore) loadExpiries() error {
+	eb, ok := kv.backend.(ExpiringBackend)
+	if !ok {
+		return nil
+	}
+	expiries, err := eb.Expiries()
+	if err != nil {
+		return err
+	}
+	for key, deadline := range expiries {
+		kv.setExpiry(key, deadline)
+	}
+	return nil
+}
+
+// expired reports whether key has a TTL that has run out. Callers hold key's
+// segment.
+func (kv *KVStore) expired(key string) bool {
+	deadline, ok := kv.segment(key).expires[key]
+	return ok && !kv.now().Before(deadline)
+}
+
+// countExpired returns how many keys have expired but not yet been evicted.
+// Callers hold every segment.
+func (kv *KVStore) countExpired() int {
+	now := kv.now()
+	n := 0
+	for i := range kv.segments {
+		for _, deadline := range kv.segments[i].expires {
+			if !now.Before(deadline) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// startJanitor starts the janitor goroutine if it is not running and the
+// store is open. Close changes the state before stopping the janitor, so
+// one started by an operation still in progress is stopped too.
+func (kv *KVStore) startJanitor() {
+	kv.janitorMu.Lock()
+	defer kv.janitorMu.Unlock()
+	if kv.janitorStop == nil && kv.state.Load() == stateOpen {
+		kv.janitorStop = make(chan struct{})
+		kv.wg.Add(1)
+		go kv.janitor(kv.janitorStop)
+	}
+}
+
+// janitor evicts expired keys every janitorInterval until stop is closed.
+func (kv *KVStore) janitor(stop <-chan struct{}) {
+	defer kv.wg.Done()
+	t := time.NewTicker(kv.janitorInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			kv.evictExpired()
+		}
+	}
+}
+
+// evictExpired deletes every expired key from the backend, one segment at a
+// time. Each eviction is recorded as an expire change.
+func (kv *KVStore) evictExpired() {
+	evicted := 0
+	for i := range kv.segments {
+		seg := &kv.segments[i]
+		changes, err := kv.recordChanges(
+			func() error { return kv.lockSegment(seg) },
+			func() { kv.unlockSegment(seg) },
+			func(sv *storeView) error {
+				now := kv.now()
+				for key, deadline := range seg.expires {
+					if now.Before(deadline) {
+						continue
+					}
+					// A failed delete keeps the deadline, so the key
+					// stays invisible and is retried on the next pass.
+					if err := sv.delete(key); err != nil {
+						kv.logger.Warn("evict expired key", "key", key, "err", err)
+						continue
+					}
+					evicted++
+				}
+				return nil
+			})
+		if err != nil {
+			// The store is closing, or its keys could not be loaded.
+			return
+		}
+		kv.notify(context.Background(), changes)
+	}
+	if evicted > 0 {
+		kv.logger.Debug("expired keys evicted", "count", evicted)
+	}
+}
+
+// stopJanitor stops the janitor goroutine, if one is running, and waits for
+// it to exit.
+func (kv *KVStore) stopJanitor() {
+	kv.janitorMu.Lock()
+	stop := kv.janitorStop
+	kv.janitorStop = nil
+	kv.janitorMu.Unlock()
+	if stop != nil {
+		close(stop)
+		kv.wg.Wait()
+	}
+}
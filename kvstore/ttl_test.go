@@ -0,0 +1,162 @@
+package kvstore
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for WithClock that moves only when advanced.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func TestTTL(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.now), WithJanitorInterval(time.Hour))
+	engine := newEngine(t, store)
+
+	eval(t, engine, `(kv-set! "session" "abc" 1000) (kv-set! "host" "db")`)
+	check(t, engine,
+		`(= (kv-ttl "session") 1000)`,
+		`(= (kv-ttl "host") -1)`)
+	checkRaises(t, engine, `(kv-set! "x" "v" 0)`, "invalid-ttl")
+	checkRaises(t, engine, `(kv-set! "x" "v" -5)`, "invalid-ttl")
+	checkRaises(t, engine, `(kv-ttl "missing")`, "key-not-found")
+
+	clock.advance(400 * time.Millisecond)
+	check(t, engine, `(= (kv-ttl "session") 600)`)
+
+	// Once its deadline passes a key is invisible, though the janitor has
+	// not evicted it yet.
+	clock.advance(600 * time.Millisecond)
+	check(t, engine,
+		`(eq? (kv-get "session" 'gone) 'gone)`,
+		`(equal? (kv-keys) '("host"))`,
+		`(= (kv-count) 1)`,
+		`(kv-set-if-absent! "session" "new")`)
+	checkRaises(t, engine, `(kv-ttl "later")`, "key-not-found")
+
+	// Setting a key without a TTL clears the one it had.
+	eval(t, engine, `(kv-set! "host" "db" 50) (kv-set! "host" "db2")`)
+	clock.advance(time.Second)
+	check(t, engine, `(= (kv-ttl "host") -1)`, `(equal? (kv-get "host") "db2")`)
+}
+
+func TestJanitor(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.now), WithJanitorInterval(time.Millisecond))
+	for _, k := range []string{"a", "b"} {
+		if err := store.SetWithTTL(k, "v", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Set("c", "v"); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Minute)
+	waitFor(t, "eviction", func() bool { return store.backend.Len() == 1 })
+	if n := store.Stats().Expired; n != 2 {
+		t.Errorf("Stats().Expired = %d, want 2", n)
+	}
+
+	// Close stops the janitor and waits for it to exit.
+	if err := store.SetWithTTL("d", "v", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	running := func() bool {
+		store.janitorMu.Lock()
+		defer store.janitorMu.Unlock()
+		return store.janitorStop != nil
+	}
+	if running() {
+		t.Error("janitor still running after Close")
+	}
+	store.startJanitor()
+	if running() {
+		t.Error("janitor started on a closed store")
+	}
+}
+
+func TestTTLPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	clock := newFakeClock()
+	opts := []Option{WithClock(clock.now), WithJanitorInterval(time.Hour), WithCompactionThreshold(0)}
+	store, err := Open(path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []func() error{
+		func() error { return store.SetWithTTL("short", "v", time.Minute) },
+		func() error { return store.SetWithTTL("long", "v", time.Hour) },
+		func() error { return store.SetWithTTL("cleared", "v", time.Minute) },
+		func() error { return store.Set("cleared", "v") },
+		func() error { return store.Set("kept", "v") },
+		func() error { _, err := store.Expire("kept", 2*time.Hour); return err },
+	} {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen reopens the store, after compacting its log if compact is set.
+	reopen := func(compact bool) {
+		t.Helper()
+		if compact {
+			b := openLog(t, path, opts...)
+			b.compact()
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if store, err = Open(path, opts...); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+	}
+	ttls := func(want map[string]time.Duration) {
+		t.Helper()
+		for k, d := range want {
+			got, found, err := store.TTL(k)
+			if err != nil || !found || got != d {
+				t.Errorf("TTL(%s) = %v, %v, %v; want %v", k, got, found, err, d)
+			}
+		}
+	}
+
+	reopen(false)
+	ttls(map[string]time.Duration{"short": time.Minute, "long": time.Hour, "cleared": -1, "kept": 2 * time.Hour})
+
+	// A deadline that passed while the store was closed hides the key.
+	store.Close()
+	clock.advance(30 * time.Minute)
+	reopen(true)
+	if _, found, _ := store.Get("short"); found {
+		t.Error("key expired while the store was closed is visible")
+	}
+	ttls(map[string]time.Duration{"long": 30 * time.Minute, "cleared": -1, "kept": 90 * time.Minute})
+}
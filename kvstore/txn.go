@@ -0,0 +1,352 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aalpar/wile/values"
+)
+
+// ErrTransactionConflict reports that a concurrent write changed what an
+// optimistic transaction read. It does not escape atomically, which runs the
+// transaction again under the store's write lock.
+var ErrTransactionConflict = values.NewStaticError("transaction conflict")
+
+// txnKey is the context key under which a transaction on kv is stored.
+// Primitives called from inside the thunk find it through their context.
+type txnKey struct{ kv *KVStore }
+
+// txnWrite is a buffered mutation of one key.
+type txnWrite struct {
+	value   string
+	deleted bool
+	expires time.Time
+}
+
+// txnRead is what a transaction saw of a key it read from the store.
+type txnRead struct {
+	value   string
+	found   bool
+	expires time.Time
+}
+
+// txn buffers the writes made inside kv-transaction. Reads see the
+// transaction's own writes layered over the store. An optimistic
+// transaction does not lock the store between operations: each read takes
+// the read locks and checks that what the transaction read before is
+// unchanged, and commit checks it once more under the write lock before
+// applying the writes as one batch. A failed check marks the transaction as
+// conflicting. A held transaction runs entirely under the write lock, so it
+// cannot conflict.
+type txn struct {
+	kv      *KVStore
+	epoch   uint64
+	rev     int64 // store revision the reads were last checked at
+	reads   map[string]txnRead
+	scanned bool // a listing or count was read, so any change conflicts
+	locked  bool // the read locks are held by an enclosing read
+	held    bool // kv.mu is held for writing until the transaction ends
+	failed  bool
+	cleared bool
+	writes  map[string]txnWrite
+}
+
+func (kv *KVStore) newTxn() *txn {
+	return &txn{kv: kv, rev: -1, reads: make(map[string]txnRead), writes: make(map[string]txnWrite)}
+}
+
+// context returns ctx carrying the transaction.
+func (tx *txn) context(ctx context.Context) context.Context {
+	return context.WithValue(context.WithValue(ctx, txnKey{tx.kv}, tx), anyTxnKey{}, true)
+}
+
+// atomically runs fn inside a transaction on kv, passing it a context that
+// carries the transaction. If ctx already carries one, fn joins it;
+// otherwise the writes fn makes are committed when it returns nil. fn first
+// runs optimistically; if a concurrent write conflicts with what it read,
+// its writes are dropped and it runs once more under the write lock, as
+// locked runs it. Watchers see the committed changes after kv.mu is
+// released.
+func (kv *KVStore) atomically(ctx context.Context, fn func(context.Context, view) error) error {
+	if tx := kv.txnFrom(ctx); tx != nil {
+		return fn(ctx, guard(ctx, tx))
+	}
+	if err := kv.writable(); err != nil {
+		return err
+	}
+	tx := kv.newTxn()
+	err := fn(tx.context(ctx), guard(ctx, tx))
+	if err == nil && !tx.failed {
+		err = tx.commit(ctx)
+	}
+	if !tx.failed {
+		return err
+	}
+	kv.logger.Debug("transaction conflict, retrying under the write lock")
+	return kv.locked(ctx, fn)
+}
+
+// locked is atomically for functions that must run exactly once, such as
+// one calling a Scheme procedure: fn runs in a transaction holding kv.mu
+// for writing from start to commit, so no other operation on the store can
+// run alongside it. Operations fn makes on the store join the transaction.
+func (kv *KVStore) locked(ctx context.Context, fn func(context.Context, view) error) error {
+	if tx := kv.txnFrom(ctx); tx != nil {
+		return fn(ctx, guard(ctx, tx))
+	}
+	if err := kv.writable(); err != nil {
+		return err
+	}
+	tx := kv.newTxn()
+	tx.held = true
+	return kv.mutate(ctx, func(sv *storeView) error {
+		if err := fn(tx.context(ctx), guard(ctx, tx)); err != nil {
+			return err
+		}
+		if ops := tx.ops(); len(ops) > 0 {
+			return sv.applyBatch(ops)
+		}
+		return nil
+	})
+}
+
+// anyTxnKey marks a context inside a transaction on any store.
+type anyTxnKey struct{}
+
+// inTransaction reports whether ctx is inside a transaction on any store.
+func inTransaction(ctx context.Context) bool {
+	return ctx.Value(anyTxnKey{}) != nil
+}
+
+// txnFrom returns the transaction on kv active in ctx, or nil.
+func (kv *KVStore) txnFrom(ctx context.Context) *txn {
+	tx, _ := ctx.Value(txnKey{kv}).(*txn)
+	return tx
+}
+
+// join runs fn, an operation called from inside the transaction, on the
+// transaction's view. fn holds the read locks, so it may also read the
+// store's internals, such as its history.
+func (tx *txn) join(ctx context.Context, fn func(view) error) error {
+	return tx.read(func() error { return fn(guard(ctx, tx)) })
+}
+
+// read runs fn holding kv.mu and every segment for reading, after checking
+// that nothing the transaction has read has changed. Reads nested inside
+// another read, and those of a held transaction, run under the locks
+// already held.
+func (tx *txn) read(fn func() error) error {
+	if tx.locked || tx.held {
+		return fn()
+	}
+	kv := tx.kv
+	if err := kv.rlock(); err != nil {
+		return err
+	}
+	defer kv.mu.RUnlock()
+	if err := kv.loadIndex(); err != nil {
+		return err
+	}
+	kv.rlockSegments()
+	defer kv.runlockSegments()
+	if err := tx.validate(false); err != nil {
+		return err
+	}
+	tx.locked = true
+	defer func() { tx.locked = false }()
+	return fn()
+}
+
+// validate checks that the keys the transaction read still hold what it
+// saw, and that no listing it read could have changed. Unless all is set,
+// the check is skipped if the store's revision has not moved since the last
+// one. Callers hold the store's locks.
+func (tx *txn) validate(all bool) error {
+	kv := tx.kv
+	epoch, rev := kv.changes.epoch.Load(), kv.changes.revision()
+	if !all && epoch == tx.epoch && rev == tx.rev {
+		return nil
+	}
+	if tx.scanned && tx.rev >= 0 && (epoch != tx.epoch || rev != tx.rev) {
+		return tx.conflict()
+	}
+	for key, seen := range tx.reads {
+		now, err := tx.observe(key)
+		if err != nil {
+			return err
+		}
+		if now != seen {
+			return tx.conflict()
+		}
+	}
+	tx.epoch, tx.rev = epoch, rev
+	return nil
+}
+
+// conflict marks the transaction as failed.
+func (tx *txn) conflict() error {
+	tx.failed = true
+	return fmt.Errorf("%w: a concurrent write changed what the transaction read", ErrTransactionConflict)
+}
+
+// observe returns what the store holds for key. Callers hold key's segment.
+func (tx *txn) observe(key string) (txnRead, error) {
+	val, found, err := tx.kv.backend.Get(key)
+	if err != nil || !found || tx.kv.expired(key) {
+		return txnRead{}, err
+	}
+	deadline, _ := tx.kv.expiry(key)
+	return txnRead{value: val, found: true, expires: deadline}, nil
+}
+
+// remember reads key from the store, unless the transaction already has.
+func (tx *txn) remember(key string) (txnRead, error) {
+	if r, ok := tx.reads[key]; ok {
+		return r, nil
+	}
+	var r txnRead
+	err := tx.read(func() error {
+		var err error
+		if r, err = tx.observe(key); err != nil {
+			return err
+		}
+		if r.found {
+			tx.kv.stats.hits.Add(1)
+		} else {
+			tx.kv.stats.misses.Add(1)
+		}
+		tx.reads[key] = r
+		return nil
+	})
+	return r, err
+}
+
+func (tx *txn) get(key string) (string, bool, error) {
+	if w, ok := tx.writes[key]; ok {
+		if w.deleted {
+			return "", false, nil
+		}
+		return w.value, true, nil
+	}
+	if tx.cleared {
+		return "", false, nil
+	}
+	r, err := tx.remember(key)
+	return r.value, r.found, err
+}
+
+func (tx *txn) set(key, value string, ttl time.Duration) error {
+	return tx.setUntil(key, value, tx.kv.deadline(ttl))
+}
+
+func (tx *txn) setUntil(key, value string, deadline time.Time) error {
+	tx.writes[key] = txnWrite{value: value, expires: deadline}
+	return nil
+}
+
+func (tx *txn) delete(key string) error {
+	tx.writes[key] = txnWrite{deleted: true}
+	return nil
+}
+
+func (tx *txn) clear() error {
+	tx.cleared = true
+	clear(tx.writes)
+	return nil
+}
+
+func (tx *txn) keys() ([]string, error) {
+	return tx.scan("", "", false, 0)
+}
+
+// scan merges the buffered writes in [start, end) into the store's keys.
+func (tx *txn) scan(start, end string, reverse bool, limit int) ([]string, error) {
+	var keys []string
+	if !tx.cleared {
+		err := tx.read(func() error {
+			tx.scanned = true
+			var err error
+			keys, err = tx.kv.scan(start, end, reverse, 0)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	live := keys[:0]
+	for _, k := range keys {
+		if _, ok := tx.writes[k]; !ok {
+			live = append(live, k)
+		}
+	}
+	for k, w := range tx.writes {
+		if !w.deleted && k >= start && (end == "" || k < end) {
+			live = append(live, k)
+		}
+	}
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(live)))
+	} else {
+		sort.Strings(live)
+	}
+	if limit > 0 && len(live) > limit {
+		live = live[:limit]
+	}
+	return live, nil
+}
+
+func (tx *txn) count() (int, error) {
+	keys, err := tx.keys()
+	return len(keys), err
+}
+
+func (tx *txn) expiry(key string) (time.Time, bool) {
+	if w, ok := tx.writes[key]; ok {
+		return w.expires, !w.deleted && !w.expires.IsZero()
+	}
+	if tx.cleared {
+		return time.Time{}, false
+	}
+	r, err := tx.remember(key)
+	return r.expires, err == nil && r.found && !r.expires.IsZero()
+}
+
+// commit checks the transaction's reads under the write lock and applies
+// its writes as one batch. Other callers observe all of the writes or none,
+// and a backend failure applies none of them.
+func (tx *txn) commit(ctx context.Context) error {
+	ops := tx.ops()
+	if len(ops) == 0 {
+		return nil
+	}
+	return tx.kv.mutate(ctx, func(sv *storeView) error {
+		if err := tx.validate(true); err != nil {
+			return err
+		}
+		return sv.applyBatch(ops)
+	})
+}
+
+// ops returns the transaction's writes as a batch: a clear first if it
+// cleared the store, then the writes in key order.
+func (tx *txn) ops() []BatchOp {
+	if !tx.cleared && len(tx.writes) == 0 {
+		return nil
+	}
+	ops := make([]BatchOp, 0, len(tx.writes)+1)
+	if tx.cleared {
+		ops = append(ops, BatchOp{Clear: true})
+	}
+	keys := make([]string, 0, len(tx.writes))
+	for k := range tx.writes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		w := tx.writes[k]
+		ops = append(ops, BatchOp{Key: k, Value: w.value, Expires: w.expires, Delete: w.deleted})
+	}
+	return ops
+}
@@ -0,0 +1,193 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTransaction(t *testing.T) {
+	store := New()
+	engine := newEngine(t, store)
+	eval(t, engine, `(kv-set! "a" 1) (kv-set! "b" 2)`)
+
+	// Reads inside the transaction see its own writes; the store sees them
+	// when it commits.
+	check(t, engine,
+		`(equal? (kv-transaction
+		           (lambda ()
+		             (kv-set! "a" 10)
+		             (kv-delete! "b")
+		             (kv-set! "c" 3)
+		             (list (kv-get "a") (kv-get "b" 'none) (kv-keys) (kv-count))))
+		         '(10 none ("a" "c") 2))`,
+		`(equal? (kv-keys) '("a" "c"))`,
+		`(= (kv-get "a") 10)`)
+
+	// A raise discards every write and propagates.
+	check(t, engine,
+		`(eq? (guard (e (#t 'raised))
+		        (kv-transaction
+		          (lambda ()
+		            (kv-set! "a" 99)
+		            (kv-clear!)
+		            (error "abort"))))
+		      'raised)`,
+		`(equal? (kv-keys) '("a" "c"))`,
+		`(= (kv-get "a") 10)`)
+
+	// A clear inside a transaction hides the store's keys from its reads.
+	eval(t, engine, `(kv-transaction (lambda () (kv-clear!) (kv-set! "d" 4)))`)
+	check(t, engine, `(equal? (kv-keys) '("d"))`)
+
+	checkRaises(t, engine, `(kv-transaction (lambda () (kv-transaction (lambda () 1))))`, "nested-transaction")
+	if got, _, _ := store.Get("d"); got != "4" {
+		t.Errorf("d = %q after a failed nested transaction, want 4", got)
+	}
+}
+
+func TestTransactionConflict(t *testing.T) {
+	store := New()
+	t.Cleanup(func() { store.Close() })
+	if err := store.Set("n", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write made between the transaction's read and its commit makes it
+	// run again, this time reading the new value.
+	attempts := 0
+	err := store.atomically(context.Background(), func(_ context.Context, v view) error {
+		attempts++
+		cur, _, err := v.get("n")
+		if err != nil {
+			return err
+		}
+		if attempts == 1 {
+			if err := store.Set("n", "2"); err != nil {
+				return err
+			}
+		}
+		return v.set("m", cur, 0)
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("atomically = %v after %d attempts, want success after 2", err, attempts)
+	}
+	if got, _, _ := store.Get("m"); got != "2" {
+		t.Errorf("m = %q, want the value read on the second attempt", got)
+	}
+
+	// After a conflict the transaction runs under the write lock, so
+	// writers wait for it rather than make it conflict again.
+	attempts = 0
+	written := make(chan error, 1)
+	err = store.atomically(context.Background(), func(_ context.Context, v view) error {
+		attempts++
+		if _, err := v.keys(); err != nil {
+			return err
+		}
+		if err := v.set("kept", encodeString("v"), 0); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return store.Set("n", "3")
+		}
+		go func() { written <- store.Set("n", "4") }()
+		select {
+		case err := <-written:
+			return fmt.Errorf("a write ran inside the locked transaction: %v", err)
+		case <-time.After(20 * time.Millisecond):
+			return nil
+		}
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("atomically = %v after %d attempts, want success after 2", err, attempts)
+	}
+	if _, found, _ := store.Get("kept"); !found {
+		t.Error("the locked run was not committed")
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := store.Get("n"); got != "4" {
+		t.Errorf("n = %q, want the write that waited", got)
+	}
+}
+
+func TestTransactionLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := newEngine(t, store)
+	eval(t, engine, `(kv-set! "a" "old")`)
+	size := fileSize(t, path)
+	eval(t, engine, `(kv-transaction (lambda () (kv-set! "a" "new") (kv-set! "b" "new") (kv-delete! "c")))`)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction is logged as one record, which a torn tail loses
+	// entirely.
+	b := openLog(t, path)
+	if b.log.records != 4 {
+		t.Errorf("log holds %d mutations, want 4", b.log.records)
+	}
+	b.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:len(data)-1], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b = openLog(t, path)
+	defer b.Close()
+	if want := map[string]string{"a": encodeString("old")}; !maps.Equal(entries(t, b), want) {
+		t.Errorf("recovered %v, want %v", entries(t, b), want)
+	}
+	if b.log.size != size {
+		t.Errorf("recovered log is %d bytes, want %d", b.log.size, size)
+	}
+}
+
+// flakyBackend is a backend whose Set fails once failAt more have
+// succeeded, if failAt is positive.
+type flakyBackend struct {
+	*MemoryBackend
+	failAt int
+}
+
+func (b *flakyBackend) Set(key, value string) error {
+	if b.failAt > 0 {
+		b.failAt--
+		if b.failAt == 0 {
+			return errInjected
+		}
+	}
+	return b.MemoryBackend.Set(key, value)
+}
+
+func TestTransactionUndo(t *testing.T) {
+	backend := &flakyBackend{MemoryBackend: NewMemoryBackend()}
+	store := New(WithBackend(backend))
+	engine := newEngine(t, store)
+	eval(t, engine, `(kv-set! "a" 1) (kv-set! "b" 2)`)
+	want := entries(t, backend)
+
+	// The third write fails, so the two before it are undone.
+	backend.failAt = 3
+	checkRaises(t, engine,
+		`(kv-transaction (lambda () (kv-delete! "a") (kv-set! "b" 20) (kv-set! "c" 30) (kv-set! "d" 40)))`,
+		"storage")
+	if got := entries(t, backend); !maps.Equal(got, want) {
+		t.Errorf("backend holds %v after a failed commit, want %v", got, want)
+	}
+	check(t, engine,
+		`(equal? (kv-keys) '("a" "b"))`,
+		`(= (kv-get "b") 2)`)
+}
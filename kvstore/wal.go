@@ -0,0 +1,711 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The write-ahead log is a header followed by a sequence of framed records:
+//
+//	header:  "WKVLOG\x00\x01"
+//	record:  crc32c(payload) uint32 | len(payload) uint32 | payload
+//	payload: op byte | uvarint len(key) | key | uvarint len(value) | value [| varint expires]
+//	batch:   op byte | uvarint n | n × (uvarint len(payload) | payload)
+//
+// Both integers in the frame are little-endian. A set record for a key with
+// a TTL ends with its deadline in Unix nanoseconds. A batch record holds the
+// payloads of several mutations, so that recovery applies all of them or,
+// if the record is torn, none. A record that is short, has
+// an impossible length or fails its checksum marks the end of the valid log;
+// everything from that offset on is truncated during recovery.
+
+const (
+	walHeader        = "WKVLOG\x00\x01"
+	walFrameSize     = 8
+	walMaxRecordSize = 64 << 20
+)
+
+var walCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// walOp identifies the mutation a log record describes.
+type walOp byte
+
+const (
+	walSet walOp = iota + 1
+	walDelete
+	walClear
+	walBatch
+)
+
+// walRecord is one logged mutation.
+type walRecord struct {
+	op      walOp
+	key     string
+	value   string
+	expires time.Time   // set only: zero if the key has no TTL
+	batch   []walRecord // batch only
+}
+
+// LogBackend keeps entries in memory and makes them durable with an
+// append-only write-ahead log. Every mutation is appended as a checksummed
+// record before it is applied, and the log is replayed on open. A background
+// goroutine syncs the log under SyncInterval and compacts it once it is
+// mostly dead records. It is an ExpiringBackend, so TTLs survive a restart.
+type LogBackend struct {
+	mu      sync.RWMutex // excludes writers while the log is compacted
+	data    map[string]string
+	expires map[string]time.Time
+	log     *wal
+	opts    options
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	closing sync.Once
+}
+
+// OpenLogBackend opens or creates the log at path and replays it. A torn or
+// corrupt tail left by a crash is truncated rather than failing the open.
+// Only the log options (sync policy and compaction) apply.
+func OpenLogBackend(path string, opts ...Option) (*LogBackend, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	b := &LogBackend{data: make(map[string]string), expires: make(map[string]time.Time), opts: o}
+	log, err := openWAL(path, o.syncPolicy, b.apply)
+	if err != nil {
+		return nil, fmt.Errorf("kvstore: open %s: %w", path, err)
+	}
+	b.log = log
+	if log.truncated > 0 {
+		o.logger.Warn("truncated torn log tail", "path", path, "bytes", log.truncated)
+	}
+	b.stop = make(chan struct{})
+	b.wg.Add(1)
+	go b.maintain()
+	return b, nil
+}
+
+// Get implements Backend.
+func (b *LogBackend) Get(key string) (string, bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	val, found := b.data[key]
+	return val, found, nil
+}
+
+// Set implements Backend.
+func (b *LogBackend) Set(key, value string) error {
+	return b.SetExpiring(key, value, time.Time{})
+}
+
+// SetExpiring implements ExpiringBackend.
+func (b *LogBackend) SetExpiring(key, value string, expires time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rec := walRecord{op: walSet, key: key, value: value, expires: expires}
+	if err := b.log.append(rec); err != nil {
+		return err
+	}
+	b.apply(rec)
+	return nil
+}
+
+// Expiries implements ExpiringBackend.
+func (b *LogBackend) Expiries() (map[string]time.Time, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return maps.Clone(b.expires), nil
+}
+
+// Delete implements Backend. Deleting a missing key writes no record.
+func (b *LogBackend) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, found := b.data[key]; !found {
+		return nil
+	}
+	rec := walRecord{op: walDelete, key: key}
+	if err := b.log.append(rec); err != nil {
+		return err
+	}
+	b.apply(rec)
+	return nil
+}
+
+// Clear implements Backend.
+func (b *LogBackend) Clear() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rec := walRecord{op: walClear}
+	if err := b.log.append(rec); err != nil {
+		return err
+	}
+	b.apply(rec)
+	return nil
+}
+
+// Apply implements BatchBackend. The batch is logged as a single record.
+func (b *LogBackend) Apply(ops []BatchOp) error {
+	rec := walRecord{op: walBatch, batch: make([]walRecord, len(ops))}
+	for i, op := range ops {
+		switch {
+		case op.Clear:
+			rec.batch[i] = walRecord{op: walClear}
+		case op.Delete:
+			rec.batch[i] = walRecord{op: walDelete, key: op.Key}
+		default:
+			rec.batch[i] = walRecord{op: walSet, key: op.Key, value: op.Value, expires: op.Expires}
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.log.append(rec); err != nil {
+		return err
+	}
+	b.apply(rec)
+	return nil
+}
+
+// Keys implements Backend.
+func (b *LogBackend) Keys() ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	keys := make([]string, 0, len(b.data))
+	for k := range b.data {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Len implements Backend.
+func (b *LogBackend) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.data)
+}
+
+// Concurrent implements ConcurrentBackend.
+func (b *LogBackend) Concurrent() bool {
+	return true
+}
+
+// Close stops background work, syncs the log and closes it. Closing a
+// closed backend does nothing.
+func (b *LogBackend) Close() error {
+	var err error
+	b.closing.Do(func() {
+		close(b.stop)
+		b.wg.Wait()
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.data, b.expires = nil, nil
+		err = b.log.close()
+	})
+	return err
+}
+
+// apply applies a logged or recovered record to the in-memory state.
+func (b *LogBackend) apply(rec walRecord) {
+	switch rec.op {
+	case walSet:
+		b.data[rec.key] = rec.value
+		if rec.expires.IsZero() {
+			delete(b.expires, rec.key)
+		} else {
+			b.expires[rec.key] = rec.expires
+		}
+	case walDelete:
+		delete(b.data, rec.key)
+		delete(b.expires, rec.key)
+	case walClear:
+		clear(b.data)
+		clear(b.expires)
+	case walBatch:
+		for _, sub := range rec.batch {
+			b.apply(sub)
+		}
+	}
+}
+
+// maintain syncs the log under SyncInterval and periodically compacts it.
+func (b *LogBackend) maintain() {
+	defer b.wg.Done()
+
+	var syncC <-chan time.Time
+	if b.opts.syncPolicy == SyncInterval {
+		t := time.NewTicker(b.opts.syncInterval)
+		defer t.Stop()
+		syncC = t.C
+	}
+	compact := time.NewTicker(b.opts.compactionInterval)
+	defer compact.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-syncC:
+			// A failed sync leaves the log dirty; the next tick or
+			// Close retries it.
+			if err := b.log.sync(); err != nil {
+				b.opts.logger.Warn("sync log", "path", b.log.path, "err", err)
+			}
+		case <-compact.C:
+			b.compact()
+		}
+	}
+}
+
+// compact rewrites the log if it has grown past the threshold. Holding the
+// read lock keeps writers out while the snapshot is written, so no append can
+// land in the file that is about to be replaced.
+func (b *LogBackend) compact() {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if !b.log.needsCompaction(len(b.data), b.opts.compactionThreshold) {
+		return
+	}
+	// On failure the old log is left in place and still complete.
+	if err := b.log.compact(b.data, b.expires); err != nil {
+		b.opts.logger.Warn("compact log", "path", b.log.path, "err", err)
+	}
+}
+
+// errTornRecord reports a record that could not be decoded. It never escapes
+// recovery: the log is truncated at the start of the offending record.
+var errTornRecord = errors.New("torn or corrupt log record")
+
+// wal is an append-only log of mutations. It is not safe for concurrent
+// appends on its own; the LogBackend write lock serializes them. The internal
+// mutex only guards against the background sync racing an append or close.
+type wal struct {
+	mu      sync.Mutex
+	path    string
+	f       logFile
+	policy  SyncPolicy
+	size    int64 // bytes in the file, header included
+	records int   // records written since the log was last rewritten
+	dirty   bool  // bytes written since the last fsync
+	failed  error // set when the file may hold a record that was not applied
+
+	truncated int64 // bytes of torn or corrupt tail dropped by recovery
+}
+
+// logFile is the file behind a wal. It is an *os.File except in tests,
+// which substitute one that fails.
+type logFile interface {
+	io.Reader
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// openWAL opens or creates the log at path and replays every valid record
+// through apply. A torn or corrupt tail is truncated so that later appends
+// start from a clean record boundary.
+func openWAL(path string, policy SyncPolicy, apply func(walRecord)) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l := &wal{path: path, f: f, policy: policy}
+	if err := l.recover(apply); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// recover validates the header, replays records and truncates the tail.
+func (l *wal) recover(apply func(walRecord)) error {
+	info, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < int64(len(walHeader)) {
+		// New file, or one that died before its header reached disk.
+		if err := l.reset(); err != nil {
+			return err
+		}
+		return syncDir(l.path)
+	}
+
+	r := bufio.NewReader(l.f)
+	header := make([]byte, len(walHeader))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header) != walHeader {
+		return fmt.Errorf("kvstore: %s is not a kvstore log", l.path)
+	}
+
+	end := int64(len(walHeader))
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, errTornRecord) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return err
+		}
+		apply(rec)
+		end += n
+		l.records += rec.mutations()
+	}
+
+	if end < info.Size() {
+		l.truncated = info.Size() - end
+		if err := l.f.Truncate(end); err != nil {
+			return err
+		}
+		if err := l.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if _, err := l.f.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+	l.size = end
+	return nil
+}
+
+// reset truncates the file to an empty log containing only the header.
+func (l *wal) reset() error {
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.f.WriteAt([]byte(walHeader), 0); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	if _, err := l.f.Seek(int64(len(walHeader)), io.SeekStart); err != nil {
+		return err
+	}
+	l.size = int64(len(walHeader))
+	l.records = 0
+	l.dirty = false
+	return nil
+}
+
+// append writes rec to the log, syncing according to the policy. If the
+// write or the sync fails, the caller does not apply rec, so the file is
+// truncated back to its last record for rec not to reappear on replay. A
+// failed sync also leaves the durability of earlier records unknown, so the
+// log refuses further appends until it is compacted or reopened, as it does
+// if the truncation fails.
+func (l *wal) append(rec walRecord) error {
+	buf := encodeRecord(nil, rec)
+	if n := len(buf) - walFrameSize; n > walMaxRecordSize {
+		return fmt.Errorf("kvstore: log record of %d bytes exceeds the limit of %d", n, walMaxRecordSize)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failed != nil {
+		return l.failed
+	}
+	if _, err := l.f.Write(buf); err != nil {
+		l.discard(err, false)
+		return err
+	}
+	if l.policy == SyncAlways {
+		if err := l.f.Sync(); err != nil {
+			l.discard(err, true)
+			return err
+		}
+	} else {
+		l.dirty = true
+	}
+	l.size += int64(len(buf))
+	l.records += rec.mutations()
+	return nil
+}
+
+// mutations returns the number of mutations rec records.
+func (rec walRecord) mutations() int {
+	if rec.op == walBatch {
+		return len(rec.batch)
+	}
+	return 1
+}
+
+// discard truncates the file to l.size after an append failed with cause,
+// marking the log failed if that fails too or if fail is set.
+func (l *wal) discard(cause error, fail bool) {
+	err := l.f.Truncate(l.size)
+	if err == nil {
+		_, err = l.f.Seek(l.size, io.SeekStart)
+	}
+	if err != nil || fail {
+		l.failed = fmt.Errorf("kvstore: log %s failed: %w", l.path, errors.Join(cause, err))
+	}
+}
+
+// sync flushes written records to stable storage.
+func (l *wal) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syncLocked()
+}
+
+func (l *wal) syncLocked() error {
+	if !l.dirty {
+		return nil
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// needsCompaction reports whether the log has failed, or has grown past
+// threshold bytes and holds more than twice as many records as there are
+// live keys.
+func (l *wal) needsCompaction(live int, threshold int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failed != nil || l.size >= threshold && l.records > 2*live
+}
+
+// compact rewrites the log so that it holds exactly one set record per entry
+// in data, with its deadline from expires. The new log is written beside the
+// old one and renamed over it, so a crash at any point leaves one complete
+// log on disk.
+func (l *wal) compact(data map[string]string, expires map[string]time.Time) error {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tmpPath := l.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	size := int64(len(walHeader))
+	_, err = w.WriteString(walHeader)
+	var buf []byte
+	for _, k := range keys {
+		if err != nil {
+			break
+		}
+		buf = encodeRecord(buf[:0], walRecord{op: walSet, key: k, value: data[k], expires: expires[k]})
+		size += int64(len(buf))
+		_, err = w.Write(buf)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := syncDir(l.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Seek(size, io.SeekStart); err != nil {
+		tmp.Close()
+		return err
+	}
+	l.f.Close()
+	l.f = tmp
+	l.size = size
+	l.records = len(keys)
+	l.dirty = false
+	l.failed = nil
+	return nil
+}
+
+// close syncs any outstanding records and closes the file.
+func (l *wal) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.syncLocked()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// encodeRecord appends the framed encoding of rec to buf.
+func encodeRecord(buf []byte, rec walRecord) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, walFrameSize)...)
+	buf = appendPayload(buf, rec)
+
+	payload := buf[start+walFrameSize:]
+	binary.LittleEndian.PutUint32(buf[start:], crc32.Checksum(payload, walCRC))
+	binary.LittleEndian.PutUint32(buf[start+4:], uint32(len(payload)))
+	return buf
+}
+
+// appendPayload appends the payload encoding of rec to buf.
+func appendPayload(buf []byte, rec walRecord) []byte {
+	buf = append(buf, byte(rec.op))
+	if rec.op == walBatch {
+		buf = binary.AppendUvarint(buf, uint64(len(rec.batch)))
+		var sub []byte
+		for _, r := range rec.batch {
+			sub = appendPayload(sub[:0], r)
+			buf = binary.AppendUvarint(buf, uint64(len(sub)))
+			buf = append(buf, sub...)
+		}
+		return buf
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(rec.key)))
+	buf = append(buf, rec.key...)
+	buf = binary.AppendUvarint(buf, uint64(len(rec.value)))
+	buf = append(buf, rec.value...)
+	if !rec.expires.IsZero() {
+		buf = binary.AppendVarint(buf, rec.expires.UnixNano())
+	}
+	return buf
+}
+
+// readRecord reads one framed record, returning it with its size on disk.
+// It returns io.EOF only at a clean record boundary.
+func readRecord(r *bufio.Reader) (walRecord, int64, error) {
+	var frame [walFrameSize]byte
+	n, err := io.ReadFull(r, frame[:])
+	if err != nil {
+		if err == io.EOF && n == 0 {
+			return walRecord{}, 0, io.EOF
+		}
+		return walRecord{}, 0, io.ErrUnexpectedEOF
+	}
+	sum := binary.LittleEndian.Uint32(frame[:4])
+	length := binary.LittleEndian.Uint32(frame[4:])
+	if length == 0 || length > walMaxRecordSize {
+		return walRecord{}, 0, errTornRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return walRecord{}, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.Checksum(payload, walCRC) != sum {
+		return walRecord{}, 0, errTornRecord
+	}
+	rec, err := decodePayload(payload)
+	if err != nil {
+		return walRecord{}, 0, err
+	}
+	return rec, walFrameSize + int64(length), nil
+}
+
+// decodePayload parses a record payload whose checksum has been verified.
+func decodePayload(p []byte) (walRecord, error) {
+	if len(p) == 0 {
+		return walRecord{}, errTornRecord
+	}
+	rec := walRecord{op: walOp(p[0])}
+	if rec.op < walSet || rec.op > walBatch {
+		return walRecord{}, errTornRecord
+	}
+	p = p[1:]
+	if rec.op == walBatch {
+		return decodeBatch(rec, p)
+	}
+	key, p, ok := readField(p)
+	if !ok {
+		return walRecord{}, errTornRecord
+	}
+	value, p, ok := readField(p)
+	if !ok {
+		return walRecord{}, errTornRecord
+	}
+	rec.key, rec.value = key, value
+	if rec.op == walSet && len(p) > 0 {
+		ns, w := binary.Varint(p)
+		if w <= 0 {
+			return walRecord{}, errTornRecord
+		}
+		rec.expires, p = time.Unix(0, ns), p[w:]
+	}
+	if len(p) != 0 {
+		return walRecord{}, errTornRecord
+	}
+	return rec, nil
+}
+
+// decodeBatch parses the mutations of a batch record.
+func decodeBatch(rec walRecord, p []byte) (walRecord, error) {
+	n, w := binary.Uvarint(p)
+	if w <= 0 || n > uint64(len(p)) {
+		return walRecord{}, errTornRecord
+	}
+	p = p[w:]
+	rec.batch = make([]walRecord, n)
+	for i := range rec.batch {
+		sub, rest, ok := readField(p)
+		if !ok || len(sub) == 0 || walOp(sub[0]) == walBatch {
+			return walRecord{}, errTornRecord
+		}
+		var err error
+		if rec.batch[i], err = decodePayload([]byte(sub)); err != nil {
+			return walRecord{}, err
+		}
+		p = rest
+	}
+	if len(p) != 0 {
+		return walRecord{}, errTornRecord
+	}
+	return rec, nil
+}
+
+// readField reads a uvarint length-prefixed string from p.
+func readField(p []byte) (string, []byte, bool) {
+	n, w := binary.Uvarint(p)
+	if w <= 0 || n > uint64(len(p)-w) {
+		return "", nil, false
+	}
+	p = p[w:]
+	return string(p[:n]), p[n:], true
+}
+
+// syncDir fsyncs the directory containing path so that a newly created or
+// renamed file survives a crash.
+func syncDir(path string) error {
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,301 @@
+package kvstore
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openLog opens the log backend at path, failing the test on error.
+func openLog(t *testing.T, path string, opts ...Option) *LogBackend {
+	t.Helper()
+	b, err := OpenLogBackend(path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// entries returns a backend's contents.
+func entries(t *testing.T, b Backend) map[string]string {
+	t.Helper()
+	keys, err := b.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for _, k := range keys {
+		v, _, err := b.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[k] = v
+	}
+	return m
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	b := openLog(t, path)
+	for _, op := range []func() error{
+		func() error { return b.Set("a", "1") },
+		func() error { return b.Set("b", "2") },
+		func() error { return b.Clear() },
+		func() error { return b.Set("c", "3") },
+		func() error { return b.Set("d", "4") },
+		func() error { return b.Delete("c") },
+		func() error { return b.Delete("missing") },
+		func() error { return b.Set("d", "5") },
+	} {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	b = openLog(t, path)
+	defer b.Close()
+	if got, want := entries(t, b), map[string]string{"d": "5"}; !maps.Equal(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+	if b.log.truncated != 0 {
+		t.Errorf("truncated %d bytes of a clean log", b.log.truncated)
+	}
+}
+
+func TestLogRecovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte, last int) []byte
+	}{
+		{"torn frame", func(data []byte, last int) []byte { return data[:last+walFrameSize/2] }},
+		{"torn payload", func(data []byte, last int) []byte { return data[:len(data)-1] }},
+		{"bad checksum", func(data []byte, last int) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}},
+		{"impossible length", func(data []byte, last int) []byte {
+			data[last+4], data[last+5], data[last+6], data[last+7] = 0xff, 0xff, 0xff, 0xff
+			return data
+		}},
+		{"zero length", func(data []byte, last int) []byte {
+			clear(data[last : last+walFrameSize])
+			return data
+		}},
+		{"unknown op", func(data []byte, last int) []byte {
+			return append(data[:last], encodeRecord(nil, walRecord{op: walClear + 9, key: "x"})...)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "kv.log")
+			b := openLog(t, path)
+			if err := b.Set("kept", "v"); err != nil {
+				t.Fatal(err)
+			}
+			last := int(b.log.size)
+			if err := b.Set("lost", "v"); err != nil {
+				t.Fatal(err)
+			}
+			b.Close()
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = tt.corrupt(data, last)
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			b = openLog(t, path)
+			if got, want := entries(t, b), map[string]string{"kept": "v"}; !maps.Equal(got, want) {
+				t.Errorf("recovered %v, want %v", got, want)
+			}
+			if want := int64(len(data) - last); b.log.truncated != want {
+				t.Errorf("truncated %d bytes, want %d", b.log.truncated, want)
+			}
+			if size := fileSize(t, path); size != int64(last) {
+				t.Errorf("log is %d bytes after recovery, want %d", size, last)
+			}
+
+			// Appends continue from the last good record.
+			if err := b.Set("after", "v"); err != nil {
+				t.Fatal(err)
+			}
+			b.Close()
+			b = openLog(t, path)
+			defer b.Close()
+			if got, want := entries(t, b), map[string]string{"kept": "v", "after": "v"}; !maps.Equal(got, want) {
+				t.Errorf("reopened %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLogHeader(t *testing.T) {
+	dir := t.TempDir()
+
+	foreign := filepath.Join(dir, "foreign")
+	if err := os.WriteFile(foreign, []byte("not a kvstore log"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := OpenLogBackend(foreign); err == nil {
+		b.Close()
+		t.Error("opened a file with a foreign header")
+	}
+
+	// A file too short to hold the header died before it was written, and
+	// is started afresh.
+	short := filepath.Join(dir, "short")
+	if err := os.WriteFile(short, []byte(walHeader[:3]), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b := openLog(t, short)
+	defer b.Close()
+	if n := b.Len(); n != 0 {
+		t.Errorf("new log has %d entries", n)
+	}
+	data, err := os.ReadFile(short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != walHeader {
+		t.Errorf("new log holds %q, want the header", data)
+	}
+}
+
+func TestLogCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	b := openLog(t, path, WithCompactionThreshold(0))
+	want := make(map[string]string)
+	for i := range 50 {
+		k := string(rune('a' + i%5))
+		v := string(rune('A' + i))
+		if err := b.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = v
+	}
+	if err := b.Delete("e"); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "e")
+	before := fileSize(t, path)
+
+	b.compact()
+	if after := fileSize(t, path); after >= before {
+		t.Errorf("log is %d bytes after compaction, was %d", after, before)
+	}
+	if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("compaction left its temporary file: %v", err)
+	}
+	if b.log.records != len(want) {
+		t.Errorf("compacted log has %d records, want %d", b.log.records, len(want))
+	}
+
+	// Appends go to the new file.
+	if err := b.Set("z", "after"); err != nil {
+		t.Fatal(err)
+	}
+	want["z"] = "after"
+	b.Close()
+
+	b = openLog(t, path)
+	defer b.Close()
+	if got := entries(t, b); !maps.Equal(got, want) {
+		t.Errorf("reopened %v, want %v", got, want)
+	}
+}
+
+// faultyFile is a log file whose next write or sync can be made to fail.
+// A failing write stores half of its bytes first, like a full disk.
+type faultyFile struct {
+	*os.File
+	failWrite, failSync bool
+}
+
+var errInjected = errors.New("injected failure")
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if f.failWrite {
+		f.failWrite = false
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, errInjected
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultyFile) Sync() error {
+	if f.failSync {
+		f.failSync = false
+		return errInjected
+	}
+	return f.File.Sync()
+}
+
+func TestLogFailedAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	b := openLog(t, path)
+	f := &faultyFile{File: b.log.f.(*os.File)}
+	b.log.f = f
+	if err := b.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A short write is cut off, and the log carries on.
+	f.failWrite = true
+	if err := b.Set("b", "2"); !errors.Is(err, errInjected) {
+		t.Fatalf("Set with failing write = %v", err)
+	}
+	if _, found, _ := b.Get("b"); found {
+		t.Error("failed Set was applied")
+	}
+	if size := fileSize(t, path); size != b.log.size {
+		t.Errorf("log is %d bytes, want %d", size, b.log.size)
+	}
+	if err := b.Set("c", "3"); err != nil {
+		t.Fatalf("Set after failed write = %v", err)
+	}
+
+	// A failed sync also removes the record, and fails the log until it
+	// is compacted.
+	f.failSync = true
+	if err := b.Set("d", "4"); !errors.Is(err, errInjected) {
+		t.Fatalf("Set with failing sync = %v", err)
+	}
+	if err := b.Set("e", "5"); !errors.Is(err, errInjected) {
+		t.Errorf("Set on failed log = %v", err)
+	}
+	if !b.log.needsCompaction(b.Len(), 1<<30) {
+		t.Error("failed log does not ask for compaction")
+	}
+	b.compact()
+	if err := b.Set("e", "5"); err != nil {
+		t.Errorf("Set after compaction = %v", err)
+	}
+	b.Close()
+
+	b = openLog(t, path)
+	defer b.Close()
+	want := map[string]string{"a": "1", "c": "3", "e": "5"}
+	if got := entries(t, b); !maps.Equal(got, want) {
+		t.Errorf("reopened %v, want %v", got, want)
+	}
+}
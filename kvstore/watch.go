@@ -0,0 +1,382 @@
+package kvstore
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aalpar/wile/machine"
+	"github.com/aalpar/wile/values"
+)
+
+// Change operations reported to watchers.
+const (
+	opSet    = "set"
+	opDelete = "delete"
+	opClear  = "clear"
+	opExpire = "expire"
+	opEvict  = "evict"
+)
+
+// change is one mutation of a key, with its encoded value before and after,
+// the deadline a set gave it if it has a TTL, and the revision it was
+// assigned. A clear in the change feed has no key.
+type change struct {
+	op       string
+	key      string
+	old, new string
+	hadOld   bool
+	hasNew   bool
+	expires  time.Time
+	rev      int64
+}
+
+// watcher is a callback registered for the keys that start with prefix.
+type watcher struct {
+	prefix string
+	fn     func(change) error
+}
+
+// recorder collects the changes an operation makes while it holds the
+// store's locks so watchers can be notified once they are released. Only
+// keys matching a watched prefix are recorded; prefixes is snapshotted when
+// the locks are taken.
+type recorder struct {
+	prefixes []string
+	changes  []change
+}
+
+func (r *recorder) watches(key string) bool {
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch registers w and returns its token.
+func (kv *KVStore) watch(w watcher) int64 {
+	kv.watchMu.Lock()
+	defer kv.watchMu.Unlock()
+	if kv.watchers == nil {
+		kv.watchers = make(map[int64]watcher)
+	}
+	kv.nextWatch++
+	kv.watchers[kv.nextWatch] = w
+	kv.publishWatchers()
+	return kv.nextWatch
+}
+
+// unwatch removes the watcher with the given token, reporting whether it
+// existed.
+func (kv *KVStore) unwatch(token int64) bool {
+	kv.watchMu.Lock()
+	defer kv.watchMu.Unlock()
+	_, ok := kv.watchers[token]
+	delete(kv.watchers, token)
+	kv.publishWatchers()
+	return ok
+}
+
+// publishWatchers replaces kv.watching with the watchers in token order, so
+// that writers can read them without taking watchMu. Callers hold watchMu.
+func (kv *KVStore) publishWatchers() {
+	tokens := make([]int64, 0, len(kv.watchers))
+	for t := range kv.watchers {
+		tokens = append(tokens, t)
+	}
+	slices.Sort(tokens)
+	watchers := make([]watcher, len(tokens))
+	for i, t := range tokens {
+		watchers[i] = kv.watchers[t]
+	}
+	kv.watching.Store(&watchers)
+}
+
+// currentWatchers returns the registered watchers in token order.
+func (kv *KVStore) currentWatchers() []watcher {
+	if ws := kv.watching.Load(); ws != nil {
+		return *ws
+	}
+	return nil
+}
+
+// newRecorder returns a recorder for the current watchers, or nil if there
+// are none, in which case mutations record nothing.
+func (kv *KVStore) newRecorder() *recorder {
+	watchers := kv.currentWatchers()
+	if len(watchers) == 0 {
+		return nil
+	}
+	r := &recorder{}
+	for _, w := range watchers {
+		r.prefixes = append(r.prefixes, w.prefix)
+	}
+	return r
+}
+
+// mutate runs fn under the write lock, recording the changes it makes, and
+// notifies watchers after the lock is released.
+func (kv *KVStore) mutate(ctx context.Context, fn func(*storeView) error) error {
+	changes, err := kv.recordChanges(kv.lock, kv.mu.Unlock, fn)
+	kv.notify(ctx, changes)
+	return err
+}
+
+// recordChanges runs fn between lock and unlock on a view that records the
+// changes it makes, and returns them.
+func (kv *KVStore) recordChanges(lock func() error, unlock func(), fn func(*storeView) error) ([]change, error) {
+	if err := lock(); err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := kv.loadIndex(); err != nil {
+		return nil, err
+	}
+	sv := &storeView{KVStore: kv, rec: kv.newRecorder()}
+	err := fn(sv)
+	if sv.rec == nil {
+		return nil, err
+	}
+	return sv.rec.changes, err
+}
+
+// record assigns ch the next revision, appends it to the change feed and
+// queues it for watchers of its key. Callers hold the key's segment for
+// writing, or kv.mu, and have already applied the change. It returns the
+// revision.
+func (sv *storeView) record(ch change) int64 {
+	ch.rev = sv.changes.append(ch)
+	sv.remember(ch)
+	if sv.rec != nil && sv.rec.watches(ch.key) {
+		sv.rec.changes = append(sv.rec.changes, ch)
+	}
+	return ch.rev
+}
+
+// notify calls every watcher whose prefix matches a change, in change order
+// and then registration order; Scheme watchers queue the change for their
+// engine. A watcher that fails or panics is skipped; the mutation has
+// already been applied. ctx is that of the operation that made the changes,
+// and is used only to find its engine, which then delivers its own queued
+// events.
+func (kv *KVStore) notify(ctx context.Context, changes []change) {
+	if len(changes) == 0 {
+		return
+	}
+	watchers := kv.currentWatchers()
+	for _, ch := range changes {
+		for _, w := range watchers {
+			if strings.HasPrefix(ch.key, w.prefix) {
+				kv.callWatcher(w, ch)
+			}
+		}
+	}
+	if b := bindingFrom(ctx); b != nil {
+		b.deliver(ctx, callerFrom(ctx))
+	}
+}
+
+// callWatcher calls w for ch, logging an error or panic instead of passing
+// it on.
+func (kv *KVStore) callWatcher(w watcher, ch change) {
+	defer func() {
+		if r := recover(); r != nil {
+			kv.logger.Warn("watcher panicked", "prefix", w.prefix, "key", ch.key, "panic", r)
+		}
+	}()
+	if err := w.fn(ch); err != nil {
+		kv.logger.Warn("watcher failed", "prefix", w.prefix, "key", ch.key, "err", err)
+	}
+}
+
+// schemeWatcher adapts a Scheme procedure taking (event key old new) to a
+// watcher. Missing values are passed as #f. A change may be made by any
+// engine or by the host, so the watcher only queues it on owner, the binding
+// of the engine that registered it; owner calls the procedure on its own
+// machine.
+func schemeWatcher(prefix string, proc values.Value, owner *binding) watcher {
+	return watcher{prefix: prefix, fn: func(ch change) error {
+		owner.enqueue(event{prefix: prefix, proc: proc, ch: ch})
+		return nil
+	}}
+}
+
+// maxPendingEvents bounds the watch events queued for one engine. When an
+// engine falls further behind, its oldest events are dropped.
+const maxPendingEvents = 1024
+
+// binding is the state shared by the primitives registered for one engine:
+// the watch events waiting to be delivered to the procedures it passed to
+// kv-watch. Events are queued by whichever goroutine made the change and
+// delivered by the engine's own primitives, on its machine.
+type binding struct {
+	kv       *KVStore
+	policy   *Policy // nil for an unrestricted engine
+	mu       sync.Mutex
+	pending  []event
+	dropped  int
+	draining bool
+
+	// The watches the engine registered, and whether release has removed
+	// them since it last registered one.
+	watches  map[watchRef]struct{}
+	released bool
+}
+
+// watchRef names a watch registered on a store, or a named store, by its
+// token.
+type watchRef struct {
+	kv    *KVStore
+	token int64
+}
+
+// event is a change waiting to be delivered to a Scheme watcher.
+type event struct {
+	prefix string
+	proc   values.Value
+	ch     change
+}
+
+func newBinding(kv *KVStore, p *Policy) *binding {
+	return &binding{kv: kv, policy: p}
+}
+
+// context returns ctx as seen by a primitive of b's engine called on mc: it
+// carries the caller, b, and b's policy in place of any policy ctx had.
+func (b *binding) context(ctx context.Context, mc *machine.MachineContext) context.Context {
+	ctx = context.WithValue(withCaller(ctx, mc), bindingKey{}, b)
+	return context.WithValue(ctx, policyKey{}, b.policy)
+}
+
+// bindingKey is the context key under which a primitive passes the binding
+// it was registered with.
+type bindingKey struct{}
+
+// bindingFrom returns the binding carried by ctx, or nil.
+func bindingFrom(ctx context.Context) *binding {
+	b, _ := ctx.Value(bindingKey{}).(*binding)
+	return b
+}
+
+// track records that b's engine registered the watch token on kv.
+func (b *binding) track(kv *KVStore, token int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.watches == nil {
+		b.watches = make(map[watchRef]struct{})
+	}
+	b.watches[watchRef{kv, token}] = struct{}{}
+	b.released = false
+}
+
+// untrack forgets the watch token on kv.
+func (b *binding) untrack(kv *KVStore, token int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.watches, watchRef{kv, token})
+}
+
+// release removes the watches b's engine registered and drops its queued
+// events, once the engine has closed. Events for watches not yet removed
+// when a writer picked them up are not queued either.
+func (b *binding) release() {
+	b.mu.Lock()
+	watches := b.watches
+	b.watches = nil
+	b.pending = nil
+	b.dropped = 0
+	b.released = true
+	b.mu.Unlock()
+	for ref := range watches {
+		ref.kv.unwatch(ref.token)
+	}
+}
+
+func (b *binding) enqueue(e event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.released {
+		return
+	}
+	if len(b.pending) == maxPendingEvents {
+		b.pending = b.pending[1:]
+		b.dropped++
+	}
+	b.pending = append(b.pending, e)
+}
+
+// deliver calls the procedures of the queued events in order on mc, which
+// belongs to the binding's engine, and returns how many it called. Events
+// queued by the callbacks are delivered too. It does nothing inside a
+// transaction, whose writes are not yet visible, or inside a callback it is
+// already running.
+func (b *binding) deliver(ctx context.Context, mc *machine.MachineContext) int {
+	if mc == nil || inTransaction(ctx) {
+		return 0
+	}
+	ctx = b.context(ctx, mc)
+	b.mu.Lock()
+	if b.draining {
+		b.mu.Unlock()
+		return 0
+	}
+	b.draining = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.draining = false
+		b.mu.Unlock()
+	}()
+	n := 0
+	for {
+		b.mu.Lock()
+		if len(b.pending) == 0 {
+			b.pending = nil
+			b.mu.Unlock()
+			return n
+		}
+		e := b.pending[0]
+		b.pending = b.pending[1:]
+		dropped := b.dropped
+		b.dropped = 0
+		b.mu.Unlock()
+		if dropped > 0 {
+			b.kv.logger.Warn("watch events dropped", "count", dropped, "limit", maxPendingEvents)
+		}
+		b.call(ctx, mc, e)
+		n++
+	}
+}
+
+// call calls e's procedure, logging an error or panic instead of passing it
+// on: the change has already been applied.
+func (b *binding) call(ctx context.Context, mc *machine.MachineContext, e event) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.kv.logger.Warn("watcher panicked", "prefix", e.prefix, "key", e.ch.key, "panic", r)
+		}
+	}()
+	_, err := callProcedure(ctx, mc, e.proc,
+		values.NewSymbol(e.ch.op), values.NewString(e.ch.key),
+		eventValue(e.ch.old, e.ch.hadOld), eventValue(e.ch.new, e.ch.hasNew))
+	if err != nil {
+		b.kv.logger.Warn("watcher failed", "prefix", e.prefix, "key", e.ch.key, "err", err)
+	}
+}
+
+// eventValue decodes a stored value for a watcher, or returns #f if there is
+// none.
+func eventValue(enc string, ok bool) values.Value {
+	if !ok {
+		return values.FalseValue
+	}
+	v, err := decodeValue(enc)
+	if err != nil {
+		return values.FalseValue
+	}
+	return v
+}
@@ -0,0 +1,163 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordEvents is Scheme that makes an engine collect the events of a watch
+// on prefix; (events-seen) returns them oldest first.
+func recordEvents(prefix string) string {
+	return fmt.Sprintf(`
+		(define events '())
+		(define (events-seen) (reverse events))
+		(kv-watch %q (lambda (event key old new)
+		               (set! events (cons (list event key old new) events))))`, prefix)
+}
+
+func TestWatchEngines(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.now), WithJanitorInterval(time.Hour))
+	a := newEngine(t, store)
+	b := newEngine(t, store)
+	eval(t, a, recordEvents("k"))
+
+	// A watcher sees its own engine's writes before they return.
+	eval(t, a, `(kv-set! "k1" 1) (kv-set! "other" 0)`)
+	check(t, a, `(equal? (events-seen) '((set "k1" #f 1)))`)
+
+	// Another engine's writes wait for the watching engine to use the
+	// store, and run on its machine.
+	eval(t, b, `(kv-set! "k2" 2)`)
+	check(t, a,
+		`(= (length (events-seen)) 1)`,
+		`(= (kv-poll-watches) 1)`,
+		`(equal? (events-seen) '((set "k1" #f 1) (set "k2" #f 2)))`)
+	check(t, b, `(= (kv-poll-watches) 0)`)
+
+	// Host writes and expiries are delivered the same way, before the next
+	// primitive runs.
+	if err := store.Set("k3", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetWithTTL("k4", "y", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Second)
+	store.evictExpired()
+	check(t, a,
+		`(equal? (kv-get "k3") "x")`,
+		`(equal? (events-seen)
+		         '((set "k1" #f 1) (set "k2" #f 2) (set "k3" #f "x") (delete "k1" 1 #f)
+		           (set "k4" #f "y") (expire "k4" "y" #f)))`)
+
+	// Nothing is delivered inside a transaction.
+	eval(t, b, `(kv-set! "k5" 5)`)
+	check(t, a,
+		`(= (kv-transaction (lambda () (kv-poll-watches))) 0)`,
+		`(= (length (events-seen)) 7)`)
+}
+
+func TestWatchEngineClose(t *testing.T) {
+	store := New()
+	named, err := store.namedStore("named")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newEngine(t, store.Restrict(Policy{}))
+	b := newEngine(t, store.Restrict(Policy{}))
+	eval(t, a, recordEvents("k"))
+	eval(t, a, `(kv-store-watch (kv-open "named") "" (lambda args #t))`)
+	eval(t, b, recordEvents("k"))
+	if n := len(store.currentWatchers()); n != 2 {
+		t.Fatalf("store has %d watchers, want 2", n)
+	}
+
+	// Closing A removes its watches, on named stores too, and leaves B's.
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(store.currentWatchers()); n != 1 {
+		t.Errorf("store has %d watchers after A closed, want 1", n)
+	}
+	if n := len(named.currentWatchers()); n != 0 {
+		t.Errorf("named store has %d watchers after A closed, want 0", n)
+	}
+	eval(t, b, `(kv-set! "k1" 1) (kv-store-set! (kv-open "named") "k1" 1)`)
+	check(t, b, `(equal? (events-seen) '((set "k1" #f 1)))`)
+
+	// Closing an engine that loaded the store removes the watches of every
+	// engine that loaded it, but not Watch callbacks.
+	store = New()
+	c := newEngine(t, store)
+	eval(t, c, recordEvents("k"))
+	store.Watch("k", func(Event) {})
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(store.currentWatchers()); n != 1 {
+		t.Errorf("store has %d watchers after closing, want 1", n)
+	}
+}
+
+func TestWatchCallbackWrites(t *testing.T) {
+	engine := newEngine(t, New())
+	eval(t, engine, recordEvents("n"))
+
+	// A callback's own writes are queued and delivered by the same pass,
+	// in order, rather than recursively.
+	eval(t, engine, `
+		(kv-watch "n" (lambda (event key old new)
+		                (when (equal? key "n1") (kv-set! "n2" new))))
+		(kv-set! "n1" 1)`)
+	check(t, engine, `(equal? (events-seen) '((set "n1" #f 1) (set "n2" #f 1)))`)
+}
+
+func TestWatchOverflow(t *testing.T) {
+	store := New()
+	engine := newEngine(t, store)
+	eval(t, engine, recordEvents(""))
+	for i := range maxPendingEvents + 6 {
+		if err := store.Set(fmt.Sprintf("k%04d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(t, engine,
+		fmt.Sprintf(`(= (kv-poll-watches) %d)`, maxPendingEvents),
+		`(equal? (cadr (car (events-seen))) "k0006")`)
+}
+
+func TestWatchConcurrent(t *testing.T) {
+	store := New()
+	watching := newEngine(t, store)
+	writing := newEngine(t, store)
+	eval(t, watching, recordEvents("k"))
+
+	const writes = 200
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range writes {
+			if _, err := writing.EvalMultiple(context.Background(), fmt.Sprintf(`(kv-set! "k%d" %d)`, i, i)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for range writes {
+		eval(t, watching, `(kv-poll-watches)`)
+	}
+	wg.Wait()
+	eval(t, watching, `(kv-poll-watches)`)
+	check(t, watching, fmt.Sprintf(`(= (length (events-seen)) %d)`, writes))
+}
@@ -1,6 +1,7 @@
 #!/usr/bin/env bash
 # Run all example binaries from a dist directory and verify they exit 0.
-# Each example gets a 30-second timeout to catch hangs.
+# Each example gets a 30-second timeout to catch hangs. Servers, which run
+# until interrupted, are skipped.
 #
 # Usage:
 #   ./tools/sh/run-examples.sh <dist-dir>
@@ -15,6 +16,7 @@ if [ ! -d "$DIST_DIR" ]; then
 fi
 
 TIMEOUT="${EXAMPLE_TIMEOUT:-30}"
+SKIP=(kv-server)
 
 # Detect timeout command (GNU timeout or macOS gtimeout via coreutils)
 if command -v timeout >/dev/null 2>&1; then
@@ -34,6 +36,10 @@ for bin in "$DIST_DIR"/*; do
     [ -f "$bin" ] || continue
 
     name=$(basename "$bin")
+    if [[ " ${SKIP[*]} " == *" $name "* ]]; then
+        echo "  $name... skipped"
+        continue
+    fi
     echo -n "  $name... "
 
     if "${TIMEOUT_CMD[@]}" "$TIMEOUT" "$bin" >/dev/null 2>&1; then